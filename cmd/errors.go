@@ -0,0 +1,127 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// The exit statuses of the command, so that scripts may tell the kinds of failure apart
+const (
+	exitError       = 1
+	exitUsage       = 2
+	exitAuth        = 3
+	exitNotFound    = 4
+	exitRateLimited = 5
+	exitInvalid     = 6
+	exitNetwork     = 7
+	exitCrypto      = 8
+	exitDaemon      = 9
+	exitInterrupted = 130
+)
+
+// exitStatus is the exit status of the command that failed with err
+func exitStatus(err error) int {
+	// the registry error codes that are not a kind of their own
+	if apiErr, ok := registry.AsAPIError(err); ok {
+		switch apiErr.Code() {
+		case registry.ErrorCodeTooManyRequests:
+			return exitRateLimited
+		case registry.ErrorCodeNameInvalid,
+			registry.ErrorCodeTagInvalid,
+			registry.ErrorCodeDigestInvalid,
+			registry.ErrorCodeSizeInvalid,
+			registry.ErrorCodeManifestInvalid,
+			registry.ErrorCodeManifestUnverified,
+			registry.ErrorCodeBlobUploadInvalid,
+			registry.ErrorCodeUnsupported:
+			return exitInvalid
+		}
+	}
+
+	switch utils.KindOf(err) {
+	case utils.KindUsage:
+		return exitUsage
+	case utils.KindAuth:
+		return exitAuth
+	case utils.KindNotFound:
+		return exitNotFound
+	case utils.KindNetwork:
+		return exitNetwork
+	case utils.KindCrypto, utils.KindPolicy:
+		return exitCrypto
+	case utils.KindDaemon:
+		return exitDaemon
+	}
+
+	return exitError
+}
+
+// hint suggests what to do about err
+func hint(err error) string {
+	// an image refused by the policy is not a wrong passphrase or tampering
+	if utils.KindOf(err) == utils.KindPolicy {
+		return "The image is outside the decryption policy. If it is trusted, see --allow-legacy-format, " +
+			"--allow-type, --min-kdf-cost, --max-kdf-cost and --max-passphrase-shares."
+	}
+
+	switch exitStatus(err) {
+	case exitUsage:
+		return "Run crypto-cli --help for usage."
+	case exitAuth:
+		return "The registry denied access to the repository. Check that you are logged in " +
+			"(crypto-cli login) and that the account may access it."
+	case exitNotFound:
+		return "The image does not exist. Check the name and tag."
+	case exitRateLimited:
+		return "The registry is limiting requests. Try again later."
+	case exitInvalid:
+		return "The registry rejected the request as invalid or unsupported."
+	case exitNetwork:
+		return "The registry could not be reached or is unavailable. Check the network " +
+			"and proxy settings or try again later."
+	case exitCrypto:
+		return "The image could not be decrypted. Check the passphrase; if it is correct, " +
+			"the image may have been tampered with."
+	case exitDaemon:
+		return "The docker daemon failed. Check that it is running and accessible."
+	}
+
+	return ""
+}
+
+// classifyUsageErrors marks the errors of invalid flags and arguments of cmd and its
+// subcommands as usage errors
+func classifyUsageErrors(cmd *cobra.Command) {
+	cmd.SetFlagErrorFunc(func(_ *cobra.Command, err error) error {
+		return utils.WithKind(utils.KindUsage, err)
+	})
+
+	var visit func(c *cobra.Command)
+	visit = func(c *cobra.Command) {
+		if args := c.Args; args != nil {
+			c.Args = func(c *cobra.Command, a []string) error {
+				return utils.WithKind(utils.KindUsage, args(c, a))
+			}
+		}
+		for _, sub := range c.Commands() {
+			visit(sub)
+		}
+	}
+	visit(cmd)
+}
@@ -0,0 +1,92 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+var (
+	inspectDecrypt bool
+	inspectFormat  string
+)
+
+// inspectCmd represents the inspect command
+var inspectCmd = &cobra.Command{
+	Use:   "inspect [OPTIONS] NAME[:TAG]",
+	Short: "Show how an image in a remote repository is encrypted.",
+	Long: `inspect obtains the manifest of an image from a remote repository and shows, for
+the config and each layer, whether it is encrypted and with what algorithms and parameters.
+Nothing is decrypted unless --decrypt is given, in which case the config is also downloaded
+and decrypted to show the history and labels of the image.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		switch inspectFormat {
+		case "table", "json":
+		default:
+			return utils.NewKindError(utils.KindUsage, "invalid format: "+inspectFormat)
+		}
+		if err := checkFlagsPull(cmd.Flags()); err != nil {
+			return err
+		}
+		return runInspect(args[0], &opts)
+	},
+	Args: cobra.ExactArgs(1),
+}
+
+func runInspect(remote string, opts *crypto.Opts) error {
+	ref, err := reference.ParseNormalizedNamed(remote)
+	if err != nil {
+		return errors.Wrapf(err, "remote = %s", remote)
+	}
+
+	insp, err := images.InspectImage(ctx, ref, opts, inspectDecrypt, tempDir)
+	if err != nil {
+		return err
+	}
+
+	if inspectFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(insp))
+	}
+
+	return insp.WriteTable(os.Stdout)
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+
+	inspectCmd.Flags().BoolVar(
+		&inspectDecrypt,
+		"decrypt",
+		false,
+		"Also decrypt the config and show the history and labels of the image.",
+	)
+	inspectCmd.Flags().StringVar(
+		&inspectFormat,
+		"format",
+		"table",
+		"The output format, either table or json.",
+	)
+}
@@ -0,0 +1,292 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+var (
+	keyType      string
+	keyName      string
+	keyPublic    bool
+	keyOutput    string
+	keystorePath string
+
+	// keyCmd represents the key command
+	keyCmd = &cobra.Command{
+		Use:   "key [command]",
+		Short: "Manage the keys and identities in the local keystore.",
+		Long: `key manages a local keystore of named keys, with which images may be encrypted instead
+of with a passphrase. The keystore is itself encrypted with a passphrase, which is given in
+the same ways as the passphrase of an image.
+
+A symmetric key both encrypts and decrypts images. An x25519 identity is a key pair: images
+are encrypted to its public part, which may be exported and shared, and only the holder of
+the private part may decrypt them. An x25519-mlkem768 identity is the same, but combines
+X25519 with the post-quantum ML-KEM-768, so that images encrypted to it now cannot be
+decrypted later by a quantum computer.`,
+	}
+
+	keyGenerateCmd = &cobra.Command{
+		Use:   "generate [OPTIONS] NAME",
+		Short: "Generate a new key in the keystore.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			k, err := crypto.GenerateKey(args[0], crypto.KeyType(keyType))
+			if err != nil {
+				return err
+			}
+			return addKey(cmd.Flags(), k)
+		},
+		Args: cobra.ExactArgs(1),
+	}
+
+	keyImportCmd = &cobra.Command{
+		Use:   "import [OPTIONS] [FILE]",
+		Short: "Import a key exported by key export, from a file or stdin.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			filename := ""
+			if len(args) == 1 {
+				filename = args[0]
+			}
+			return runKeyImport(cmd.Flags(), filename)
+		},
+		Args: cobra.MaximumNArgs(1),
+	}
+
+	keyListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the keys in the keystore.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ks, _, err := openKeystore(cmd.Flags())
+			if err != nil {
+				return err
+			}
+
+			keys, err := ks.List()
+			if err != nil {
+				return err
+			}
+
+			return printKeys(os.Stdout, keys)
+		},
+		Args: cobra.NoArgs,
+	}
+
+	keyExportCmd = &cobra.Command{
+		Use:   "export [OPTIONS] NAME",
+		Short: "Export a key from the keystore, e.g. to share the public part of an identity.",
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			ks, _, err := openKeystore(cmd.Flags())
+			if err != nil {
+				return
+			}
+
+			k, err := ks.Get(args[0])
+			if err != nil {
+				return
+			}
+
+			if keyPublic {
+				if k, err = k.PublicOnly(); err != nil {
+					return
+				}
+			} else {
+				log.Warn().Msgf("Exporting the secret key %s, keep it safe.", k.Name)
+			}
+
+			data, err := json.MarshalIndent(k, "", "  ")
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			data = append(data, '\n')
+
+			if keyOutput == "" {
+				_, err = os.Stdout.Write(data)
+				return errors.WithStack(err)
+			}
+
+			return errors.WithStack(ioutil.WriteFile(keyOutput, data, 0600))
+		},
+		Args: cobra.ExactArgs(1),
+	}
+
+	keyDeleteCmd = &cobra.Command{
+		Use:   "delete NAME",
+		Short: "Delete a key from the keystore.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ks, _, err := openKeystore(cmd.Flags())
+			if err != nil {
+				return err
+			}
+
+			if err = ks.Delete(args[0]); err != nil {
+				return err
+			}
+
+			if err = ks.Save(); err != nil {
+				return err
+			}
+
+			log.Info().Msgf("Deleted key %s.", args[0])
+			return nil
+		},
+		Args: cobra.ExactArgs(1),
+	}
+)
+
+// openKeystore opens the keystore, obtaining its passphrase from the flags or by
+// prompting for it when it is first needed. given reports whether the passphrase was
+// given by a flag.
+func openKeystore(flags *pflag.FlagSet) (_ *crypto.Keystore, given bool, err error) {
+	provider, err := passphraseProvider(flags)
+	if err != nil {
+		return
+	}
+
+	opts.SetPassphraseProvider(provider)
+	ks := crypto.NewKeystore(keystorePath, crypto.PassphraseFunc(func() (crypto.Secret, error) {
+		passphrase, err := opts.GetPassphrase(crypto.StdinPassReader)
+		if err != nil {
+			return nil, err
+		}
+		// the keystore wipes its copy, and opts wipes the passphrase when the command ends
+		return passphrase.Copy(), nil
+	}))
+
+	return ks, provider != nil, nil
+}
+
+// runKeyImport imports a key from filename, or from stdin if it is empty
+func runKeyImport(flags *pflag.FlagSet, filename string) (err error) {
+	var r io.Reader = os.Stdin
+	if filename != "" {
+		// the file is named by the user to be read
+		fh, err := os.Open(filename) // #nosec
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer func() { err = utils.CheckedClose(fh, err) }()
+		r = fh
+	}
+
+	k := &crypto.Key{}
+	if err = json.NewDecoder(r).Decode(k); err != nil {
+		return utils.WithKind(utils.KindUsage, errors.Wrap(err, "could not decode key"))
+	}
+
+	if keyName != "" {
+		k.Name = keyName
+	}
+
+	return addKey(flags, k)
+}
+
+// addKey adds k to the keystore, creating the keystore if it does not exist
+func addKey(flags *pflag.FlagSet, k *crypto.Key) (err error) {
+	ks, given, err := openKeystore(flags)
+	if err != nil {
+		return
+	}
+
+	// the passphrase of a new keystore is confirmed, unless it was given by a flag
+	if !ks.Exists() {
+		log.Info().Msgf("Creating keystore %s.", keystorePath)
+		if !given {
+			if err = confirmPassphrase(); err != nil {
+				return
+			}
+		}
+	}
+
+	if err = ks.Add(k); err != nil {
+		return
+	}
+
+	if err = ks.Save(); err != nil {
+		return
+	}
+
+	log.Info().Msgf("Added %s key %s with ID %s.", k.Type, k.Name, k.ID)
+	return
+}
+
+// printKeys writes a human readable table describing keys to w
+func printKeys(w io.Writer, keys []*crypto.Key) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "NAME\tTYPE\tID\tPRIVATE\tCREATED")
+	for _, k := range keys {
+		fmt.Fprintf(
+			tw,
+			"%s\t%s\t%s\t%t\t%s\n",
+			k.Name,
+			k.Type,
+			k.ID,
+			len(k.Private) > 0,
+			k.Created.Format("2006-01-02 15:04:05"),
+		)
+	}
+
+	return errors.WithStack(tw.Flush())
+}
+
+func init() {
+	rootCmd.AddCommand(keyCmd)
+	keyCmd.AddCommand(keyGenerateCmd, keyImportCmd, keyListCmd, keyExportCmd, keyDeleteCmd)
+
+	keyGenerateCmd.Flags().StringVarP(
+		&keyType,
+		"type",
+		"t",
+		string(crypto.SymmetricKey),
+		`The type of key to generate, symmetric, x25519 or x25519-mlkem768.`,
+	)
+
+	keyImportCmd.Flags().StringVar(
+		&keyName,
+		"name",
+		"",
+		`The name to give the imported key, instead of the name it was exported with.`,
+	)
+
+	keyExportCmd.Flags().BoolVar(
+		&keyPublic,
+		"public",
+		false,
+		`Export only the public part of an identity.`,
+	)
+
+	keyExportCmd.Flags().StringVarP(
+		&keyOutput,
+		"output",
+		"o",
+		"",
+		`Write the key to the given file instead of stdout.`,
+	)
+}
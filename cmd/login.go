@@ -0,0 +1,80 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/images"
+)
+
+// loginCmd represents the login command
+var loginCmd = &cobra.Command{
+	Use:   "login [OPTIONS] [SERVER]",
+	Short: "Log in to a registry.",
+	Long: `login checks a username and password against a registry and stores them for use by
+push, pull and the other commands. If no server is given, Docker Hub is used. The credentials
+are stored in the same place as docker login would store them, i.e. in the credential helper
+or credential store configured in the docker config file, or in that file itself.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		server := ""
+		if len(args) == 1 {
+			server = args[0]
+		}
+		return runLogin(server)
+	},
+	Args: cobra.MaximumNArgs(1),
+}
+
+func runLogin(server string) (err error) {
+	// the password has already been read by overrideCreds if the username was given
+	if username == "" {
+		if passStdin {
+			return errors.New("--password-stdin requires --username")
+		}
+
+		fmt.Print("Username: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if username = strings.TrimSpace(line); username == "" {
+			return errors.New("username is required")
+		}
+
+		if password, err = readPassword(); err != nil {
+			return err
+		}
+	}
+
+	if err = images.Login(ctx, server, username, password); err != nil {
+		return
+	}
+
+	log.Info().Msg("Login Succeeded.")
+	return
+}
+
+func init() {
+	rootCmd.AddCommand(loginCmd)
+}
@@ -23,6 +23,7 @@ import (
 
 	"github.com/Senetas/crypto-cli/crypto"
 	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/utils"
 )
 
 // pullCmd represents the pull command
@@ -33,20 +34,67 @@ var pullCmd = &cobra.Command{
 load that images into the local docker engine. It is then available to be run under the same
 name as it was downloaded.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		cmd.Flags().VisitAll(checkFlagsPull)
+		if err := checkFlagsPull(cmd.Flags()); err != nil {
+			return err
+		}
 		return runPull(args[0], &opts)
 	},
 	Args: cobra.ExactArgs(1),
 }
 
-func checkFlagsPull(f *pflag.Flag) {
-	switch f.Name {
-	case "pass":
-		if f.Changed {
-			opts.SetPassphrase(passphrase)
+// checkFlagsPull sets where the passphrase to decrypt with is obtained from. If it was
+// not given, it is prompted for when it is needed. Images encrypted with a key are
+// decrypted with the key of the same ID from the keystore, whose passphrase is the same,
+// images whose keys were wrapped with the configured key wrapping provider of the same
+// name, and images whose key was split into shares with the keys and passphrases of enough
+// shares. Images outside the policy of --min-kdf-cost, --max-kdf-cost,
+// --max-passphrase-shares, --allow-type and --allow-legacy-format are not decrypted.
+func checkFlagsPull(flags *pflag.FlagSet) (err error) {
+	if err = checkPolicy(); err != nil {
+		return
+	}
+
+	ks, _, err := openKeystore(flags)
+	if err != nil {
+		return
+	}
+	opts.Keys = ks
+
+	for _, filename := range sharePassFiles {
+		opts.SharePassphrases = append(opts.SharePassphrases, crypto.FilePassphrase(filename))
+	}
+
+	opts.Wrappers, err = keyWrappers()
+	return
+}
+
+// checkPolicy validates the policy of the images that are decrypted and sets it
+func checkPolicy() error {
+	if policy.MinKDFCost < 0 || policy.MaxKDFCost < 0 || policy.MaxPassphraseShares < 0 {
+		return utils.NewKindError(
+			utils.KindUsage,
+			"--min-kdf-cost, --max-kdf-cost and --max-passphrase-shares cannot be negative",
+		)
+	} else if policy.MaxKDFCost > 0 && policy.MinKDFCost > policy.MaxKDFCost {
+		return utils.NewKindError(utils.KindUsage, "--min-kdf-cost cannot be greater than --max-kdf-cost")
+	}
+
+	policy.Algos = nil
+	for _, a := range allowedAlgos {
+		algos, err := crypto.ValidateAlgos(a)
+		if err != nil {
+			return utils.WithKind(utils.KindUsage, errors.Wrapf(err, "--allow-type %s", a))
 		}
-	default:
+		policy.Algos = append(policy.Algos, algos)
 	}
+
+	policy.MinVersion = crypto.LatestVersion
+	if allowLegacyFormat {
+		policy.MinVersion = 0
+	}
+
+	opts.Policy = policy
+	return nil
 }
 
 func runPull(remote string, opts *crypto.Opts) error {
@@ -55,7 +103,7 @@ func runPull(remote string, opts *crypto.Opts) error {
 		return errors.Wrapf(err, "remote = %s", remote)
 	}
 	log.Info().Msgf("Obtaining manifest for image: %s", ref)
-	return images.PullImage(ref, opts, tempDir)
+	return images.PullImage(ctx, ref, opts, tempDir)
 }
 
 func init() {
@@ -15,13 +15,35 @@
 package cmd
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
 	"github.com/Senetas/crypto-cli/crypto"
 	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+var (
+	// pushKey is the name of the key in the keystore to encrypt with
+	pushKey string
+	// wrapProvider and wrapKey are the key wrapping provider and its key to encrypt with
+	wrapProvider string
+	wrapKey      string
+	// threshold is the number of shares needed to decrypt, which are encrypted to the keys
+	// named by shareKeys, with the passphrases in sharePassFiles and with sharePassCount
+	// passphrases that are prompted for
+	threshold      int
+	shareKeys      []string
+	sharePassCount int
+	// sharePasses are the passphrases that were prompted for, wiped when the command ends
+	sharePasses []crypto.Secret
+	// cipherStr is the cipher to encrypt with
+	cipherStr string
 )
 
 // pushCmd represents the push command
@@ -34,38 +56,209 @@ confidentially. It does not sign images so cannot guarantee identities.`,
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
 		opts.Algos, err = crypto.ValidateAlgos(typeStr)
 		if err != nil {
+			return utils.WithKind(utils.KindUsage, err)
+		}
+		if err = checkFlagsPush(cmd.Flags()); err != nil {
 			return err
 		}
-		cmd.Flags().VisitAll(checkFlagsPush)
 		return runPush(args[0], &opts)
 	},
 	Args: cobra.ExactArgs(1),
 }
 
-func checkFlagsPush(f *pflag.Flag) {
-	switch f.Name {
-	case "pass":
-		if opts.Algos != crypto.None {
-			if !f.Changed {
-				var err error
-				passphrase, err = crypto.GetPassSTDIN("Enter passphrase: ", crypto.StdinPassReader)
-				if err != nil {
-					log.Fatal().Err(err).Msgf("Could not obtain passphrase")
-				}
-
-				passphrase1, err := crypto.GetPassSTDIN("Re-enter passphrase: ", crypto.StdinPassReader)
-				if err != nil {
-					log.Fatal().Err(err).Msgf("Could not obtain passphrase")
-				}
-
-				if passphrase != passphrase1 {
-					log.Fatal().Msg("Passphrases do not match.")
-				}
+// checkFlagsPush sets where the passphrase to encrypt with is obtained from, or the key or
+// key wrapping provider if one was given. If none was given, the passphrase is prompted for
+// twice.
+func checkFlagsPush(flags *pflag.FlagSet) (err error) {
+	if opts.Cipher, err = crypto.ValidateCipher(cipherStr); err != nil {
+		return utils.WithKind(utils.KindUsage, err)
+	}
+
+	if err = crypto.ValidateKDFCost(opts.Iter); err != nil {
+		return utils.WithKind(utils.KindUsage, errors.Wrap(err, "--kdf-cost"))
+	}
+
+	switch {
+	case threshold > 0:
+		return useShares(flags)
+	case pushKey != "" && wrapProvider != "":
+		return utils.NewKindError(utils.KindUsage, "--key cannot be combined with --wrap-provider")
+	case pushKey != "":
+		return useKey(flags)
+	case wrapProvider != "":
+		return useWrapper(flags)
+	}
+
+	switch opts.Algos.KeySource() {
+	case crypto.KeystoreSource:
+		return utils.NewKindError(utils.KindUsage, "--type "+string(opts.Algos)+" requires --key")
+	case crypto.WrapperSource:
+		return utils.NewKindError(utils.KindUsage, "--type "+string(opts.Algos)+" requires --wrap-provider")
+	case crypto.SharesSource:
+		return utils.NewKindError(utils.KindUsage, "--type "+string(opts.Algos)+" requires --threshold")
+	case crypto.NoKey:
+		return nil
+	}
+
+	provider, err := passphraseProvider(flags)
+	if err != nil {
+		return
+	} else if provider != nil {
+		opts.SetPassphraseProvider(provider)
+		return
+	}
+
+	return confirmPassphrase()
+}
+
+// useKey sets the key from the keystore to encrypt with, and the algorithms of that key
+func useKey(flags *pflag.FlagSet) (err error) {
+	if flags.Changed("type") {
+		return utils.NewKindError(utils.KindUsage, "--type cannot be combined with --key")
+	}
+
+	ks, _, err := openKeystore(flags)
+	if err != nil {
+		return
+	}
+
+	if opts.Key, err = ks.Get(pushKey); err != nil {
+		return
+	}
+
+	opts.Algos = opts.Key.Algos()
+	return nil
+}
+
+// useWrapper sets the key wrapping provider and key to wrap data keys with
+func useWrapper(flags *pflag.FlagSet) (err error) {
+	if flags.Changed("type") {
+		return utils.NewKindError(utils.KindUsage, "--type cannot be combined with --wrap-provider")
+	} else if wrapKey == "" {
+		return utils.NewKindError(utils.KindUsage, "--wrap-provider requires --wrap-key")
+	}
+
+	wrappers, err := keyWrappers()
+	if err != nil {
+		return
+	}
+
+	for _, w := range wrappers {
+		if w.Name() == wrapProvider {
+			opts.Wrapper, opts.WrapKeyID = w, wrapKey
+			opts.Algos = crypto.WrapAes256Gcm
+			return nil
+		}
+	}
+
+	return utils.NewKindError(
+		utils.KindUsage,
+		"key wrapping provider "+wrapProvider+" is not configured, see --vault-addr and --keyprovider",
+	)
+}
+
+// useShares sets the keys and passphrases that the shares of the key encryption key are
+// encrypted to and with, and the number of them needed to decrypt
+func useShares(flags *pflag.FlagSet) (err error) {
+	if flags.Changed("type") || pushKey != "" || wrapProvider != "" {
+		return utils.NewKindError(utils.KindUsage, "--threshold cannot be combined with --type, --key or --wrap-provider")
+	}
+
+	opts.Algos = crypto.ShamirAes256Gcm
+	opts.Threshold = threshold
+
+	if len(shareKeys) > 0 {
+		ks, _, err := openKeystore(flags)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range shareKeys {
+			k, err := ks.Get(name)
+			if err != nil {
+				return err
 			}
-			opts.SetPassphrase(passphrase)
+			opts.ShareKeys = append(opts.ShareKeys, k)
+		}
+	}
+
+	for _, filename := range sharePassFiles {
+		opts.SharePassphrases = append(opts.SharePassphrases, crypto.FilePassphrase(filename))
+	}
+
+	for i := 1; i <= sharePassCount; i++ {
+		p, err := newPassphrase(fmt.Sprintf(" for share passphrase %d of %d", i, sharePassCount))
+		if err != nil {
+			return err
+		}
+		sharePasses = append(sharePasses, p)
+		opts.SharePassphrases = append(opts.SharePassphrases, crypto.PassphraseFunc(func() (crypto.Secret, error) {
+			return p.Copy(), nil
+		}))
+	}
+
+	if n := len(opts.ShareKeys) + len(opts.SharePassphrases); threshold > n {
+		return utils.NewKindError(
+			utils.KindUsage,
+			fmt.Sprintf("--threshold %d exceeds the number of shares, %d", threshold, n),
+		)
+	}
+
+	return nil
+}
+
+// confirmPassphrase prompts for a new passphrase twice and sets it
+func confirmPassphrase() (err error) {
+	p, err := newPassphrase("")
+	if err != nil {
+		return
+	}
+
+	opts.SetPassphraseSecret(p)
+	return nil
+}
+
+// newPassphrase prompts for a new passphrase twice, naming what it is for. The caller
+// wipes the passphrase returned.
+func newPassphrase(what string) (_ crypto.Secret, err error) {
+	passphrase, err := crypto.GetPassSTDIN("Enter passphrase"+what+": ", crypto.StdinPassReader)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not obtain passphrase")
+	}
+
+	passphrase1, err := crypto.GetPassSTDIN("Re-enter passphrase"+what+": ", crypto.StdinPassReader)
+	if err != nil {
+		passphrase.Wipe()
+		return nil, errors.Wrap(err, "could not obtain passphrase")
+	}
+	defer passphrase1.Wipe()
+
+	if !bytes.Equal(passphrase, passphrase1) {
+		passphrase.Wipe()
+		return nil, utils.NewKindError(utils.KindUsage, "passphrases do not match")
+	}
+
+	return passphrase, nil
+}
+
+// schemeUsage lists the registered encryption schemes, one per line, for the help of
+// --type
+func schemeUsage() string {
+	schemes := crypto.Schemes()
+
+	width := 0
+	for _, s := range schemes {
+		if len(s.Algos()) > width {
+			width = len(s.Algos())
 		}
-	default:
 	}
+
+	usage := ""
+	for _, s := range schemes {
+		usage += fmt.Sprintf("  %-*s  %s\n", width, s.Algos(), s.Description())
+	}
+
+	return usage
 }
 
 func runPush(remote string, opts *crypto.Opts) error {
@@ -74,7 +267,7 @@ func runPush(remote string, opts *crypto.Opts) error {
 		return err
 	}
 	log.Info().Msgf("Pushing image: %s.", ref)
-	return images.PushImage(ref, opts, tempDir)
+	return images.PushImage(ctx, ref, opts, tempDir)
 }
 
 func init() {
@@ -86,12 +279,66 @@ func init() {
 		false,
 		`whether manifests should be compatible with the Docker image manifest schema v2.2
 or a slight modfication of it`,
+	)
+	pushCmd.Flags().StringVar(
+		&pushKey,
+		"key",
+		"",
+		`Encrypt with the named key or identity from the keystore instead of a passphrase.
+The passphrase, if any, is that of the keystore.`,
+	)
+	pushCmd.Flags().StringVar(
+		&wrapProvider,
+		"wrap-provider",
+		"",
+		`Wrap the data keys with the named key wrapping provider instead of a passphrase: vault
+for the server given by --vault-addr, or the name of a --keyprovider.`,
+	)
+	pushCmd.Flags().StringVar(
+		&wrapKey,
+		"wrap-key",
+		"",
+		`The ID of the key of the key wrapping provider to wrap the data keys with.`,
+	)
+	pushCmd.Flags().IntVar(
+		&threshold,
+		"threshold",
+		0,
+		`Split the key that encrypts the data keys into shares, this many of which are needed
+to decrypt. The shares are encrypted to the keys given by --share-key and with the
+passphrases given by --share-pass-file and --share-passphrases.`,
+	)
+	pushCmd.Flags().StringArrayVar(
+		&shareKeys,
+		"share-key",
+		nil,
+		`Encrypt a share to the named key or identity from the keystore. May be given more than once.`,
+	)
+	pushCmd.Flags().IntVar(
+		&sharePassCount,
+		"share-passphrases",
+		0,
+		`Prompt for this many passphrases to encrypt a share with each.`,
+	)
+	pushCmd.Flags().StringVar(
+		&cipherStr,
+		"cipher",
+		string(crypto.Aes256Gcm),
+		`The cipher to encrypt with, AES256-GCM or CHACHA20-POLY1305. The latter is faster
+to decrypt on CPUs without AES instructions, such as many ARM devices.`,
+	)
+	pushCmd.Flags().IntVar(
+		&opts.Iter,
+		"kdf-cost",
+		crypto.Pbkdf2Iter,
+		`The number of iterations of PBKDF2 to derive keys from passphrases with. It is recorded
+in the image, and must be within the bounds that it is pulled with, see --min-kdf-cost.`,
 	)
 	pushCmd.Flags().StringVarP(
 		&typeStr,
 		"type",
 		"t",
 		string(crypto.Pbkdf2Aes256Gcm),
-		"Specifies the type of encryption to use.",
+		"Specifies the type of encryption to use, one of:\n"+schemeUsage(),
 	)
 }
@@ -15,15 +15,27 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 
 	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/auth"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
 	"github.com/Senetas/crypto-cli/utils"
 )
 
@@ -32,11 +44,42 @@ var (
 	tempDir    string
 	passphrase string
 	debug      bool
-	opts       = crypto.Opts{
-		Algos:  crypto.Pbkdf2Aes256Gcm,
-		Compat: false,
+	username   string
+	password   string
+	passStdin  bool
+	passFile   string
+	passEnv    string
+	passFD     int
+	passCmd    string
+	passPipe   bool
+	insecure   []string
+	traceFile  string
+	trace      *httpclient.Trace
+	retries    int
+	retryDelay time.Duration
+	timeout    time.Duration
+	idle       time.Duration
+	proxyURL   string
+	noHTTP2    bool
+	vaultAddr  string
+	vaultMount string
+	providers  []string
+	// sharePassFiles hold the passphrases of shares, one per file
+	sharePassFiles []string
+	// policy restricts the images that are decrypted
+	policy            = crypto.DefaultPolicy()
+	allowedAlgos      []string
+	allowLegacyFormat bool
+	opts              = crypto.Opts{
+		Algos:   crypto.Pbkdf2Aes256Gcm,
+		Compat:  false,
+		Version: crypto.LatestVersion,
 	}
 
+	// ctx is cancelled when the process is interrupted, so that in-flight requests are
+	// abandoned and temporary files are cleaned up
+	ctx = context.Background()
+
 	// rootCmd represents the base command when called without any subcommands
 	rootCmd = &cobra.Command{
 		Use:   "crypto-cli [OPTIONS] [command]",
@@ -50,19 +93,72 @@ MAC the images before uploading them, and check the MAC then decrypt after
 downloading them.`,
 		SilenceErrors: true,
 		SilenceUsage:  true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			if err = setTransportConfig(); err != nil {
+				return
+			}
+			registry.SetInsecureRegistries(insecure)
+			registry.SetIdleTimeout(idle)
+			httpclient.SetTimeout(timeout)
+			httpclient.SetRetryPolicy(httpclient.RetryPolicy{
+				MaxRetries: retries,
+				BaseDelay:  httpclient.DefaultRetryPolicy.BaseDelay,
+				MaxDelay:   retryDelay,
+			})
+			if traceFile != "" {
+				if trace, err = httpclient.StartTrace(traceFile); err != nil {
+					return
+				}
+			}
+			return overrideCreds()
+		},
 	}
 )
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
-		c, ok := errors.Cause(err).(utils.Error)
-		if debug && (!ok || c.HasStack) {
-			log.Fatal().Msgf("%+v", err)
-		}
-		log.Fatal().Msgf("%v", err)
+	var stop context.CancelFunc
+	ctx, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		// a second signal terminates immediately
+		stop()
+		log.Warn().Msg("Interrupted, cleaning up.")
+	}()
+
+	classifyUsageErrors(rootCmd)
+
+	err := rootCmd.Execute()
+	opts.Wipe()
+	for _, p := range sharePasses {
+		p.Wipe()
 	}
+	if trace != nil {
+		err = utils.CheckedClose(trace, err)
+	}
+
+	if err == nil {
+		return
+	}
+
+	c, ok := errors.Cause(err).(utils.Error)
+	if debug && (!ok || c.HasStack) {
+		log.Error().Msgf("%+v", err)
+	} else {
+		log.Error().Msgf("%v", err)
+	}
+
+	if h := hint(err); h != "" {
+		log.Info().Msg(h)
+	}
+
+	if ctx.Err() != nil {
+		os.Exit(exitInterrupted)
+	}
+	os.Exit(exitStatus(err))
 }
 
 func init() {
@@ -80,6 +176,42 @@ func init() {
 If absent, a prompt will be presented.`,
 	)
 
+	rootCmd.PersistentFlags().StringVar(
+		&passFile,
+		"pass-file",
+		"",
+		`Read the passphrase from the first line of the given file.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&passEnv,
+		"pass-env",
+		"",
+		`Read the passphrase from the given environment variable, which is then unset.`,
+	)
+
+	rootCmd.PersistentFlags().IntVar(
+		&passFD,
+		"pass-fd",
+		-1,
+		`Read the passphrase from the first line of the given open file descriptor.`,
+	)
+
+	rootCmd.PersistentFlags().BoolVar(
+		&passPipe,
+		"pass-stdin",
+		false,
+		`Read the passphrase from the first line of stdin.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&passCmd,
+		"pass-command",
+		"",
+		`Run the given shell command and read the passphrase from the first line of its output,
+e.g. to obtain it from a secret store.`,
+	)
+
 	rootCmd.PersistentFlags().BoolVarP(
 		&debug,
 		"verbose",
@@ -88,6 +220,167 @@ If absent, a prompt will be presented.`,
 		"Set the log level to debug",
 	)
 
+	rootCmd.PersistentFlags().StringVarP(
+		&username,
+		"username",
+		"u",
+		"",
+		`Specifies the username to authenticate with the registry, instead of the credentials
+stored by docker login or crypto-cli login.`,
+	)
+
+	rootCmd.PersistentFlags().BoolVar(
+		&passStdin,
+		"password-stdin",
+		false,
+		`Read the registry password from stdin rather than prompting for it.
+Requires --username.`,
+	)
+
+	rootCmd.PersistentFlags().StringSliceVar(
+		&insecure,
+		"insecure-registry",
+		nil,
+		`Allow connections to the given registries (host[:port] or CIDR) over plain HTTP or
+without verifying their certificates. May be repeated.`,
+	)
+
+	rootCmd.PersistentFlags().IntVar(
+		&retries,
+		"max-retries",
+		httpclient.DefaultRetryPolicy.MaxRetries,
+		`The number of times a request to a registry is retried if it fails with a connection
+error or a transient status (429 or 5xx). Set to 0 to disable retries.`,
+	)
+
+	rootCmd.PersistentFlags().DurationVar(
+		&retryDelay,
+		"max-retry-delay",
+		httpclient.DefaultRetryPolicy.MaxDelay,
+		`The longest time to wait before retrying a request, including any delay requested
+by the registry with Retry-After.`,
+	)
+
+	rootCmd.PersistentFlags().DurationVar(
+		&timeout,
+		"timeout",
+		httpclient.DefaultTimeout,
+		`The longest time to wait for a request to a registry, other than the upload or
+download of a blob, to complete. Set to 0 to wait indefinitely.`,
+	)
+
+	rootCmd.PersistentFlags().DurationVar(
+		&idle,
+		"idle-timeout",
+		registry.DefaultIdleTimeout,
+		`The longest time that the upload or download of a blob may make no progress before
+it is abandoned. Set to 0 to wait indefinitely.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&proxyURL,
+		"proxy",
+		"",
+		`The URL of the proxy (http, https or socks5) through which to connect to registries,
+instead of the one given by HTTPS_PROXY or HTTP_PROXY. Hosts listed in NO_PROXY are
+still connected to directly.`,
+	)
+
+	rootCmd.PersistentFlags().BoolVar(
+		&noHTTP2,
+		"disable-http2",
+		false,
+		`Connect to registries with HTTP/1.1 only, e.g. for proxies that do not support HTTP/2.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&traceFile,
+		"trace-file",
+		"",
+		`Write a trace of every request to the registries to the given file in HAR format,
+e.g. to attach to a bug report. Credentials and tokens are redacted.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&keystorePath,
+		"keystore",
+		defaultKeystore(),
+		`The keystore of named keys, with which images may be encrypted instead of with a
+passphrase. See crypto-cli key --help.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&vaultAddr,
+		"vault-addr",
+		os.Getenv("VAULT_ADDR"),
+		`The address of the Vault server, or KMS with the same API, whose transit engine wraps
+data keys for the vault key wrapping provider. The token is read from VAULT_TOKEN.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&vaultMount,
+		"vault-mount",
+		"transit",
+		`The path that the transit engine is mounted at on the Vault server.`,
+	)
+
+	rootCmd.PersistentFlags().StringArrayVar(
+		&providers,
+		"keyprovider",
+		nil,
+		`A key wrapping provider NAME=COMMAND, where COMMAND is run with the shell and speaks the
+keyprovider protocol of ocicrypt over stdin and stdout. May be given more than once.`,
+	)
+
+	rootCmd.PersistentFlags().StringArrayVar(
+		&sharePassFiles,
+		"share-pass-file",
+		nil,
+		`Read the passphrase of a share of the key of an image encrypted with --threshold from
+the first line of the given file. May be given more than once. When decrypting, the
+passphrases of shares that are still needed are prompted for.`,
+	)
+
+	rootCmd.PersistentFlags().IntVar(
+		&policy.MinKDFCost,
+		"min-kdf-cost",
+		crypto.MinKDFCost,
+		`Refuse to decrypt images whose keys are derived from passphrases with fewer iterations
+of PBKDF2. 0 is no minimum.`,
+	)
+
+	rootCmd.PersistentFlags().IntVar(
+		&policy.MaxKDFCost,
+		"max-kdf-cost",
+		crypto.MaxKDFCost,
+		`Refuse to decrypt images whose keys are derived from passphrases with more iterations
+of PBKDF2, which could take arbitrarily long. 0 is no maximum.`,
+	)
+
+	rootCmd.PersistentFlags().IntVar(
+		&policy.MaxPassphraseShares,
+		"max-passphrase-shares",
+		crypto.DefaultMaxPassphraseShares,
+		`Refuse to decrypt images whose keys are split into more shares encrypted with
+passphrases, as each passphrase is tried against each of them. 0 is no maximum.`,
+	)
+
+	rootCmd.PersistentFlags().StringSliceVar(
+		&allowedAlgos,
+		"allow-type",
+		nil,
+		`Only decrypt images encrypted with these types of encryption. May be given more than
+once. By default any type is decrypted.`,
+	)
+
+	rootCmd.PersistentFlags().BoolVar(
+		&allowLegacyFormat,
+		"allow-legacy-format",
+		false,
+		`Also decrypt images encrypted in format version 0, whose keys are not committed to.
+Only use this for images that were pushed by older versions and are trusted.`,
+	)
+
 	rootCmd.PersistentFlags().StringVar(
 		&tempDir,
 		"temp",
@@ -96,6 +389,144 @@ If absent, a prompt will be presented.`,
 	)
 }
 
+// setTransportConfig configures the transport of every request to a registry from the
+// command line
+func setTransportConfig() error {
+	config := httpclient.DefaultTransportConfig
+	config.DisableHTTP2 = noHTTP2
+
+	if proxyURL != "" {
+		// the error of url.Parse would include any credentials in the URL
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return utils.NewKindError(utils.KindUsage, "invalid proxy: could not parse the URL")
+		}
+
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return utils.NewKindError(utils.KindUsage, fmt.Sprintf("invalid proxy: unsupported scheme %q", u.Scheme))
+		}
+
+		config.Proxy = u
+	}
+
+	httpclient.SetTransportConfig(config)
+	return nil
+}
+
+// keyWrappers returns the key wrapping providers configured by the flags
+func keyWrappers() (wrappers []crypto.KeyWrapper, err error) {
+	if vaultAddr != "" {
+		wrappers = append(
+			wrappers,
+			crypto.NewVaultWrapper(vaultAddr, os.Getenv("VAULT_TOKEN"), vaultMount, httpclient.DefaultClient),
+		)
+	}
+
+	for _, p := range providers {
+		i := strings.IndexByte(p, '=')
+		if i <= 0 || i == len(p)-1 {
+			return nil, utils.NewKindError(utils.KindUsage, fmt.Sprintf("invalid keyprovider %q: expected NAME=COMMAND", p))
+		}
+
+		name := p[:i]
+		if name == crypto.VaultWrapperName {
+			return nil, utils.NewKindError(utils.KindUsage, "a keyprovider may not be called "+name)
+		}
+		wrappers = append(wrappers, crypto.NewCommandWrapper(name, p[i+1:]))
+	}
+
+	return wrappers, nil
+}
+
+// defaultKeystore is the keystore in the home directory of the user
+func defaultKeystore() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".crypto-cli", "keystore.json")
+}
+
+// passphraseProvider returns the provider of the passphrase given by the flags, or nil
+// if it is to be prompted for. At most one source of the passphrase may be given.
+func passphraseProvider(flags *pflag.FlagSet) (provider crypto.PassphraseProvider, err error) {
+	var given []string
+	if flags.Changed("pass") {
+		log.Warn().Msg("--pass exposes the passphrase to other users of this machine, use --pass-file, --pass-env, --pass-fd, --pass-stdin or --pass-command instead.")
+		provider = crypto.PassphraseFunc(func() (crypto.Secret, error) {
+			return crypto.SecretFrom([]byte(passphrase)), nil
+		})
+		given = append(given, "--pass")
+	}
+	if flags.Changed("pass-file") {
+		provider = crypto.FilePassphrase(passFile)
+		given = append(given, "--pass-file")
+	}
+	if flags.Changed("pass-env") {
+		provider = crypto.EnvPassphrase(passEnv)
+		given = append(given, "--pass-env")
+	}
+	if flags.Changed("pass-fd") {
+		provider = crypto.FDPassphrase(passFD)
+		given = append(given, "--pass-fd")
+	}
+	if flags.Changed("pass-stdin") {
+		if passStdin {
+			return nil, utils.NewKindError(utils.KindUsage, "--pass-stdin and --password-stdin cannot both read stdin")
+		}
+		provider = crypto.ReaderPassphrase(os.Stdin, "stdin")
+		given = append(given, "--pass-stdin")
+	}
+	if flags.Changed("pass-command") {
+		provider = crypto.CommandPassphrase(passCmd)
+		given = append(given, "--pass-command")
+	}
+
+	if len(given) > 1 {
+		return nil, utils.NewKindError(utils.KindUsage, "only one of "+strings.Join(given, ", ")+" may be given")
+	}
+
+	return provider, nil
+}
+
+// overrideCreds uses the username and password given on the command line, if any,
+// to authenticate with every registry
+func overrideCreds() (err error) {
+	if username == "" {
+		if passStdin {
+			return utils.NewKindError(utils.KindUsage, "--password-stdin requires --username")
+		}
+		return
+	}
+
+	if password, err = readPassword(); err != nil {
+		return
+	}
+
+	auth.OverrideDefaultCreds(auth.NewCreds(username, password))
+	return
+}
+
+// readPassword reads the registry password from stdin if --password-stdin
+// was given, otherwise it prompts for it
+func readPassword() (string, error) {
+	if !passStdin {
+		// the credentials of registries are strings, so the password cannot be wiped
+		password, err := crypto.GetPassSTDIN("Password: ", crypto.StdinPassReader)
+		defer password.Wipe()
+		return string(password), err
+	}
+
+	contents, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
 func initLogging() {
 	// hide debug logs by default
 	if debug {
@@ -0,0 +1,178 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/proxy"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+var (
+	upstream   string
+	listenAddr string
+	servePush  bool
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve [OPTIONS]",
+	Short: "Serve decrypted images from, or push encrypted images to, a remote registry.",
+	Long: `serve runs a local, read only registry that serves decrypted copies of the images
+in an upstream registry. Clients that do not understand encryption, such as docker pull,
+may then pull from it, e.g.
+
+    crypto-cli serve --upstream docker.io --listen 127.0.0.1:5000
+    docker pull 127.0.0.1:5000/cryptocli/alpine:latest
+
+Manifests are fetched from upstream each time they are requested by tag. Decrypted blobs
+are cached on disk, encrypted under a key that is discarded when serve exits.
+
+With --push, serve instead runs a local, write only registry. Images pushed to it are
+encrypted and then pushed to the upstream registry, e.g.
+
+    crypto-cli serve --push --upstream docker.io --listen 127.0.0.1:5001
+    docker push 127.0.0.1:5001/cryptocli/alpine:latest`,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if !servePush {
+			if err = checkFlagsPull(cmd.Flags()); err != nil {
+				return
+			}
+			return runServe(&opts)
+		}
+		opts.Algos, err = crypto.ValidateAlgos(typeStr)
+		if err != nil {
+			return utils.WithKind(utils.KindUsage, err)
+		}
+		if err = checkFlagsPush(cmd.Flags()); err != nil {
+			return err
+		}
+		return runServePush(&opts)
+	},
+	Args: cobra.NoArgs,
+}
+
+func runServe(opts *crypto.Opts) (err error) {
+	if opts.Algos != crypto.None {
+		// prompt now rather than in the middle of a request
+		if _, err = opts.GetPassphrase(crypto.StdinPassReader); err != nil {
+			return
+		}
+	}
+
+	p, err := proxy.NewDecryptingProxy(upstream, opts, tempDir)
+	if err != nil {
+		return
+	}
+	defer func() { err = utils.CheckedClose(p, err) }()
+
+	log.Info().Msgf("Serving decrypted images from %s on %s.", upstream, listenAddr)
+	return listenAndServe(p)
+}
+
+func runServePush(opts *crypto.Opts) (err error) {
+	p, err := proxy.NewEncryptingProxy(upstream, opts, tempDir)
+	if err != nil {
+		return
+	}
+	defer func() { err = utils.CheckedClose(p, err) }()
+
+	log.Info().Msgf("Pushing encrypted images to %s from %s.", upstream, listenAddr)
+	return listenAndServe(p)
+}
+
+// listenAndServe serves handler on listenAddr until ctx is cancelled. Requests in flight are
+// cancelled too, so that the proxy may then clean up.
+func listenAndServe(handler http.Handler) error {
+	srv := &http.Server{
+		Addr:        listenAddr,
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errCh:
+		return errors.WithStack(err)
+	case <-ctx.Done():
+	}
+
+	log.Info().Msg("Shutting down.")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return errors.WithStack(srv.Shutdown(shutdownCtx))
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+
+	serveCmd.Flags().StringVar(
+		&upstream,
+		"upstream",
+		"docker.io",
+		"The registry that hosts the encrypted images.",
+	)
+	serveCmd.Flags().StringVar(
+		&listenAddr,
+		"listen",
+		"127.0.0.1:5000",
+		"The address to listen on.",
+	)
+	serveCmd.Flags().BoolVar(
+		&servePush,
+		"push",
+		false,
+		"Accept pushes, encrypting the images and pushing them upstream, instead of serving pulls.",
+	)
+	serveCmd.Flags().BoolVar(
+		&opts.Compat,
+		"compat",
+		false,
+		`with --push, whether manifests should be compatible with the Docker image manifest
+schema v2.2 or a slight modfication of it`,
+	)
+	serveCmd.Flags().StringVar(
+		&cipherStr,
+		"cipher",
+		string(crypto.Aes256Gcm),
+		"With --push, the cipher to encrypt with, AES256-GCM or CHACHA20-POLY1305.",
+	)
+	serveCmd.Flags().IntVar(
+		&opts.Iter,
+		"kdf-cost",
+		crypto.Pbkdf2Iter,
+		"With --push, the number of iterations of PBKDF2 to derive keys from passphrases with.",
+	)
+	serveCmd.Flags().StringVarP(
+		&typeStr,
+		"type",
+		"t",
+		string(crypto.Pbkdf2Aes256Gcm),
+		"With --push, specifies the type of encryption to use, one of:\n"+schemeUsage(),
+	)
+}
@@ -0,0 +1,98 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify [OPTIONS] NAME[:TAG]",
+	Short: "Check that an image in a remote repository downloads and decrypts correctly.",
+	Long: `verify downloads every blob of an image and checks that it matches its digest, that
+it decrypts and authenticates under the given passphrase, and that the uncompressed layers
+match the diff IDs in the config. Nothing is loaded into docker. A report is printed and the
+command fails if any blob could not be verified.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkFlagsPull(cmd.Flags()); err != nil {
+			return err
+		}
+		return runVerify(args[0], &opts)
+	},
+	Args: cobra.ExactArgs(1),
+}
+
+func runVerify(remote string, opts *crypto.Opts) error {
+	ref, err := reference.ParseNormalizedNamed(remote)
+	if err != nil {
+		return errors.Wrapf(err, "remote = %s", remote)
+	}
+	log.Info().Msgf("Verifying image: %s", ref)
+
+	report, err := images.VerifyImage(ctx, ref, opts, tempDir)
+	if err != nil {
+		return err
+	}
+
+	if err = printVerifyReport(os.Stdout, report); err != nil {
+		return err
+	}
+
+	if !report.Passed() {
+		return utils.NewKindError(utils.KindCrypto, "verification failed")
+	}
+
+	log.Info().Msg("Verification passed.")
+	return nil
+}
+
+// printVerifyReport writes a human readable table describing report to w
+func printVerifyReport(w io.Writer, report *images.VerifyReport) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "BLOB\tDIGEST\tDIFF ID\tRESULT")
+	for _, b := range report.Blobs {
+		diffID := "-"
+		if b.DiffID != "" {
+			diffID = b.DiffID.String()
+		}
+
+		result := "PASS"
+		if b.Err != nil {
+			result = "FAIL: " + b.Err.Error()
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", b.Name, b.Digest, diffID, result)
+	}
+
+	return errors.WithStack(tw.Flush())
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
@@ -29,23 +29,58 @@ const (
 	// from a passphrase using PBKDF2
 	Pbkdf2Aes256Gcm Algos = "PBKDF2-AES256-GCM"
 
+	// KeyAes256Gcm represents aead with AES256-GCM with a named symmetric key from the keystore
+	KeyAes256Gcm Algos = "KEY-AES256-GCM"
+
+	// X25519Aes256Gcm represents aead with AES256-GCM with a key agreed by X25519 between an
+	// ephemeral key and an identity from the keystore
+	X25519Aes256Gcm Algos = "X25519-AES256-GCM"
+
+	// X25519MlKem768Aes256Gcm represents aead with AES256-GCM with a key derived from both an
+	// X25519 agreement and an ML-KEM-768 encapsulation to a hybrid identity from the keystore
+	X25519MlKem768Aes256Gcm Algos = "X25519-MLKEM768-AES256-GCM"
+
+	// WrapAes256Gcm represents aead with AES256-GCM with a data key wrapped by a key wrapping
+	// provider, such as a KMS
+	WrapAes256Gcm Algos = "WRAP-AES256-GCM"
+
+	// ShamirAes256Gcm represents aead with AES256-GCM with a data key encrypted with a key
+	// that is split into shares, a threshold of which are needed to decrypt
+	ShamirAes256Gcm Algos = "SHAMIR-AES256-GCM"
+
 	// Pbkdf2Iter is the number of iterations of PBKDF2 to run
 	Pbkdf2Iter = 4e4
 )
 
+// LatestVersion is the version of the format of the crypto objects of new images. From
+// version 1, keys and configs are encrypted with a commitment to the key.
+const LatestVersion = 1
+
 type versionData struct {
 	saltLength  int
 	nonceLength int
+	committing  bool
 }
 
-var versionDataStore = map[int]versionData{0: {saltLength: 16, nonceLength: 12}}
+var versionDataStore = map[int]versionData{
+	0: {saltLength: 16, nonceLength: 12},
+	1: {saltLength: 16, nonceLength: 12, committing: true},
+}
 
-// ValidateAlgos converts a string to valid Algos if possible
+// ValidateAlgos converts a string to valid Algos if possible, that is, to the Algos of a
+// registered scheme
 func ValidateAlgos(ctstr string) (Algos, error) {
-	if ctstr == string(None) {
-		return None, nil
-	} else if ctstr == string(Pbkdf2Aes256Gcm) {
-		return Pbkdf2Aes256Gcm, nil
+	if _, ok := schemes[Algos(ctstr)]; ok {
+		return Algos(ctstr), nil
 	}
 	return Algos(""), errors.New("invalid encryption type")
 }
+
+// KeySource is what the key that encrypts the data keys of the scheme of a is obtained
+// from, or NoKey if there is no such scheme
+func (a Algos) KeySource() KeySource {
+	if s, err := LookupScheme(a, LatestVersion); err == nil {
+		return s.KeySource()
+	}
+	return NoKey
+}
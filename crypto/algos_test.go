@@ -33,6 +33,11 @@ func TestValidateAlgos(t *testing.T) {
 	}{
 		{"NONE", crypto.None, nil},
 		{"PBKDF2-AES256-GCM", crypto.Pbkdf2Aes256Gcm, nil},
+		{"KEY-AES256-GCM", crypto.KeyAes256Gcm, nil},
+		{"X25519-AES256-GCM", crypto.X25519Aes256Gcm, nil},
+		{"X25519-MLKEM768-AES256-GCM", crypto.X25519MlKem768Aes256Gcm, nil},
+		{"WRAP-AES256-GCM", crypto.WrapAes256Gcm, nil},
+		{"SHAMIR-AES256-GCM", crypto.ShamirAes256Gcm, nil},
 		{"", crypto.Algos(""), errors.New("invalid encryption type")},
 	}
 
@@ -19,6 +19,8 @@ import (
 
 	"github.com/minio/sio"
 	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/utils"
 )
 
 var defaultConfig = sio.Config{
@@ -28,27 +30,47 @@ var defaultConfig = sio.Config{
 }
 
 // EncBlobWriter returns an io.WriteCloser that encrypts written data with
-// the supplied key
-func EncBlobWriter(in io.Writer, key []byte) (io.WriteCloser, error) {
+// the supplied key and cipher
+func EncBlobWriter(in io.Writer, c Cipher, key []byte) (io.WriteCloser, error) {
 	if len(key) != 32 {
 		return nil, errors.New("key was of the wrong length")
 	}
 
 	cfg := defaultConfig
 	cfg.Key = key
+	cfg.CipherSuites = []byte{c.suite()}
 
 	return sio.EncryptWriter(in, cfg)
 }
 
 // DecBlobReader returns an io.Reader that decrypts read data with
-// the supplied key
-func DecBlobReader(in io.Reader, key []byte) (io.Reader, error) {
+// the supplied key and cipher. Data encrypted with any other cipher is rejected.
+func DecBlobReader(in io.Reader, c Cipher, key []byte) (io.Reader, error) {
 	if len(key) != 32 {
 		return nil, errors.New("key was of the wrong length")
 	}
 
 	cfg := defaultConfig
 	cfg.Key = key
+	cfg.CipherSuites = []byte{c.suite()}
+
+	r, err := sio.DecryptReader(in, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &authReader{r: r}, nil
+}
+
+// authReader classifies the failure to decrypt or authenticate the data it reads
+type authReader struct {
+	r io.Reader
+}
 
-	return sio.DecryptReader(in, cfg)
+func (a *authReader) Read(p []byte) (n int, err error) {
+	n, err = a.r.Read(p)
+	if _, ok := err.(sio.Error); ok {
+		err = utils.WithKind(utils.KindCrypto, err)
+	}
+	return
 }
@@ -32,17 +32,24 @@ func TestEncDec(t *testing.T) {
 	assert := assert.New(t)
 
 	tests := []struct {
-		buf    *bytes.Buffer
-		key    []byte
-		errEnc string
-		errDec string
+		buf       *bytes.Buffer
+		key       []byte
+		encCipher crypto.Cipher
+		decCipher crypto.Cipher
+		errEnc    string
+		errDec    string
+		errRead   bool
 	}{
-		{&bytes.Buffer{}, []byte("hunter2"), "key was of the wrong length", ""},
-		{&bytes.Buffer{}, make([]byte, 32), "", ""},
+		{&bytes.Buffer{}, []byte("hunter2"), crypto.Aes256Gcm, crypto.Aes256Gcm, "key was of the wrong length", "", false},
+		{&bytes.Buffer{}, make([]byte, 32), crypto.Aes256Gcm, crypto.Aes256Gcm, "", "", false},
+		{&bytes.Buffer{}, make([]byte, 32), "", crypto.Aes256Gcm, "", "", false},
+		{&bytes.Buffer{}, make([]byte, 32), crypto.ChaCha20Poly1305, crypto.ChaCha20Poly1305, "", "", false},
+		{&bytes.Buffer{}, make([]byte, 32), crypto.ChaCha20Poly1305, crypto.Aes256Gcm, "", "", true},
+		{&bytes.Buffer{}, make([]byte, 32), crypto.Aes256Gcm, crypto.ChaCha20Poly1305, "", "", true},
 	}
 
 	for _, test := range tests {
-		enc, err := crypto.EncBlobWriter(test.buf, test.key)
+		enc, err := crypto.EncBlobWriter(test.buf, test.encCipher, test.key)
 		if err != nil {
 			assert.EqualError(err, test.errEnc)
 			continue
@@ -65,7 +72,7 @@ func TestEncDec(t *testing.T) {
 
 		buf2 := bytes.NewBuffer(test.buf.Bytes())
 
-		dec, err := crypto.DecBlobReader(buf2, test.key)
+		dec, err := crypto.DecBlobReader(buf2, test.decCipher, test.key)
 		if err != nil {
 			assert.EqualError(err, test.errDec)
 			continue
@@ -73,6 +80,10 @@ func TestEncDec(t *testing.T) {
 
 		var out bytes.Buffer
 		n, err = io.Copy(&out, dec)
+		if test.errRead {
+			assert.Error(err)
+			continue
+		}
 		if !assert.NoError(err) {
 			continue
 		}
@@ -97,7 +108,7 @@ func TestDec(t *testing.T) {
 
 	for _, test := range tests {
 		buf := bytes.NewBuffer(data)
-		dec, err := crypto.DecBlobReader(buf, test.key)
+		dec, err := crypto.DecBlobReader(buf, crypto.Aes256Gcm, test.key)
 		if err != nil {
 			assert.EqualError(err, test.errDec)
 			continue
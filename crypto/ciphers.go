@@ -0,0 +1,92 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"strings"
+
+	"github.com/minio/sio"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher is the AEAD that encrypts the layers and config of an image and wraps their data
+// keys. It is independent of how the key encryption key is obtained, which Algos names.
+type Cipher string
+
+const (
+	// Aes256Gcm is AES256-GCM, which is the default, and is fast where the CPU has AES
+	// instructions
+	Aes256Gcm Cipher = "AES256-GCM"
+
+	// ChaCha20Poly1305 is ChaCha20-Poly1305 for layers and XChaCha20-Poly1305 for the config
+	// and keys, which are fast on CPUs without AES instructions, e.g. many ARM devices
+	ChaCha20Poly1305 Cipher = "CHACHA20-POLY1305"
+)
+
+// ValidateCipher converts a string to a valid Cipher if possible, ignoring case. The empty
+// string is the default, AES256-GCM.
+func ValidateCipher(s string) (Cipher, error) {
+	switch c := Cipher(strings.ToUpper(s)); c {
+	case "", Aes256Gcm:
+		return Aes256Gcm, nil
+	case ChaCha20Poly1305:
+		return c, nil
+	}
+	return Cipher(""), errors.New("invalid cipher: " + s)
+}
+
+// String returns the name of the cipher, which is AES256-GCM if it is empty, as it is in
+// the crypto objects of images encrypted before ciphers could be chosen
+func (c Cipher) String() string {
+	if c == "" {
+		return string(Aes256Gcm)
+	}
+	return string(c)
+}
+
+// nonceSize is the size of the nonces of the config and data key
+func (c Cipher) nonceSize() int {
+	if c == ChaCha20Poly1305 {
+		return chacha20poly1305.NonceSizeX
+	}
+	return 12
+}
+
+// aead returns the AEAD that encrypts the config and data key under key
+func (c Cipher) aead(key []byte) (cipher.AEAD, error) {
+	if c == ChaCha20Poly1305 {
+		aead, err := chacha20poly1305.NewX(key)
+		return aead, errors.WithStack(err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	return aead, errors.WithStack(err)
+}
+
+// suite is the cipher suite of sio that encrypts the layers
+func (c Cipher) suite() byte {
+	if c == ChaCha20Poly1305 {
+		return sio.CHACHA20_POLY1305
+	}
+	return sio.AES_256_GCM
+}
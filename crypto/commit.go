@@ -0,0 +1,111 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/pkg/errors"
+)
+
+// AES-GCM and ChaCha20-Poly1305 are not key-committing: a ciphertext may be crafted that
+// decrypts under many keys, so that whether it decrypts reveals which of them, e.g. which
+// of many guessed passphrases, is right. From version 1, the key that each key and config
+// is encrypted with is committed to by an HMAC of it that is prepended to the ciphertext
+// and checked before decrypting. The AEAD uses another key derived from it. Once the key
+// that wraps the data key is committed to, the data key, and so the layers, are fixed too.
+
+// commitmentSize is the size of a key commitment
+const commitmentSize = sha256.Size
+
+// errWrongKey is the cause of the failure to decrypt a committed ciphertext with a key
+// other than the one it was encrypted with
+var errWrongKey = errors.New("wrong key")
+
+// format is how keys and configs are encrypted: the cipher, and whether the key is
+// committed to
+type format struct {
+	cipher     Cipher
+	committing bool
+}
+
+// format returns the format of the keys and config of c
+func (c Crypto) format() format {
+	return format{cipher: c.Cipher, committing: versionDataStore[c.Version].committing}
+}
+
+// commitKey derives the key that the AEAD uses from key, and a commitment to key that is
+// bound to the salt and nonce
+func commitKey(key, salt, nonce []byte) (aeadKey, commitment []byte) {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte("crypto-cli aead key\x00"))
+	aeadKey = mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte("crypto-cli key commitment\x00"))
+	_, _ = mac.Write(salt)
+	_, _ = mac.Write(nonce)
+	commitment = mac.Sum(nil)
+
+	return aeadKey, commitment
+}
+
+// seal encrypts plaintext under key, authenticating the salt, and prepends the commitment
+// to key if the format is committing
+func (f format) seal(key, nonce, plaintext, salt []byte) ([]byte, error) {
+	var commitment []byte
+	if f.committing {
+		key, commitment = commitKey(key, salt, nonce)
+		defer wipe(key)
+	}
+
+	aead, err := f.cipher.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(commitment, nonce, plaintext, salt), nil
+}
+
+// open is the inverse of seal. If the format is committing and the ciphertext was not
+// encrypted under key, the error is errWrongKey.
+func (f format) open(key, nonce, ciphertext, salt []byte) ([]byte, error) {
+	if f.committing {
+		if len(ciphertext) < commitmentSize {
+			return nil, errors.New("ciphertext is too short")
+		}
+
+		var commitment []byte
+		key, commitment = commitKey(key, salt, nonce)
+		defer wipe(key)
+		if !hmac.Equal(commitment, ciphertext[:commitmentSize]) {
+			return nil, errWrongKey
+		}
+		ciphertext = ciphertext[commitmentSize:]
+	}
+
+	aead, err := f.cipher.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("nonce is wrong length")
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, salt)
+	return plaintext, errors.WithStack(err)
+}
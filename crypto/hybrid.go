@@ -0,0 +1,188 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// A hybrid identity is an X25519 key pair and an ML-KEM-768 key pair. The private key is the
+// X25519 private key followed by the ML-KEM seed, and the public key is the X25519 public key
+// followed by the ML-KEM encapsulation key. A data key is wrapped with a key derived from
+// both shared secrets, so it stays confidential unless both X25519 and ML-KEM are broken.
+const (
+	hybridPrivateSize = 32 + mlkem.SeedSize
+	hybridPublicSize  = 32 + mlkem.EncapsulationKeySize768
+
+	// hybridVersion is the version of the encoding of the encapsulation, which is stored in
+	// the ephemeral key of the crypto object: the version, the ephemeral X25519 public key
+	// and the ML-KEM ciphertext
+	hybridVersion           = 1
+	hybridEncapsulationSize = 1 + 32 + mlkem.CiphertextSize768
+)
+
+// generateHybrid generates the private and public keys of a hybrid identity
+func generateHybrid() (priv, pub []byte, err error) {
+	x, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	priv = append(x.Bytes(), dk.Bytes()...)
+	pub = append(x.PublicKey().Bytes(), dk.EncapsulationKey().Bytes()...)
+	return priv, pub, nil
+}
+
+// hybridPrivate parses the private key of a hybrid identity
+func hybridPrivate(priv []byte) (*ecdh.PrivateKey, *mlkem.DecapsulationKey768, error) {
+	if len(priv) != hybridPrivateSize {
+		return nil, nil, errors.New("hybrid private key is the wrong length")
+	}
+
+	x, err := ecdh.X25519().NewPrivateKey(priv[:32])
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	dk, err := mlkem.NewDecapsulationKey768(priv[32:])
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	return x, dk, nil
+}
+
+// checkHybrid checks that the public key of a hybrid identity is well formed and, if the
+// private key is given, that it matches
+func checkHybrid(priv, pub []byte) error {
+	if len(pub) != hybridPublicSize {
+		return errors.New("hybrid public key is the wrong length")
+	}
+
+	if _, err := mlkem.NewEncapsulationKey768(pub[32:]); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if priv == nil {
+		return nil
+	}
+
+	x, dk, err := hybridPrivate(priv)
+	if err != nil {
+		return err
+	}
+
+	derived := append(x.PublicKey().Bytes(), dk.EncapsulationKey().Bytes()...)
+	if !bytes.Equal(derived, pub) {
+		return errors.New("private and public keys do not match")
+	}
+
+	return nil
+}
+
+// hybridEncapsulate derives a key encryption key for the hybrid public key pub, returning
+// it and the versioned encapsulation from which its holder may derive it too
+func hybridEncapsulate(pub, salt []byte) (kek, encapsulation []byte, err error) {
+	if len(pub) != hybridPublicSize {
+		return nil, nil, errors.New("hybrid public key is the wrong length")
+	}
+
+	peer, err := ecdh.X25519().NewPublicKey(pub[:32])
+	if err != nil {
+		return nil, nil, utils.WithKind(utils.KindCrypto, errors.Wrap(err, "invalid public key"))
+	}
+
+	ek, err := mlkem.NewEncapsulationKey768(pub[32:])
+	if err != nil {
+		return nil, nil, utils.WithKind(utils.KindCrypto, errors.Wrap(err, "invalid public key"))
+	}
+
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	sharedX, err := eph.ECDH(peer)
+	if err != nil {
+		return nil, nil, utils.WithKind(utils.KindCrypto, errors.WithStack(err))
+	}
+
+	sharedK, ct := ek.Encapsulate()
+
+	encapsulation = append([]byte{hybridVersion}, eph.PublicKey().Bytes()...)
+	encapsulation = append(encapsulation, ct...)
+
+	kek, err = hybridKEK(sharedK, sharedX, salt, encapsulation, pub)
+	return
+}
+
+// hybridDecapsulate derives the key encryption key of an encapsulation with the private key
+// of the hybrid identity that it was made for
+func hybridDecapsulate(priv, pub, salt, encapsulation []byte) ([]byte, error) {
+	if len(encapsulation) != hybridEncapsulationSize || encapsulation[0] != hybridVersion {
+		return nil, utils.NewKindError(utils.KindCrypto, "unsupported or malformed hybrid encapsulation")
+	}
+
+	x, dk, err := hybridPrivate(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	eph, err := ecdh.X25519().NewPublicKey(encapsulation[1:33])
+	if err != nil {
+		return nil, utils.WithKind(utils.KindCrypto, errors.Wrap(err, "invalid ephemeral key"))
+	}
+
+	sharedX, err := x.ECDH(eph)
+	if err != nil {
+		return nil, utils.WithKind(utils.KindCrypto, errors.WithStack(err))
+	}
+
+	sharedK, err := dk.Decapsulate(encapsulation[33:])
+	if err != nil {
+		return nil, utils.WithKind(utils.KindCrypto, errors.WithStack(err))
+	}
+
+	return hybridKEK(sharedK, sharedX, salt, encapsulation, pub)
+}
+
+// hybridKEK combines the shared secrets into a key encryption key, binding in the
+// encapsulation and the public key of the recipient
+func hybridKEK(sharedK, sharedX, salt, encapsulation, pub []byte) ([]byte, error) {
+	secret := append(append([]byte{}, sharedK...), sharedX...)
+	defer wipe(secret)
+	defer wipe(sharedK)
+	defer wipe(sharedX)
+
+	info := append([]byte(string(X25519MlKem768Aes256Gcm)+"\x00"), encapsulation...)
+	info = append(info, pub...)
+
+	kek, err := hkdf.Key(sha256.New, secret, salt, string(info), 32)
+	return kek, errors.WithStack(err)
+}
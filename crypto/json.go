@@ -15,63 +15,48 @@
 package crypto
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"encoding/base64"
 	"encoding/json"
 
 	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/utils"
 )
 
-// EncryptJSON encrypts a JSON object and base64 (URL) encodes the ciphertext
-func EncryptJSON(val interface{}, key, nonce, salt []byte) (ciphertext string, err error) {
+// EncryptJSON encrypts a JSON object with the data key, nonce and salt of d in its format
+// and base64 (URL) encodes the ciphertext
+func EncryptJSON(val interface{}, d *DeCrypto) (ciphertext string, err error) {
 	plaintext, err := json.Marshal(val)
 	if err != nil {
 		err = errors.WithStack(err)
 		return
 	}
 
-	block, err := aes.NewCipher(key)
+	sealed, err := d.format().seal(d.DecKey, d.Nonce, plaintext, d.Salt)
 	if err != nil {
-		err = errors.WithStack(err)
 		return
 	}
 
-	aesgcm, err := cipher.NewGCM(block)
-	if err != nil {
-		err = errors.WithStack(err)
-		return
-	}
-
-	ciphertext = base64.URLEncoding.EncodeToString(aesgcm.Seal(nil, nonce, plaintext, salt))
+	ciphertext = base64.URLEncoding.EncodeToString(sealed)
 
 	return
 }
 
 // DecryptJSON decrypts a string that is the base64 (URL) encoded ciphertext of
-// a json object and assigns that object to val
-func DecryptJSON(ciphertext string, key, nonce, salt []byte, val interface{}) (err error) {
+// a json object encrypted with d and assigns that object to val
+func DecryptJSON(ciphertext string, d *DeCrypto, val interface{}) (err error) {
 	decoded, err := base64.URLEncoding.DecodeString(ciphertext)
 	if err != nil {
 		err = errors.WithStack(err)
 		return
 	}
 
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		err = errors.WithStack(err)
-		return
-	}
-
-	aesgcm, err := cipher.NewGCM(block)
-	if err != nil {
-		err = errors.WithStack(err)
+	plaintext, err := d.format().open(d.DecKey, d.Nonce, decoded, d.Salt)
+	if errors.Cause(err) == errWrongKey {
+		err = utils.NewKindError(utils.KindCrypto, "the config was encrypted with another key")
 		return
-	}
-
-	plaintext, err := aesgcm.Open(nil, nonce, decoded, salt)
-	if err != nil {
-		err = errors.WithStack(err)
+	} else if err != nil {
+		err = utils.WithKind(utils.KindCrypto, err)
 		return
 	}
 
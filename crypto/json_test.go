@@ -19,8 +19,10 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/chacha20poly1305"
 
 	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/utils"
 )
 
 type test struct {
@@ -51,17 +53,46 @@ func TestJSONEncDec(t *testing.T) {
 	require.NoError(err)
 	require.Equal(16, m)
 
-	nonce := make([]byte, 12)
-	p, err := rand.Read(nonce)
-	require.NoError(err)
-	require.Equal(12, p)
+	suites := []struct {
+		cipher    crypto.Cipher
+		nonceSize int
+		version   int
+	}{
+		{crypto.Aes256Gcm, 12, 0},
+		{crypto.Aes256Gcm, 12, crypto.LatestVersion},
+		{crypto.ChaCha20Poly1305, chacha20poly1305.NonceSizeX, crypto.LatestVersion},
+	}
 
-	str, err := crypto.EncryptJSON(o, key, nonce, salt)
-	require.NoError(err)
+	for _, suite := range suites {
+		nonce := make([]byte, suite.nonceSize)
+		p, err := rand.Read(nonce)
+		require.NoError(err)
+		require.Equal(suite.nonceSize, p)
+
+		d := &crypto.DeCrypto{
+			Crypto: crypto.Crypto{Nonce: nonce, Salt: salt, Version: suite.version},
+			DecKey: key,
+		}
+		if suite.cipher == crypto.ChaCha20Poly1305 {
+			d.Cipher = suite.cipher
+		}
 
-	t.Log(str)
-	o1 := test{}
+		str, err := crypto.EncryptJSON(o, d)
+		require.NoError(err)
 
-	require.NoError(crypto.DecryptJSON(str, key, nonce, salt, &o1))
-	require.Equal(o, o1)
+		t.Log(str)
+		o1 := test{}
+
+		require.NoError(crypto.DecryptJSON(str, d, &o1))
+		require.Equal(o, o1)
+
+		other := *d
+		other.DecKey = make([]byte, 32)
+		err = crypto.DecryptJSON(str, &other, &test{})
+		require.Error(err)
+		require.Equal(utils.KindCrypto, utils.KindOf(err))
+		if suite.version == crypto.LatestVersion {
+			require.Contains(err.Error(), "another key")
+		}
+	}
 }
@@ -15,9 +15,6 @@
 package crypto
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"net/url"
@@ -50,6 +47,28 @@ const (
 
 	// ItersKey is the key used for the version field in the url encoding of the crypto object
 	ItersKey = "iters"
+
+	// KeyIDKey is the key used for the key ID field in the url encoding of the crypto object
+	KeyIDKey = "keyid"
+
+	// EphemeralKeyKey is the key used for the ephemeral public key field in the url encoding
+	// of the crypto object
+	EphemeralKeyKey = "epk"
+
+	// ProviderKey is the key used for the key wrapping provider field in the url encoding of
+	// the crypto object
+	ProviderKey = "provider"
+
+	// ThresholdKey is the key used for the threshold field in the url encoding of the
+	// crypto object
+	ThresholdKey = "threshold"
+
+	// SharesKey is the key used for the (JSON encoded) shares in the url encoding of the
+	// crypto object
+	SharesKey = "shares"
+
+	// CipherKey is the key used for the cipher field in the url encoding of the crypto object
+	CipherKey = "cipher"
 )
 
 // Crypto contains the common parts of EnCrypto and DeCrypto
@@ -59,6 +78,19 @@ type Crypto struct {
 	Salt    []byte `json:"salt"`
 	Iters   int    `json:"iters"`
 	Version int    `json:"version"`
+	// KeyID identifies the key in the keystore, or of the key wrapping provider, that the
+	// data key is encrypted with, if it is not encrypted with a passphrase
+	KeyID string `json:"keyId,omitempty"`
+	// Provider is the name of the key wrapping provider of WRAP-AES256-GCM
+	Provider string `json:"provider,omitempty"`
+	// Threshold is the number of the Shares of SHAMIR-AES256-GCM needed to decrypt
+	Threshold int     `json:"threshold,omitempty"`
+	Shares    []Share `json:"shares,omitempty"`
+	// Cipher encrypts the data, config and keys. It is omitted for AES256-GCM.
+	Cipher Cipher `json:"cipher,omitempty"`
+	// EphemeralKey is the public key of the ephemeral key pair of X25519-AES256-GCM, or the
+	// versioned encapsulation of X25519-MLKEM768-AES256-GCM
+	EphemeralKey []byte `json:"epk,omitempty"`
 }
 
 // EnCrypto is a encrypted key with the algotithms used to encrypt it and the data
@@ -69,6 +101,22 @@ type EnCrypto struct {
 
 // NewEncryptoCompat create a new Encrypto struct from some URLs
 func NewEncryptoCompat(urls []string, opts *Opts) (e EnCrypto, err error) {
+	e, err = ParseEncryptoCompat(urls)
+	if err != nil {
+		return
+	}
+
+	if e.Algos != opts.Algos {
+		err = utils.NewError("encryption type does not match decryption type", false)
+		return
+	}
+
+	return
+}
+
+// ParseEncryptoCompat creates a new Encrypto struct from some URLs without checking
+// that it may be decrypted with any particular options
+func ParseEncryptoCompat(urls []string) (e EnCrypto, err error) {
 	if len(urls) == 0 {
 		err = errors.New("missing encryption key")
 		return
@@ -85,11 +133,6 @@ func NewEncryptoCompat(urls []string, opts *Opts) (e EnCrypto, err error) {
 		return
 	}
 
-	if e.Algos != opts.Algos {
-		err = utils.NewError("encryption type does not match decryption type", false)
-		return
-	}
-
 	e.EncKey, err = base64.URLEncoding.DecodeString(u.Query().Get(KeyKey))
 	if err != nil {
 		err = errors.WithStack(err)
@@ -120,6 +163,19 @@ func NewEncryptoCompat(urls []string, opts *Opts) (e EnCrypto, err error) {
 		return
 	}
 
+	if c := u.Query().Get(CipherKey); c != "" {
+		if e.Cipher, err = ValidateCipher(c); err != nil {
+			return
+		}
+	}
+
+	s, err := LookupScheme(e.Algos, e.Version)
+	if err != nil {
+		return
+	}
+
+	err = s.DecodeCompat(u.Query(), &e)
+
 	return
 }
 
@@ -137,155 +193,154 @@ func NewURLCompat(e *EnCrypto, opts *Opts) (u *url.URL, err error) {
 	v.Set(SaltKey, base64.URLEncoding.EncodeToString(e.Salt))
 	v.Set(ItersKey, strconv.Itoa(e.Iters))
 	v.Set(VersionKey, strconv.Itoa(e.Version))
+	if e.Cipher != "" {
+		v.Set(CipherKey, string(e.Cipher))
+	}
+
+	s, err := LookupScheme(e.Algos, e.Version)
+	if err != nil {
+		return
+	}
+
+	if err = s.EncodeCompat(e, v); err != nil {
+		return
+	}
+
 	u.RawQuery = v.Encode()
 	return
 }
 
-// DecryptKey is the inverse function of EncryptKey (up to error)
+// DecryptKey is the inverse function of EncryptKey (up to error). The data key is
+// decrypted by the scheme of its algorithms and version. A data key that was encrypted
+// with a key from the keystore is decrypted with the key of the same ID from opts.Keys, and
+// one that was wrapped by a provider with the provider of the same name from opts.Wrappers,
+// and one whose key was split into shares with the keys and passphrases of the shares,
+// whatever the algorithms of opts. It is not decrypted if it is outside the policy of opts.
 func DecryptKey(e EnCrypto, opts *Opts) (d DeCrypto, err error) {
-	if e.Algos != opts.Algos {
-		err = utils.NewError("encryption type does not match decryption type", false)
+	s, err := LookupScheme(e.Algos, e.Version)
+	if err != nil {
 		return
 	}
 
-	passphrase, err := opts.GetPassphrase(StdinPassReader)
-	if err != nil {
-		err = errors.WithStack(err)
+	if err = opts.Policy.Check(e.Crypto); err != nil {
 		return
 	}
 
-	d.Crypto = e.Crypto
+	if d, err = s.Unwrap(e, opts); err != nil {
+		return
+	}
 
-	if vD, ok := versionDataStore[d.Version]; !ok {
-		err = errors.New("unknown version")
-	} else {
-		if vD.saltLength != len(d.Salt) {
-			err = errors.New("salt is wrong length")
-			return
-		}
+	d.DecKey = SecretFrom(d.DecKey)
+	return
+}
 
-		if vD.nonceLength != len(d.Nonce) {
-			err = errors.New("nonce is wrong length")
-			return
-		}
+// checkLengths checks the lengths of the salt and nonce against the version
+func checkLengths(c Crypto) error {
+	vD, ok := versionDataStore[c.Version]
+	if !ok {
+		return errors.New("unknown version")
+	}
 
-		d.DecKey, err = deckey(e.EncKey, e.Nonce, e.Salt, e.Iters, passphrase)
-		err = errors.WithStack(err)
+	if vD.saltLength != len(c.Salt) {
+		return errors.New("salt is wrong length")
 	}
 
-	return
+	nonceLength := vD.nonceLength
+	if c.Cipher == ChaCha20Poly1305 {
+		nonceLength = c.Cipher.nonceSize()
+	}
+
+	if nonceLength != len(c.Nonce) {
+		return errors.New("nonce is wrong length")
+	}
+
+	return nil
 }
 
-// deckey decrypts the ciphertext (=encrpted data key) with the given passphrase and salt
+// deckey decrypts the ciphertext (=encrpted data key) in the given format with the given
+// passphrase and salt
 func deckey(
+	f format,
 	ciphertext, nonce, salt []byte,
 	iter int,
-	pass string,
+	pass []byte,
 ) (
 	plaintext []byte,
 	err error,
 ) {
 	kek := passSalt2Key(pass, salt, iter)
-
-	block, err := aes.NewCipher(kek)
-	if err != nil {
-		return
-	}
-
-	aesgcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return
+	defer kek.Wipe()
+
+	plaintext, err = f.open(kek, nonce, ciphertext, salt)
+	switch {
+	case err == nil:
+	case errors.Cause(err) == errWrongKey:
+		err = utils.NewKindError(utils.KindCrypto, "wrong passphrase")
+	case f.committing:
+		err = utils.WithKind(utils.KindCrypto, errors.Wrap(err, "the passphrase is right but the key has been tampered with"))
+	default:
+		err = utils.WithKind(utils.KindCrypto, errors.Wrap(err, "could not decrypt the key, the passphrase may be wrong"))
 	}
 
-	return aesgcm.Open(nil, nonce, ciphertext, salt)
+	return
 }
 
 // DeCrypto is a decrypted key with the algotithms used to encrypt it and the data
 type DeCrypto struct {
 	Crypto
-	DecKey []byte `json:"-"`
+	DecKey Secret `json:"-"`
 }
 
-// NewDecrypto create a new DeCrypto struct that holds decrupted key data
-func NewDecrypto(opts *Opts) (d *DeCrypto, err error) {
-	d = &DeCrypto{
-		Crypto: Crypto{
-			Algos:   opts.Algos,
-			Version: opts.Version,
-			Nonce:   make([]byte, 12),
-			Salt:    make([]byte, 16),
-			Iters:   Pbkdf2Iter,
-		},
-		DecKey: make([]byte, 32),
-	}
-
-	if _, err = rand.Read(d.DecKey); err != nil {
-		err = errors.WithStack(err)
-		return
-	}
-
-	if _, err = rand.Read(d.Nonce); err != nil {
-		err = errors.WithStack(err)
-		return
-	}
+// Wipe wipes the data key of d, once the blob has been encrypted or decrypted with it
+func (d *DeCrypto) Wipe() {
+	d.DecKey.Wipe()
+	d.DecKey = nil
+}
 
-	if _, err = rand.Read(d.Salt); err != nil {
-		err = errors.WithStack(err)
+// NewDecrypto create a new DeCrypto struct that holds decrupted key data, generated by the
+// scheme of the algorithms and version of opts
+func NewDecrypto(opts *Opts) (d *DeCrypto, err error) {
+	s, err := LookupScheme(opts.Algos, opts.Version)
+	if err != nil {
 		return
 	}
 
-	return
+	return s.NewKey(opts)
 }
 
-// EncryptKey encrypts a plaintext key with a passphrase and salt
+// EncryptKey encrypts a plaintext key with the scheme of its algorithms and version
 func EncryptKey(d DeCrypto, opts *Opts) (e EnCrypto, err error) {
 	if d.Algos != opts.Algos {
 		err = utils.NewError("encryption type does not match decryption type", false)
 		return
 	}
 
-	passphrase, err := opts.GetPassphrase(StdinPassReader)
+	s, err := LookupScheme(d.Algos, d.Version)
 	if err != nil {
 		return
 	}
 
-	e.Crypto = d.Crypto
-	e.EncKey, err = enckey(d.DecKey, e.Nonce, e.Salt, e.Iters, passphrase)
-	if err != nil {
-		err = errors.WithStack(err)
-		return
-	}
-
-	return
+	return s.Wrap(d, opts)
 }
 
-// enckey encrypts the plaintext (= data key) with the given passphrase and salt
+// enckey encrypts the plaintext (= data key) in the given format with the given passphrase
+// and salt
 func enckey(
+	f format,
 	plaintext, nonce, salt []byte,
 	iters int,
-	pass string,
+	pass []byte,
 ) (
 	ciphertext []byte,
 	err error,
 ) {
 	kek := passSalt2Key(pass, salt, iters)
+	defer kek.Wipe()
 
-	block, err := aes.NewCipher(kek)
-	if err != nil {
-		err = errors.WithStack(err)
-		return
-	}
-
-	aesgcm, err := cipher.NewGCM(block)
-	if err != nil {
-		err = errors.WithStack(err)
-		return
-	}
-
-	return aesgcm.Seal(nil, nonce, plaintext, salt), nil
+	return f.seal(kek, nonce, plaintext, salt)
 }
 
 // passSalt2Key deterministically returns a 32 byte encryption key given a passphrase and a salt
-func passSalt2Key(pass string, salt []byte, iter int) []byte {
-	return pbkdf2.Key([]byte(pass), salt, iter, 32, sha256.New)
+func passSalt2Key(pass, salt []byte, iter int) Secret {
+	return SecretFrom(pbkdf2.Key(pass, salt, iter, 32, sha256.New))
 }
@@ -18,6 +18,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/Senetas/crypto-cli/crypto"
 	"github.com/Senetas/crypto-cli/utils"
@@ -27,8 +28,9 @@ var (
 	//passphrase = "196884 = 196883 + 1"
 	passphrase = "hunter2"
 	opts       = &crypto.Opts{
-		Algos:  crypto.Pbkdf2Aes256Gcm,
-		Compat: false,
+		Algos:   crypto.Pbkdf2Aes256Gcm,
+		Compat:  false,
+		Version: crypto.LatestVersion,
 	}
 	optsNone = &crypto.Opts{
 		Algos:  crypto.None,
@@ -38,6 +40,11 @@ var (
 		Algos:  crypto.Pbkdf2Aes256Gcm,
 		Compat: true,
 	}
+	optsChaCha = &crypto.Opts{
+		Algos:   crypto.Pbkdf2Aes256Gcm,
+		Cipher:  crypto.ChaCha20Poly1305,
+		Version: crypto.LatestVersion,
+	}
 	urlsValid   = []string{"https://crypto.senetas.com/?algos=PBKDF2-AES256-GCM&key=AAAAAAAAnECtJQZpzaepbGxVsLqfhEVdGEh3tadKd7w-wZIXTY-yMo8LidOYbJZ2axuUExIhDGPQZxyZzdzVD2OuiPyFMNj98Ju1rF-D2Sh2Qxd3"}
 	urlsInvalid = []string{"http://crypto.senetas.com/?algos=PBKDF2-AES256-GCM&key=3m6X-rV110o2DEm3pU-8qZpV-7ZKbBroFkWOUaI1Dv0_WRaVceZy5tsJ-PMoOMUW5CScc2wpL-PoBPMVAen7Nf9BPPCdcbrtpmFsMw=="}
 )
@@ -52,6 +59,7 @@ func TestCrypto(t *testing.T) {
 		{opts, passphrase},
 		{optsNone, passphrase},
 		{optsCompat, passphrase},
+		{optsChaCha, passphrase},
 	}
 
 	for _, test := range tests {
@@ -76,6 +84,82 @@ func TestCrypto(t *testing.T) {
 	}
 }
 
+func TestWrongPassphrase(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tests := []struct {
+		version int
+		msg     string
+	}{
+		{0, "the passphrase may be wrong"},
+		{crypto.LatestVersion, "wrong passphrase"},
+	}
+
+	for _, test := range tests {
+		encOpts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm, Version: test.version}
+		encOpts.SetPassphrase(passphrase)
+
+		c, err := crypto.NewDecrypto(encOpts)
+		require.NoError(err)
+
+		e, err := crypto.EncryptKey(*c, encOpts)
+		require.NoError(err)
+
+		decOpts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm}
+		decOpts.SetPassphrase("hunter3")
+
+		_, err = crypto.DecryptKey(e, decOpts)
+		if assert.Error(err) {
+			assert.Equal(utils.KindCrypto, utils.KindOf(err))
+			assert.Contains(err.Error(), test.msg)
+		}
+	}
+}
+
+func TestKeyCommitment(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	encOpts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm, Version: crypto.LatestVersion}
+	encOpts.SetPassphrase(passphrase)
+
+	c, err := crypto.NewDecrypto(encOpts)
+	require.NoError(err)
+
+	e, err := crypto.EncryptKey(*c, encOpts)
+	require.NoError(err)
+
+	// the commitment is prepended to the encrypted key
+	require.Len(e.EncKey, 32+len(c.DecKey)+16)
+
+	tests := []struct {
+		i   int
+		msg string
+	}{
+		{0, "wrong passphrase"},
+		{31, "wrong passphrase"},
+		{32, "tampered with"},
+		{len(e.EncKey) - 1, "tampered with"},
+	}
+
+	for _, test := range tests {
+		tampered := e
+		tampered.EncKey = append([]byte(nil), e.EncKey...)
+		tampered.EncKey[test.i] ^= 1
+
+		_, err = crypto.DecryptKey(tampered, encOpts)
+		if assert.Error(err) {
+			assert.Equal(utils.KindCrypto, utils.KindOf(err))
+			assert.Contains(err.Error(), test.msg)
+		}
+	}
+
+	d, err := crypto.DecryptKey(e, encOpts)
+	require.NoError(err)
+	assert.Equal(*c, d)
+}
+
 func TestEncDecCrypto(t *testing.T) {
 	assert := assert.New(t)
 
@@ -207,3 +291,30 @@ func TestEncDecCryptoCompat(t *testing.T) {
 		}
 	}
 }
+
+func TestParseEncryptoCompat(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ek := &crypto.EnCrypto{
+		Crypto: crypto.Crypto{
+			Algos:   crypto.Pbkdf2Aes256Gcm,
+			Nonce:   make([]byte, 12),
+			Salt:    make([]byte, 16),
+			Iters:   crypto.Pbkdf2Iter,
+			Version: 0,
+		},
+		EncKey: make([]byte, 48),
+	}
+
+	u, err := crypto.NewURLCompat(ek, opts)
+	require.NoError(err)
+
+	// unlike NewEncryptoCompat the algorithms are not checked against any options
+	e, err := crypto.ParseEncryptoCompat([]string{u.String()})
+	require.NoError(err)
+	assert.Equal(*ek, e)
+
+	_, err = crypto.ParseEncryptoCompat([]string{})
+	assert.EqualError(err, "missing encryption key")
+}
@@ -0,0 +1,165 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// the operations of the keyprovider protocol
+const (
+	keyWrapOp   = "keywrap"
+	keyUnwrapOp = "keyunwrap"
+)
+
+// KeyProviderInput is the message written to the stdin of a keyprovider binary. It follows
+// the keyprovider protocol of ocicrypt: the key ID is passed in the parameters of the
+// encrypt or decrypt config under "keyid", and the data key as the opts data.
+type KeyProviderInput struct {
+	Operation       string           `json:"op"`
+	KeyWrapParams   *KeyWrapParams   `json:"keywrapparams,omitempty"`
+	KeyUnwrapParams *KeyUnwrapParams `json:"keyunwrapparams,omitempty"`
+}
+
+// KeyWrapParams are the parameters of a keywrap operation
+type KeyWrapParams struct {
+	EncryptConfig KeyProviderConfig `json:"ec"`
+	OptsData      []byte            `json:"optsdata"`
+}
+
+// KeyUnwrapParams are the parameters of a keyunwrap operation
+type KeyUnwrapParams struct {
+	DecryptConfig KeyProviderConfig `json:"dc"`
+	Annotation    []byte            `json:"annotation"`
+}
+
+// KeyProviderConfig holds the parameters of an operation
+type KeyProviderConfig struct {
+	Parameters map[string][][]byte `json:"Parameters"`
+}
+
+// KeyProviderOutput is the message read from the stdout of a keyprovider binary
+type KeyProviderOutput struct {
+	KeyWrapResults   *KeyWrapResults   `json:"keywrapresults,omitempty"`
+	KeyUnwrapResults *KeyUnwrapResults `json:"keyunwrapresults,omitempty"`
+}
+
+// KeyWrapResults is the result of a keywrap operation
+type KeyWrapResults struct {
+	Annotation []byte `json:"annotation"`
+}
+
+// KeyUnwrapResults is the result of a keyunwrap operation
+type KeyUnwrapResults struct {
+	OptsData []byte `json:"optsdata"`
+}
+
+// CommandWrapper wraps data keys by running an external keyprovider binary, which reads a
+// KeyProviderInput from its stdin and writes a KeyProviderOutput to its stdout
+type CommandWrapper struct {
+	name    string
+	command string
+}
+
+// NewCommandWrapper creates a wrapper called name that runs command with the shell
+func NewCommandWrapper(name, command string) *CommandWrapper {
+	return &CommandWrapper{name: name, command: command}
+}
+
+// Name implements KeyWrapper
+func (c *CommandWrapper) Name() string {
+	return c.name
+}
+
+// Wrap implements KeyWrapper
+func (c *CommandWrapper) Wrap(keyID string, key []byte) ([]byte, error) {
+	out, err := c.run(&KeyProviderInput{
+		Operation: keyWrapOp,
+		KeyWrapParams: &KeyWrapParams{
+			EncryptConfig: keyProviderConfig(keyID),
+			OptsData:      key,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if out.KeyWrapResults == nil || len(out.KeyWrapResults.Annotation) == 0 {
+		return nil, errors.Errorf("keyprovider %s returned no wrapped key", c.name)
+	}
+
+	return out.KeyWrapResults.Annotation, nil
+}
+
+// Unwrap implements KeyWrapper
+func (c *CommandWrapper) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	out, err := c.run(&KeyProviderInput{
+		Operation: keyUnwrapOp,
+		KeyUnwrapParams: &KeyUnwrapParams{
+			DecryptConfig: keyProviderConfig(keyID),
+			Annotation:    wrapped,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if out.KeyUnwrapResults == nil {
+		return nil, errors.Errorf("keyprovider %s returned no key", c.name)
+	}
+
+	return out.KeyUnwrapResults.OptsData, nil
+}
+
+// run runs the command with input on its stdin and decodes its stdout. The stderr of the
+// command is passed through.
+func (c *CommandWrapper) run(input *KeyProviderInput) (*KeyProviderOutput, error) {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	cmd := shellCommand(c.command)
+	stdout := &bytes.Buffer{}
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+
+	if err = cmd.Run(); err != nil {
+		err = errors.Wrapf(err, "keyprovider %s failed to %s", c.name, input.Operation)
+		if input.Operation == keyUnwrapOp {
+			err = utils.WithKind(utils.KindCrypto, err)
+		}
+		return nil, err
+	}
+
+	out := &KeyProviderOutput{}
+	if err = json.Unmarshal(stdout.Bytes(), out); err != nil {
+		return nil, errors.Wrapf(err, "could not decode the output of keyprovider %s", c.name)
+	}
+
+	return out, nil
+}
+
+// keyProviderConfig passes the key ID to a keyprovider
+func keyProviderConfig(keyID string) KeyProviderConfig {
+	return KeyProviderConfig{Parameters: map[string][][]byte{"keyid": {[]byte(keyID)}}}
+}
@@ -0,0 +1,370 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// KeyType is the type of a key in the keystore
+type KeyType string
+
+const (
+	// SymmetricKey is a 256 bit key that both encrypts and decrypts
+	SymmetricKey KeyType = "symmetric"
+
+	// X25519Identity is an X25519 key pair. Images are encrypted to the public key, which
+	// may be shared, and decrypted with the private key.
+	X25519Identity KeyType = "x25519"
+
+	// HybridIdentity is an X25519 key pair combined with an ML-KEM-768 key pair, so that
+	// images encrypted to it remain confidential if either is broken, e.g. by a quantum
+	// computer
+	HybridIdentity KeyType = "x25519-mlkem768"
+)
+
+// Key is a named key in the keystore
+type Key struct {
+	Name string  `json:"name"`
+	Type KeyType `json:"type"`
+	// ID identifies the key in the manifests of the images encrypted with it
+	ID string `json:"id"`
+	// Private is the symmetric key or the private key of an identity. It is absent from the
+	// public part of an identity.
+	Private []byte    `json:"private,omitempty"`
+	Public  []byte    `json:"public,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// KeyLookup finds the key with which an image was encrypted by its ID
+type KeyLookup interface {
+	LookupID(id string) (*Key, error)
+}
+
+// GenerateKey generates a new key of the given type
+func GenerateKey(name string, typ KeyType) (k *Key, err error) {
+	k = &Key{Name: name, Type: typ, Created: time.Now().UTC()}
+
+	switch typ {
+	case SymmetricKey:
+		k.Private = make([]byte, 32)
+		if _, err = rand.Read(k.Private); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	case X25519Identity:
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		k.Private = priv.Bytes()
+		k.Public = priv.PublicKey().Bytes()
+	case HybridIdentity:
+		if k.Private, k.Public, err = generateHybrid(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, utils.NewKindError(utils.KindUsage, "invalid key type: "+string(typ))
+	}
+
+	k.ID = keyID(k)
+	return k, nil
+}
+
+// Validate checks that the key is well formed and that its ID matches it
+func (k *Key) Validate() error {
+	switch k.Type {
+	case SymmetricKey:
+		if len(k.Private) != 32 {
+			return errors.Errorf("key %s: symmetric key is the wrong length", k.Name)
+		}
+	case X25519Identity:
+		if len(k.Public) != 32 {
+			return errors.Errorf("key %s: public key is the wrong length", k.Name)
+		}
+		if k.Private != nil {
+			priv, err := ecdh.X25519().NewPrivateKey(k.Private)
+			if err != nil {
+				return errors.Wrapf(err, "key %s", k.Name)
+			}
+			pub, err := ecdh.X25519().NewPublicKey(k.Public)
+			if err != nil {
+				return errors.Wrapf(err, "key %s", k.Name)
+			}
+			if !priv.PublicKey().Equal(pub) {
+				return errors.Errorf("key %s: private and public keys do not match", k.Name)
+			}
+		}
+	case HybridIdentity:
+		if err := checkHybrid(k.Private, k.Public); err != nil {
+			return errors.Wrapf(err, "key %s", k.Name)
+		}
+	default:
+		return errors.Errorf("key %s: invalid type: %s", k.Name, k.Type)
+	}
+
+	if k.ID != keyID(k) {
+		return errors.Errorf("key %s: ID does not match the key", k.Name)
+	}
+
+	return nil
+}
+
+// PublicOnly returns the public part of an identity, which may be shared so that others
+// may encrypt images to it
+func (k *Key) PublicOnly() (*Key, error) {
+	if !k.Type.IsIdentity() {
+		return nil, utils.NewKindError(utils.KindUsage, "key "+k.Name+" has no public part")
+	}
+
+	pub := *k
+	pub.Private = nil
+	return &pub, nil
+}
+
+// Algos are the algorithms with which images are encrypted with the key
+func (k *Key) Algos() Algos {
+	switch k.Type {
+	case X25519Identity:
+		return X25519Aes256Gcm
+	case HybridIdentity:
+		return X25519MlKem768Aes256Gcm
+	}
+	return KeyAes256Gcm
+}
+
+// IsIdentity reports whether keys of the type are key pairs
+func (t KeyType) IsIdentity() bool {
+	return t == X25519Identity || t == HybridIdentity
+}
+
+// keyID derives the ID of a key. The ID of a symmetric key is a hash of it under a
+// distinct label, so that it does not reveal the key.
+func keyID(k *Key) string {
+	h := sha256.New()
+	if k.Type.IsIdentity() {
+		_, _ = h.Write([]byte("crypto-cli " + string(k.Type) + " key id\x00"))
+		_, _ = h.Write(k.Public)
+	} else {
+		_, _ = h.Write([]byte("crypto-cli symmetric key id\x00"))
+		_, _ = h.Write(k.Private)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// keyScheme encrypts the data keys with a key or to an identity from the keystore
+type keyScheme struct {
+	baseScheme
+}
+
+func (s keyScheme) NewKey(opts *Opts) (*DeCrypto, error) {
+	if opts.Key == nil {
+		return nil, utils.NewKindError(utils.KindUsage, "no key was given to encrypt with")
+	}
+
+	d, err := s.baseScheme.NewKey(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	d.Iters = 0
+	d.KeyID = opts.Key.ID
+
+	return d, nil
+}
+
+func (s keyScheme) Wrap(d DeCrypto, opts *Opts) (e EnCrypto, err error) {
+	e.Crypto = d.Crypto
+	if e.EncKey, e.EphemeralKey, err = wrapWithKey(d, opts); err == nil {
+		e.KeyID = opts.Key.ID
+	}
+	return
+}
+
+func (s keyScheme) Unwrap(e EnCrypto, opts *Opts) (d DeCrypto, err error) {
+	d.Crypto = e.Crypto
+	if err = checkLengths(d.Crypto); err != nil {
+		return
+	}
+	d.DecKey, err = unwrapWithKey(e, opts)
+	return
+}
+
+func (s keyScheme) EncodeCompat(e *EnCrypto, v url.Values) error {
+	v.Set(KeyIDKey, e.KeyID)
+	if len(e.EphemeralKey) > 0 {
+		v.Set(EphemeralKeyKey, base64.URLEncoding.EncodeToString(e.EphemeralKey))
+	}
+	return nil
+}
+
+func (s keyScheme) DecodeCompat(v url.Values, e *EnCrypto) (err error) {
+	e.KeyID = v.Get(KeyIDKey)
+	if epk := v.Get(EphemeralKeyKey); epk != "" {
+		e.EphemeralKey, err = base64.URLEncoding.DecodeString(epk)
+	}
+	return errors.WithStack(err)
+}
+
+func init() {
+	RegisterScheme(keyScheme{baseScheme{
+		algos:       KeyAes256Gcm,
+		description: "a symmetric key from the keystore, see --key",
+		source:      KeystoreSource,
+	}}, 0, 1)
+	RegisterScheme(keyScheme{baseScheme{
+		algos:       X25519Aes256Gcm,
+		description: "an X25519 identity from the keystore, see --key",
+		source:      KeystoreSource,
+	}}, 0, 1)
+	RegisterScheme(keyScheme{baseScheme{
+		algos:       X25519MlKem768Aes256Gcm,
+		description: "a hybrid X25519 and ML-KEM-768 identity from the keystore, see --key",
+		source:      KeystoreSource,
+	}}, 0, 1)
+}
+
+// wrapWithKey encrypts the data key of d with the key in opts, returning the encrypted
+// key and, for an identity, the public key of the ephemeral key pair
+func wrapWithKey(d DeCrypto, opts *Opts) (enc, ephemeral []byte, err error) {
+	k := opts.Key
+	if k == nil {
+		return nil, nil, utils.NewKindError(utils.KindUsage, "no key was given to encrypt with")
+	}
+	if k.Algos() != d.Algos {
+		return nil, nil, utils.NewError("encryption type does not match the type of the key", false)
+	}
+
+	return wrapTo(k, d.format(), d.Nonce, d.Salt, d.DecKey)
+}
+
+// unwrapWithKey decrypts the data key of e with the key it was encrypted with, which is
+// found in the keystore of opts by its ID
+func unwrapWithKey(e EnCrypto, opts *Opts) (_ []byte, err error) {
+	if opts.Keys == nil {
+		return nil, utils.NewKindError(utils.KindUsage, "the image was encrypted with key "+e.KeyID+" but no keystore was given")
+	}
+
+	k, err := opts.Keys.LookupID(e.KeyID)
+	if err != nil {
+		return
+	}
+	if k.Algos() != e.Algos {
+		return nil, utils.NewError("encryption type does not match the type of the key", false)
+	}
+
+	return unwrapFrom(k, e.format(), e.Nonce, e.Salt, e.EphemeralKey, e.EncKey)
+}
+
+// wrapTo encrypts plaintext to the key k in the format f, returning the ciphertext and, for an identity,
+// the public key of the ephemeral key pair or, for a hybrid identity, the encapsulation
+func wrapTo(k *Key, f format, nonce, salt, plaintext []byte) (enc, ephemeral []byte, err error) {
+	kek := k.Private
+	if k.Type == X25519Identity {
+		eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+
+		ephemeral = eph.PublicKey().Bytes()
+		if kek, err = agreeKey(eph, k.Public, salt, ephemeral); err != nil {
+			return nil, nil, err
+		}
+	} else if k.Type == HybridIdentity {
+		if kek, ephemeral, err = hybridEncapsulate(k.Public, salt); err != nil {
+			return nil, nil, err
+		}
+	}
+	if k.Type.IsIdentity() {
+		defer wipe(kek)
+	}
+
+	enc, err = sealKey(f, kek, nonce, plaintext, salt)
+	return
+}
+
+// unwrapFrom is the inverse of wrapTo. It requires the private part of k.
+func unwrapFrom(k *Key, f format, nonce, salt, ephemeral, ciphertext []byte) ([]byte, error) {
+	if len(k.Private) == 0 {
+		return nil, utils.NewKindError(utils.KindCrypto, "key "+k.Name+" is only the public part of an identity")
+	}
+
+	kek := k.Private
+	if k.Type == X25519Identity {
+		priv, err := ecdh.X25519().NewPrivateKey(k.Private)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if kek, err = agreeKey(priv, ephemeral, salt, ephemeral); err != nil {
+			return nil, err
+		}
+	} else if k.Type == HybridIdentity {
+		var err error
+		if kek, err = hybridDecapsulate(k.Private, k.Public, salt, ephemeral); err != nil {
+			return nil, err
+		}
+	}
+	if k.Type.IsIdentity() {
+		defer wipe(kek)
+	}
+
+	return openKey(f, kek, nonce, ciphertext, salt)
+}
+
+// agreeKey derives the key encryption key from the X25519 shared secret of priv and the
+// public key peer. The ephemeral public key is bound into the derivation.
+func agreeKey(priv *ecdh.PrivateKey, peer, salt, ephemeral []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, utils.WithKind(utils.KindCrypto, errors.Wrap(err, "invalid public key"))
+	}
+
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, utils.WithKind(utils.KindCrypto, errors.WithStack(err))
+	}
+	defer wipe(shared)
+
+	info := append([]byte(string(X25519Aes256Gcm)+"\x00"), ephemeral...)
+	kek, err := hkdf.Key(sha256.New, shared, salt, string(info), 32)
+	return kek, errors.WithStack(err)
+}
+
+// sealKey encrypts plaintext in the format f under kek, authenticating the salt
+func sealKey(f format, kek, nonce, plaintext, salt []byte) ([]byte, error) {
+	return f.seal(kek, nonce, plaintext, salt)
+}
+
+// openKey is the inverse of sealKey
+func openKey(f format, kek, nonce, ciphertext, salt []byte) ([]byte, error) {
+	plaintext, err := f.open(kek, nonce, ciphertext, salt)
+	if errors.Cause(err) == errWrongKey {
+		return nil, utils.NewKindError(utils.KindCrypto, "could not decrypt the key: it was encrypted with another key")
+	} else if err != nil {
+		return nil, utils.WithKind(utils.KindCrypto, errors.Wrap(err, "could not decrypt the key"))
+	}
+
+	return plaintext, nil
+}
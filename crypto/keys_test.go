@@ -0,0 +1,253 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestGenerateKey(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		typ    crypto.KeyType
+		algos  crypto.Algos
+		hasErr bool
+	}{
+		{crypto.SymmetricKey, crypto.KeyAes256Gcm, false},
+		{crypto.X25519Identity, crypto.X25519Aes256Gcm, false},
+		{crypto.HybridIdentity, crypto.X25519MlKem768Aes256Gcm, false},
+		{crypto.KeyType("rsa"), "", true},
+	}
+
+	for _, test := range tests {
+		k, err := crypto.GenerateKey("test", test.typ)
+		if test.hasErr {
+			if assert.Error(err) {
+				assert.Equal(utils.KindUsage, utils.KindOf(err))
+			}
+			continue
+		}
+
+		if !assert.NoError(err) {
+			continue
+		}
+		assert.NoError(k.Validate())
+		assert.Equal(test.algos, k.Algos())
+		_, err = crypto.ValidateAlgos(string(k.Algos()))
+		assert.NoError(err)
+
+		// a key whose ID does not match is rejected
+		bad := *k
+		bad.ID = "0000000000000000"
+		assert.Error(bad.Validate())
+	}
+}
+
+func TestEncDecWithKey(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	sym, err := crypto.GenerateKey("sym", crypto.SymmetricKey)
+	require.NoError(err)
+	id, err := crypto.GenerateKey("id", crypto.X25519Identity)
+	require.NoError(err)
+	pub, err := id.PublicOnly()
+	require.NoError(err)
+	pub.Name = "pub"
+	hybrid, err := crypto.GenerateKey("hybrid", crypto.HybridIdentity)
+	require.NoError(err)
+	hybridPub, err := hybrid.PublicOnly()
+	require.NoError(err)
+	hybridPub.Name = "hybrid-pub"
+
+	// the key of the owner of the identity
+	owner := crypto.NewKeystore(filepath.Join(dir, "owner.json"), nil)
+	require.NoError(owner.Add(sym))
+	require.NoError(owner.Add(id))
+	require.NoError(owner.Add(hybrid))
+
+	// the keystore of someone that only has the public part of the identity
+	other := crypto.NewKeystore(filepath.Join(dir, "other.json"), nil)
+	require.NoError(other.Add(pub))
+	require.NoError(other.Add(hybridPub))
+
+	tests := []struct {
+		key   *crypto.Key
+		keys  crypto.KeyLookup
+		kind  utils.Kind
+		noErr bool
+	}{
+		{sym, owner, utils.KindUnknown, true},
+		{id, owner, utils.KindUnknown, true},
+		{pub, owner, utils.KindUnknown, true},
+		{pub, other, utils.KindCrypto, false},
+		{hybrid, owner, utils.KindUnknown, true},
+		{hybridPub, owner, utils.KindUnknown, true},
+		{hybridPub, other, utils.KindCrypto, false},
+		{sym, other, utils.KindCrypto, false},
+		{sym, nil, utils.KindUsage, false},
+	}
+
+	for _, test := range tests {
+		encOpts := &crypto.Opts{Algos: test.key.Algos(), Key: test.key}
+
+		c, err := crypto.NewDecrypto(encOpts)
+		if !assert.NoError(err) {
+			continue
+		}
+
+		e, err := crypto.EncryptKey(*c, encOpts)
+		if !assert.NoError(err) {
+			continue
+		}
+		assert.Equal(test.key.ID, e.KeyID)
+		assert.Equal(test.key.Type.IsIdentity(), len(e.EphemeralKey) > 0)
+
+		d, err := crypto.DecryptKey(e, &crypto.Opts{Keys: test.keys})
+		if !test.noErr {
+			if assert.Error(err) {
+				assert.Equal(test.kind, utils.KindOf(err))
+			}
+			continue
+		}
+
+		if assert.NoError(err) {
+			assert.Equal(c.DecKey, d.DecKey)
+		}
+	}
+}
+
+func TestKeystore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	filename := filepath.Join(dir, "keystore.json")
+
+	// the keystore wipes each passphrase it is given once it is opened or saved
+	var given []crypto.Secret
+	provider := crypto.PassphraseFunc(func() (crypto.Secret, error) {
+		p := crypto.SecretFrom([]byte(passphrase))
+		given = append(given, p)
+		return p, nil
+	})
+
+	ks := crypto.NewKeystore(filename, provider)
+	assert.False(ks.Exists())
+
+	sym, err := crypto.GenerateKey("b", crypto.SymmetricKey)
+	require.NoError(err)
+	id, err := crypto.GenerateKey("a", crypto.X25519Identity)
+	require.NoError(err)
+
+	require.NoError(ks.Add(sym))
+	require.NoError(ks.Add(id))
+	assert.Equal(utils.KindUsage, utils.KindOf(ks.Add(sym)))
+	require.NoError(ks.Save())
+	assert.True(ks.Exists())
+
+	// the keys are read back with the same passphrase
+	ks = crypto.NewKeystore(filename, provider)
+	keys, err := ks.List()
+	require.NoError(err)
+	if assert.Len(keys, 2) {
+		assert.Equal("a", keys[0].Name)
+		assert.Equal("b", keys[1].Name)
+	}
+
+	k, err := ks.LookupID(sym.ID)
+	if assert.NoError(err) {
+		assert.Equal(sym.Private, k.Private)
+	}
+
+	require.NoError(ks.Delete("b"))
+	assert.EqualError(
+		ks.Delete("b"),
+		"no key named b in the keystore; run crypto-cli key list to see the names of the keys",
+	)
+	assert.Equal(utils.KindUsage, utils.KindOf(ks.Delete("b")))
+	require.NoError(ks.Save())
+
+	_, err = crypto.NewKeystore(filename, provider).Get("b")
+	assert.Equal(utils.KindUsage, utils.KindOf(err))
+
+	require.NotEmpty(given)
+	for _, p := range given {
+		assert.Equal(make([]byte, len(passphrase)), []byte(p))
+	}
+
+	// but not with another passphrase
+	wrong := staticPassphrase("hunter3")
+	_, err = crypto.NewKeystore(filename, wrong).List()
+	if assert.Error(err) {
+		assert.Equal(utils.KindCrypto, utils.KindOf(err))
+	}
+}
+
+func TestHybridEncapsulation(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	k, err := crypto.GenerateKey("hybrid", crypto.HybridIdentity)
+	require.NoError(err)
+
+	ks := crypto.NewKeystore(filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String()), nil)
+	require.NoError(ks.Add(k))
+
+	encOpts := &crypto.Opts{Algos: k.Algos(), Key: k}
+	c, err := crypto.NewDecrypto(encOpts)
+	require.NoError(err)
+	e, err := crypto.EncryptKey(*c, encOpts)
+	require.NoError(err)
+
+	// the version, the ephemeral X25519 public key and the ML-KEM-768 ciphertext
+	require.Len(e.EphemeralKey, 1+32+1088)
+	assert.Equal(byte(1), e.EphemeralKey[0])
+
+	tamper := func(i int) crypto.EnCrypto {
+		t := e
+		t.EphemeralKey = append([]byte{}, e.EphemeralKey...)
+		t.EphemeralKey[i] ^= 1
+		return t
+	}
+
+	// an unknown version, or a change to either half, is rejected
+	for _, i := range []int{0, 1, 100} {
+		_, err = crypto.DecryptKey(tamper(i), &crypto.Opts{Keys: ks})
+		if assert.Error(err) {
+			assert.Equal(utils.KindCrypto, utils.KindOf(err))
+		}
+	}
+
+	d, err := crypto.DecryptKey(e, &crypto.Opts{Keys: ks})
+	if assert.NoError(err) {
+		assert.Equal(c.DecKey, d.DecKey)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// keystoreVersion is the version of the format of the keystore file
+const keystoreVersion = 1
+
+// keystoreFormat is the format that the keys in the keystore file are encrypted in. Only
+// the holder of the passphrase may attempt to decrypt it, so it need not be committing.
+var keystoreFormat = format{cipher: Aes256Gcm}
+
+// keystoreFile is the format of the keystore file. The keys are encrypted as a JSON array
+// in the same way as the data keys of images are encrypted with a passphrase.
+type keystoreFile struct {
+	Version int    `json:"version"`
+	Algos   Algos  `json:"algos"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Iters   int    `json:"iters"`
+	Keys    []byte `json:"keys"`
+}
+
+// Keystore is a file of named keys and identities, encrypted with a passphrase. It is read
+// when it is first used, so the passphrase is only obtained if a key is needed.
+type Keystore struct {
+	filename string
+	provider PassphraseProvider
+	loaded   bool
+	keys     []*Key
+}
+
+// NewKeystore creates a keystore backed by filename, which need not exist yet. The
+// passphrase of the keystore is obtained from provider.
+func NewKeystore(filename string, provider PassphraseProvider) *Keystore {
+	return &Keystore{filename: filename, provider: provider}
+}
+
+// Exists reports whether the keystore file exists
+func (ks *Keystore) Exists() bool {
+	_, err := os.Stat(ks.filename)
+	return err == nil
+}
+
+// load reads and decrypts the keystore file, if it exists
+func (ks *Keystore) load() (err error) {
+	if ks.loaded {
+		return nil
+	}
+
+	// the keystore file is named by the user
+	data, err := ioutil.ReadFile(ks.filename) // #nosec
+	if os.IsNotExist(err) {
+		ks.loaded = true
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "could not read keystore")
+	}
+
+	f := &keystoreFile{}
+	if err = json.Unmarshal(data, f); err != nil {
+		return errors.Wrapf(err, "could not decode keystore %s", ks.filename)
+	}
+	if f.Version != keystoreVersion || f.Algos != Pbkdf2Aes256Gcm {
+		return errors.Errorf("unsupported keystore %s: version %d, %s", ks.filename, f.Version, f.Algos)
+	}
+
+	passphrase, err := ks.provider.Passphrase()
+	if err != nil {
+		return
+	}
+	defer passphrase.Wipe()
+
+	plaintext, err := deckey(keystoreFormat, f.Keys, f.Nonce, f.Salt, f.Iters, passphrase)
+	if err != nil {
+		return errors.Wrapf(err, "could not open keystore %s", ks.filename)
+	}
+	defer wipe(plaintext)
+
+	if err = json.Unmarshal(plaintext, &ks.keys); err != nil {
+		return errors.Wrapf(err, "could not decode keystore %s", ks.filename)
+	}
+
+	ks.loaded = true
+	return nil
+}
+
+// Save encrypts the keystore and writes it to its file, replacing it atomically
+func (ks *Keystore) Save() (err error) {
+	if err = ks.load(); err != nil {
+		return
+	}
+
+	plaintext, err := json.Marshal(ks.keys)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer wipe(plaintext)
+
+	f := &keystoreFile{
+		Version: keystoreVersion,
+		Algos:   Pbkdf2Aes256Gcm,
+		Salt:    make([]byte, 16),
+		Nonce:   make([]byte, 12),
+		Iters:   Pbkdf2Iter,
+	}
+	if _, err = rand.Read(f.Salt); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err = rand.Read(f.Nonce); err != nil {
+		return errors.WithStack(err)
+	}
+
+	passphrase, err := ks.provider.Passphrase()
+	if err != nil {
+		return
+	}
+	defer passphrase.Wipe()
+
+	if f.Keys, err = enckey(keystoreFormat, plaintext, f.Nonce, f.Salt, f.Iters, passphrase); err != nil {
+		return
+	}
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	dir := filepath.Dir(ks.filename)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "could not create directory %s", dir)
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".keystore")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { err = utils.CleanUp(tmp.Name(), err) }()
+
+	_, err = tmp.Write(data)
+	if err = utils.CheckedClose(tmp, err); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(tmp.Name(), ks.filename))
+}
+
+// List returns the keys in the keystore ordered by name
+func (ks *Keystore) List() ([]*Key, error) {
+	if err := ks.load(); err != nil {
+		return nil, err
+	}
+
+	keys := append([]*Key(nil), ks.keys...)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys, nil
+}
+
+// Get returns the key with the given name
+func (ks *Keystore) Get(name string) (*Key, error) {
+	if err := ks.load(); err != nil {
+		return nil, err
+	}
+
+	for _, k := range ks.keys {
+		if k.Name == name {
+			return k, nil
+		}
+	}
+
+	return nil, errNoKey(name)
+}
+
+// LookupID returns the key with the given ID. It implements KeyLookup.
+func (ks *Keystore) LookupID(id string) (*Key, error) {
+	if err := ks.load(); err != nil {
+		return nil, err
+	}
+
+	var found *Key
+	for _, k := range ks.keys {
+		// prefer an identity with its private key to only its public part
+		if k.ID == id && (found == nil || len(found.Private) == 0) {
+			found = k
+		}
+	}
+
+	if found == nil {
+		return nil, utils.NewKindError(utils.KindCrypto, "the image was encrypted with key "+id+", which is not in the keystore")
+	}
+
+	return found, nil
+}
+
+// Add adds a key to the keystore. The name must not be in use.
+func (ks *Keystore) Add(k *Key) error {
+	if err := ks.load(); err != nil {
+		return err
+	}
+
+	if err := k.Validate(); err != nil {
+		return err
+	}
+
+	for _, other := range ks.keys {
+		if other.Name == k.Name {
+			return utils.NewKindError(utils.KindUsage, "a key named "+k.Name+" is already in the keystore")
+		}
+	}
+
+	ks.keys = append(ks.keys, k)
+	return nil
+}
+
+// Delete removes the key with the given name from the keystore
+func (ks *Keystore) Delete(name string) error {
+	if err := ks.load(); err != nil {
+		return err
+	}
+
+	for i, k := range ks.keys {
+		if k.Name == name {
+			ks.keys = append(ks.keys[:i], ks.keys[i+1:]...)
+			return nil
+		}
+	}
+
+	return errNoKey(name)
+}
+
+// errNoKey is the error of a key name that is not in the keystore. It is a usage error
+// rather than KindNotFound, which is for missing images.
+func errNoKey(name string) error {
+	return utils.NewKindError(
+		utils.KindUsage,
+		"no key named "+name+" in the keystore; run crypto-cli key list to see the names of the keys",
+	)
+}
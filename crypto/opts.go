@@ -32,40 +32,107 @@ type Opts struct {
 	// whether the encryption data should be stored in a v2.2 compatible manifest or not
 	Compat        bool
 	passphraseSet bool
-	passphrase    string
+	passphrase    Secret
+	provider      PassphraseProvider
 	Version       int
 	Algos         Algos
-	Iter          int
+	// Cipher encrypts the data, config and keys of the blobs that are encrypted
+	Cipher Cipher
+	// Iter is the number of iterations of PBKDF2 that passphrases are derived with. If zero,
+	// it is Pbkdf2Iter.
+	Iter int
+	// Policy restricts the blobs that are decrypted. If nil, any are.
+	Policy *Policy
+	// Key is the key from the keystore that data keys are encrypted with, if Algos uses one
+	Key *Key
+	// Keys finds the keys that data keys were encrypted with when decrypting
+	Keys KeyLookup
+	// Wrapper wraps data keys with the key WrapKeyID, if Algos uses a wrapper
+	Wrapper   KeyWrapper
+	WrapKeyID string
+	// Wrappers are the providers that data keys may be unwrapped with when decrypting
+	Wrappers []KeyWrapper
+	// Threshold is the number of shares needed to decrypt, if Algos uses shares. The
+	// shares are encrypted to ShareKeys and then with SharePassphrases.
+	Threshold int
+	ShareKeys []*Key
+	// SharePassphrases provide the passphrases of shares. When decrypting, each is tried
+	// against every share, and passphrases are prompted for if they are not enough.
+	SharePassphrases []PassphraseProvider
+	sharePassCache   []Secret
+	sharePassUsed    int
 }
 
-// SetPassphrase sets the passphrase
+// kdfCost is the number of iterations of PBKDF2 to derive the keys of passphrases with
+func (o *Opts) kdfCost() int {
+	if o.Iter == 0 {
+		return Pbkdf2Iter
+	}
+	return o.Iter
+}
+
+// SetPassphrase sets the passphrase. The string itself cannot be wiped, so it should only
+// be used for a passphrase that is already a string, e.g. from the command line.
 func (o *Opts) SetPassphrase(passphrase string) {
+	o.SetPassphraseSecret(secretString(passphrase))
+}
+
+// SetPassphraseSecret sets the passphrase to passphrase, which o then wipes in Wipe
+func (o *Opts) SetPassphraseSecret(passphrase Secret) {
+	o.passphrase.Wipe()
 	o.passphrase = passphrase
 	o.passphraseSet = true
 }
 
-// GetPassphrase prompt the user to enter a passphrase to decrypt
-func (o *Opts) GetPassphrase(passReader func() ([]byte, error)) (_ string, err error) {
+// SetPassphraseProvider sets where the passphrase is obtained from when it is first needed,
+// instead of prompting for it
+func (o *Opts) SetPassphraseProvider(provider PassphraseProvider) {
+	o.provider = provider
+}
+
+// GetPassphrase obtains the passphrase from the provider, if one was set, or else prompts
+// the user to enter it. It is only obtained once. The Secret returned is held by o and is
+// wiped by o.Wipe, so the caller must not wipe or keep it; see Secret.Copy.
+func (o *Opts) GetPassphrase(passReader func() ([]byte, error)) (_ Secret, err error) {
 	if !o.passphraseSet {
-		o.passphrase, err = GetPassSTDIN("Enter passphrase: ", passReader)
+		provider := o.provider
+		if provider == nil {
+			provider = PromptPassphrase("Enter passphrase: ", passReader)
+		}
+
+		passphrase, err := provider.Passphrase()
 		if err != nil {
-			return
+			return nil, err
 		}
+		o.passphrase = passphrase
 		o.passphraseSet = true
 	}
 	return o.passphrase, nil
 }
 
-// GetPassSTDIN prompte the user for a passphrase
-func GetPassSTDIN(prompt string, passReader func() ([]byte, error)) (_ string, err error) {
+// Wipe wipes the passphrases held by o. They are obtained again if they are needed.
+func (o *Opts) Wipe() {
+	o.passphrase.Wipe()
+	o.passphrase = nil
+	o.passphraseSet = false
+
+	for _, passphrase := range o.sharePassCache {
+		passphrase.Wipe()
+	}
+	o.sharePassCache = nil
+}
+
+// GetPassSTDIN prompte the user for a passphrase. The caller wipes the Secret returned.
+func GetPassSTDIN(prompt string, passReader func() ([]byte, error)) (_ Secret, err error) {
 	fmt.Print(prompt)
 	passphrase := []byte{}
 	for len(passphrase) == 0 {
 		passphrase, err = passReader()
 		if err != nil {
-			return "", errors.WithStack(err)
+			wipe(passphrase)
+			return nil, errors.WithStack(err)
 		}
 		fmt.Println()
 	}
-	return string(passphrase), err
+	return SecretFrom(passphrase), nil
 }
@@ -15,10 +15,16 @@
 package crypto_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/Senetas/crypto-cli/crypto"
 )
@@ -56,7 +62,7 @@ func TestPassPhrase(t *testing.T) {
 			continue
 		}
 
-		if !assert.Equal(test.passphrase, passphrase1) {
+		if !assert.Equal(test.passphrase, string(passphrase1)) {
 			continue
 		}
 
@@ -65,6 +71,85 @@ func TestPassPhrase(t *testing.T) {
 			continue
 		}
 
-		assert.Equal(test.passphrase, passphrase2)
+		assert.Equal(test.passphrase, string(passphrase2))
+	}
+}
+
+func TestPassphraseProviders(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "passphrase")
+	require.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	file := filepath.Join(dir, "pass")
+	require.NoError(ioutil.WriteFile(file, []byte("hunter2\r\nignored\n"), 0600))
+
+	empty := filepath.Join(dir, "empty")
+	require.NoError(ioutil.WriteFile(empty, []byte("\n"), 0600))
+
+	t.Setenv("CRYPTO_CLI_TEST_PASS", "hunter2")
+
+	r, w, err := os.Pipe()
+	require.NoError(err)
+	_, err = w.Write([]byte("hunter2\n"))
+	require.NoError(err)
+	require.NoError(w.Close())
+
+	// the provider closes the descriptor it is given
+	fd, err := syscall.Dup(int(r.Fd()))
+	require.NoError(err)
+	require.NoError(r.Close())
+
+	tests := []struct {
+		provider   crypto.PassphraseProvider
+		passphrase string
+		hasErr     bool
+	}{
+		{crypto.FilePassphrase(file), "hunter2", false},
+		{crypto.FilePassphrase(filepath.Join(dir, "missing")), "", true},
+		{crypto.FilePassphrase(empty), "", true},
+		{crypto.EnvPassphrase("CRYPTO_CLI_TEST_PASS"), "hunter2", false},
+		// the variable is unset after it is read
+		{crypto.EnvPassphrase("CRYPTO_CLI_TEST_PASS"), "", true},
+		{crypto.FDPassphrase(fd), "hunter2", false},
+		{crypto.ReaderPassphrase(strings.NewReader("hunter2"), "reader"), "hunter2", false},
+		{crypto.CommandPassphrase("echo hunter2"), "hunter2", false},
+		{crypto.CommandPassphrase("exit 3"), "", true},
+		{crypto.PromptPassphrase("Enter passphrase: ", constPassReader), "hunter1", false},
+	}
+
+	for _, test := range tests {
+		opts := &crypto.Opts{}
+		opts.SetPassphraseProvider(test.provider)
+
+		passphrase, err := opts.GetPassphrase(errPassReader)
+		if test.hasErr {
+			assert.Error(err)
+			continue
+		}
+
+		if assert.NoError(err) {
+			assert.Equal(test.passphrase, string(passphrase))
+		}
+	}
+}
+
+func TestGetPassSTDIN(t *testing.T) {
+	assert := assert.New(t)
+
+	// the passphrase is only held by the Secret, so that it can be wiped
+	var read []byte
+	passphrase, err := crypto.GetPassSTDIN("Enter passphrase: ", func() ([]byte, error) {
+		read = []byte("hunter1")
+		return read, nil
+	})
+	if assert.NoError(err) {
+		assert.Equal("hunter1", string(passphrase))
+		assert.Equal(make([]byte, 7), read)
+
+		passphrase.Wipe()
+		assert.Equal(make([]byte, 7), []byte(passphrase))
 	}
 }
@@ -0,0 +1,168 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// PassphraseProvider obtains a passphrase, e.g. from a file or an external command,
+// so that it need not be given on the command line or typed at a terminal. Each call
+// returns a new Secret, which the caller wipes once it is no longer needed.
+type PassphraseProvider interface {
+	Passphrase() (Secret, error)
+}
+
+// PassphraseFunc adapts a function to a PassphraseProvider
+type PassphraseFunc func() (Secret, error)
+
+// Passphrase calls f
+func (f PassphraseFunc) Passphrase() (Secret, error) {
+	return f()
+}
+
+// PromptPassphrase prompts for the passphrase on the terminal
+func PromptPassphrase(prompt string, passReader func() ([]byte, error)) PassphraseProvider {
+	return PassphraseFunc(func() (Secret, error) {
+		return GetPassSTDIN(prompt, passReader)
+	})
+}
+
+// FilePassphrase reads the passphrase from the first line of a file
+func FilePassphrase(filename string) PassphraseProvider {
+	return PassphraseFunc(func() (_ Secret, err error) {
+		// the file is named by the user to be read
+		fh, err := os.Open(filename) // #nosec
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read passphrase file")
+		}
+		defer func() { err = utils.CheckedClose(fh, err) }()
+
+		return readPassphrase(fh, "file "+filename)
+	})
+}
+
+// EnvPassphrase reads the passphrase from an environment variable. The variable is unset
+// afterwards so that it is not inherited by other processes. The copy of it in the
+// environment of this process cannot be wiped.
+func EnvPassphrase(name string) PassphraseProvider {
+	return PassphraseFunc(func() (Secret, error) {
+		passphrase, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, errors.Errorf("environment variable %s is not set", name)
+		}
+
+		if err := os.Unsetenv(name); err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		return checkPassphrase(secretString(passphrase), "environment variable "+name)
+	})
+}
+
+// FDPassphrase reads the passphrase from an open file descriptor, e.g. one end of a pipe
+// set up by the calling process. The descriptor is closed afterwards.
+func FDPassphrase(fd int) PassphraseProvider {
+	return PassphraseFunc(func() (_ Secret, err error) {
+		name := "file descriptor " + strconv.Itoa(fd)
+
+		fh := os.NewFile(uintptr(fd), name)
+		if fh == nil {
+			return nil, errors.Errorf("invalid %s", name)
+		}
+		defer func() { err = utils.CheckedClose(fh, err) }()
+
+		return readPassphrase(fh, name)
+	})
+}
+
+// ReaderPassphrase reads the passphrase from the first line of r, e.g. stdin
+func ReaderPassphrase(r io.Reader, name string) PassphraseProvider {
+	return PassphraseFunc(func() (Secret, error) {
+		return readPassphrase(r, name)
+	})
+}
+
+// CommandPassphrase runs command with the shell and reads the passphrase from the first
+// line of its output, e.g. to obtain it from a secret store. The stderr of the command is
+// passed through.
+func CommandPassphrase(command string) PassphraseProvider {
+	return PassphraseFunc(func() (Secret, error) {
+		cmd := shellCommand(command)
+		stdout := &bytes.Buffer{}
+		cmd.Stdout = stdout
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			wipe(stdout.Bytes())
+			return nil, errors.Wrap(err, "passphrase command failed")
+		}
+
+		return linePassphrase(stdout.Bytes(), "passphrase command")
+	})
+}
+
+// shellCommand runs command with the shell of the platform
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command) // #nosec
+	}
+	return exec.Command("/bin/sh", "-c", command) // #nosec
+}
+
+// readPassphrase reads the first line of r
+func readPassphrase(r io.Reader, name string) (Secret, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		wipe(contents)
+		return nil, errors.Wrapf(err, "could not read passphrase from %s", name)
+	}
+
+	return linePassphrase(contents, name)
+}
+
+// linePassphrase copies the first line of contents to a Secret and wipes contents
+func linePassphrase(contents []byte, name string) (Secret, error) {
+	line := contents
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	line = bytes.TrimRight(line, "\r")
+
+	passphrase := NewSecret(len(line))
+	copy(passphrase, line)
+	wipe(contents)
+
+	return checkPassphrase(passphrase, name)
+}
+
+// checkPassphrase rejects an empty passphrase
+func checkPassphrase(passphrase Secret, name string) (Secret, error) {
+	if len(passphrase) == 0 {
+		passphrase.Wipe()
+		return nil, utils.NewKindError(utils.KindUsage, "the passphrase from "+name+" is empty")
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,165 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"strconv"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+const (
+	// MinKDFCost is the least number of iterations of PBKDF2 that images may be encrypted
+	// with, and that the default policy decrypts
+	MinKDFCost = 1e4
+
+	// MaxKDFCost is the most iterations of PBKDF2 that images may be encrypted with, and that
+	// the default policy decrypts. Deriving a key with more takes longer than a few seconds.
+	MaxKDFCost = 1e7
+
+	// DefaultMaxPassphraseShares is the most shares encrypted with passphrases that the
+	// default policy tries to decrypt. Each passphrase is tried against each of them.
+	DefaultMaxPassphraseShares = 16
+)
+
+// Policy restricts the encrypted blobs that are decrypted. As the metadata of a blob is
+// not authenticated until its key is decrypted, it is checked before any key is derived,
+// so that an image cannot make the client derive keys with an unbounded cost.
+type Policy struct {
+	// MinKDFCost and MaxKDFCost bound the iterations of PBKDF2 of the passphrases of the
+	// keys of blobs. Zero is no bound.
+	MinKDFCost int
+	MaxKDFCost int
+	// MaxPassphraseShares bounds the shares of a key that are encrypted with passphrases,
+	// as each costs a key derivation per passphrase. Zero is no bound.
+	MaxPassphraseShares int
+	// Algos are the algorithms that blobs may be encrypted with. If empty, any may be.
+	Algos []Algos
+	// MinVersion is the oldest format version of blobs that are decrypted. Keys and configs
+	// of version 0 do not commit to their keys, so an image that downgrades to it could
+	// use a partitioning oracle to test many passphrases per pull.
+	MinVersion int
+}
+
+// DefaultPolicy allows any algorithms of the latest format version with the bounds on the
+// cost of PBKDF2 of MinKDFCost and MaxKDFCost, and at most DefaultMaxPassphraseShares shares
+// encrypted with passphrases
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MinKDFCost:          MinKDFCost,
+		MaxKDFCost:          MaxKDFCost,
+		MaxPassphraseShares: DefaultMaxPassphraseShares,
+		MinVersion:          LatestVersion,
+	}
+}
+
+// ValidateKDFCost checks that images may be encrypted with the given number of iterations
+// of PBKDF2
+func ValidateKDFCost(iters int) error {
+	if iters < MinKDFCost || iters > MaxKDFCost {
+		return utils.NewKindError(
+			utils.KindUsage,
+			"the KDF cost must be between "+strconv.Itoa(MinKDFCost)+" and "+strconv.Itoa(MaxKDFCost),
+		)
+	}
+	return nil
+}
+
+// Check returns an error of KindPolicy if c is outside the policy, or of KindCrypto if its
+// shares are malformed. A nil policy allows anything.
+func (p *Policy) Check(c Crypto) error {
+	if p == nil {
+		return nil
+	}
+
+	if c.Version < p.MinVersion {
+		return utils.NewKindError(
+			utils.KindPolicy,
+			"the format version "+strconv.Itoa(c.Version)+" is below the minimum "+strconv.Itoa(p.MinVersion)+
+				" of the policy; decrypt images pushed by older versions with --allow-legacy-format",
+		)
+	}
+
+	if len(p.Algos) > 0 && !p.allows(c.Algos) {
+		return utils.NewKindError(utils.KindPolicy, "the encryption type "+string(c.Algos)+" is not allowed by the policy")
+	}
+
+	if c.Algos.KeySource() == PassphraseSource {
+		if err := p.checkKDFCost(c.Iters); err != nil {
+			return err
+		}
+	}
+
+	if c.Algos.KeySource() == SharesSource {
+		if err := p.checkShares(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkShares bounds the number of key derivations that the shares of c can cause
+func (p *Policy) checkShares(c Crypto) error {
+	if err := checkShares(c); err != nil {
+		return err
+	}
+
+	n := 0
+	for _, s := range c.Shares {
+		if s.KeyID != "" {
+			continue
+		}
+		if err := p.checkKDFCost(s.Iters); err != nil {
+			return err
+		}
+		n++
+	}
+
+	if p.MaxPassphraseShares > 0 && n > p.MaxPassphraseShares {
+		return utils.NewKindError(
+			utils.KindPolicy,
+			"the key has "+strconv.Itoa(n)+" shares encrypted with passphrases, more than the maximum "+
+				strconv.Itoa(p.MaxPassphraseShares)+" of the policy",
+		)
+	}
+
+	return nil
+}
+
+func (p *Policy) allows(a Algos) bool {
+	for _, allowed := range p.Algos {
+		if a == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) checkKDFCost(iters int) error {
+	switch {
+	case p.MinKDFCost > 0 && iters < p.MinKDFCost:
+		return utils.NewKindError(
+			utils.KindPolicy,
+			"the KDF cost "+strconv.Itoa(iters)+" is below the minimum "+strconv.Itoa(p.MinKDFCost)+" of the policy",
+		)
+	case p.MaxKDFCost > 0 && iters > p.MaxKDFCost:
+		return utils.NewKindError(
+			utils.KindPolicy,
+			"the KDF cost "+strconv.Itoa(iters)+" is above the maximum "+strconv.Itoa(p.MaxKDFCost)+" of the policy",
+		)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestValidateKDFCost(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		iters int
+		ok    bool
+	}{
+		{crypto.Pbkdf2Iter, true},
+		{crypto.MinKDFCost, true},
+		{crypto.MaxKDFCost, true},
+		{crypto.MinKDFCost - 1, false},
+		{crypto.MaxKDFCost + 1, false},
+		{0, false},
+	}
+
+	for _, test := range tests {
+		err := crypto.ValidateKDFCost(test.iters)
+		if test.ok {
+			assert.NoError(err)
+		} else if assert.Error(err) {
+			assert.Equal(utils.KindUsage, utils.KindOf(err))
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	encOpts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm, Version: crypto.LatestVersion, Iter: 20000}
+	encOpts.SetPassphrase(passphrase)
+
+	c, err := crypto.NewDecrypto(encOpts)
+	require.NoError(err)
+	require.Equal(20000, c.Iters)
+
+	e, err := crypto.EncryptKey(*c, encOpts)
+	require.NoError(err)
+	require.Equal(20000, e.Iters)
+
+	tampered := func(iters int) crypto.EnCrypto {
+		tampered := e
+		tampered.Iters = iters
+		return tampered
+	}
+
+	tests := []struct {
+		policy *crypto.Policy
+		e      crypto.EnCrypto
+		errMsg string
+	}{
+		{nil, e, ""},
+		{crypto.DefaultPolicy(), e, ""},
+		{&crypto.Policy{Algos: []crypto.Algos{crypto.Pbkdf2Aes256Gcm}}, e, ""},
+		{
+			&crypto.Policy{Algos: []crypto.Algos{crypto.KeyAes256Gcm}},
+			e,
+			"the encryption type PBKDF2-AES256-GCM is not allowed by the policy",
+		},
+		{crypto.DefaultPolicy(), tampered(1), "the KDF cost 1 is below the minimum 10000 of the policy"},
+		{crypto.DefaultPolicy(), tampered(1000000000), "the KDF cost 1000000000 is above the maximum 10000000 of the policy"},
+		{&crypto.Policy{MinKDFCost: 30000}, e, "the KDF cost 20000 is below the minimum 30000 of the policy"},
+	}
+
+	for _, test := range tests {
+		decOpts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm, Policy: test.policy}
+		decOpts.SetPassphrase(passphrase)
+
+		d, err := crypto.DecryptKey(test.e, decOpts)
+		if test.errMsg == "" {
+			if assert.NoError(err) {
+				assert.Equal(*c, d)
+			}
+			continue
+		}
+		if assert.EqualError(err, test.errMsg) {
+			assert.Equal(utils.KindPolicy, utils.KindOf(err))
+		}
+	}
+}
+
+func TestPolicyVersion(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	encOpts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm, Version: 0}
+	encOpts.SetPassphrase(passphrase)
+
+	c, err := crypto.NewDecrypto(encOpts)
+	require.NoError(err)
+
+	e, err := crypto.EncryptKey(*c, encOpts)
+	require.NoError(err)
+	require.Equal(0, e.Version)
+
+	legacy := crypto.DefaultPolicy()
+	legacy.MinVersion = 0
+
+	tests := []struct {
+		policy *crypto.Policy
+		errMsg string
+	}{
+		{
+			crypto.DefaultPolicy(),
+			"the format version 0 is below the minimum 1 of the policy; decrypt images pushed by older versions with --allow-legacy-format",
+		},
+		{legacy, ""},
+	}
+
+	for _, test := range tests {
+		decOpts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm, Policy: test.policy}
+		decOpts.SetPassphrase(passphrase)
+
+		d, err := crypto.DecryptKey(e, decOpts)
+		if test.errMsg == "" {
+			if assert.NoError(err) {
+				assert.Equal(*c, d)
+			}
+			continue
+		}
+		if assert.EqualError(err, test.errMsg) {
+			assert.Equal(utils.KindPolicy, utils.KindOf(err))
+		}
+	}
+}
+
+func TestPolicyShares(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	encOpts := &crypto.Opts{
+		Algos:            crypto.ShamirAes256Gcm,
+		Version:          crypto.LatestVersion,
+		Threshold:        1,
+		SharePassphrases: []crypto.PassphraseProvider{staticPassphrase("alice"), staticPassphrase("bob")},
+	}
+
+	c, err := crypto.NewDecrypto(encOpts)
+	require.NoError(err)
+	e, err := crypto.EncryptKey(*c, encOpts)
+	require.NoError(err)
+	require.Len(e.Shares, 2)
+
+	tampered := func(f func(e *crypto.EnCrypto)) crypto.EnCrypto {
+		tampered := e
+		tampered.Shares = append([]crypto.Share(nil), e.Shares...)
+		f(&tampered)
+		return tampered
+	}
+
+	tests := []struct {
+		policy *crypto.Policy
+		e      crypto.EnCrypto
+		errMsg string
+		kind   utils.Kind
+	}{
+		{crypto.DefaultPolicy(), e, "", utils.KindUnknown},
+		{
+			crypto.DefaultPolicy(),
+			tampered(func(e *crypto.EnCrypto) {
+				for len(e.Shares) <= crypto.MaxShares {
+					e.Shares = append(e.Shares, e.Shares[0])
+				}
+			}),
+			"the key has 256 shares, more than the maximum 255",
+			utils.KindCrypto,
+		},
+		{
+			crypto.DefaultPolicy(),
+			tampered(func(e *crypto.EnCrypto) { e.Shares[1].Index = e.Shares[0].Index }),
+			"share 1 is malformed",
+			utils.KindCrypto,
+		},
+		{
+			crypto.DefaultPolicy(),
+			tampered(func(e *crypto.EnCrypto) { e.Shares[0].Index = 0 }),
+			"share 0 is malformed",
+			utils.KindCrypto,
+		},
+		{
+			crypto.DefaultPolicy(),
+			tampered(func(e *crypto.EnCrypto) { e.Threshold = 3 }),
+			"invalid threshold 3 of 2 shares",
+			utils.KindCrypto,
+		},
+		{
+			&crypto.Policy{MaxPassphraseShares: 1},
+			e,
+			"the key has 2 shares encrypted with passphrases, more than the maximum 1 of the policy",
+			utils.KindPolicy,
+		},
+	}
+
+	for _, test := range tests {
+		// no key is derived from a passphrase unless the shares are within the policy
+		calls := 0
+		decOpts := &crypto.Opts{Algos: crypto.ShamirAes256Gcm, Policy: test.policy}
+		decOpts.SharePassphrases = []crypto.PassphraseProvider{
+			crypto.PassphraseFunc(func() (crypto.Secret, error) {
+				calls++
+				return crypto.SecretFrom([]byte("bob")), nil
+			}),
+		}
+
+		d, err := crypto.DecryptKey(test.e, decOpts)
+		if test.errMsg == "" {
+			if assert.NoError(err) {
+				assert.Equal(c.DecKey, d.DecKey)
+			}
+			continue
+		}
+		if assert.EqualError(err, test.errMsg) {
+			assert.Equal(test.kind, utils.KindOf(err))
+		}
+		assert.Zero(calls)
+	}
+}
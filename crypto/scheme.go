@@ -0,0 +1,278 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"crypto/rand"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// KeySource is what the key that encrypts the data keys of a scheme is obtained from
+type KeySource int
+
+const (
+	// NoKey is the source of schemes that do not encrypt
+	NoKey KeySource = iota
+	// PassphraseSource derives the key from a passphrase
+	PassphraseSource
+	// KeystoreSource uses a key or identity from the keystore
+	KeystoreSource
+	// WrapperSource has a key wrapping provider wrap the data keys
+	WrapperSource
+	// SharesSource splits the key into shares, a threshold of which are needed to decrypt
+	SharesSource
+)
+
+// Scheme is an encryption scheme: how the data keys of the config and layers of an image
+// are generated and encrypted, how the blobs are encrypted with them, and how the metadata
+// of the scheme is encoded. Schemes are registered by their Algos and the versions of the
+// format that they support, and are looked up by those recorded in the metadata of a blob.
+type Scheme interface {
+	// Algos is the name of the scheme in the metadata and the --type option
+	Algos() Algos
+	// Description is a one line description of the scheme
+	Description() string
+	// KeySource is what the key that encrypts the data keys is obtained from
+	KeySource() KeySource
+	// NewKey generates a data key for a blob
+	NewKey(opts *Opts) (*DeCrypto, error)
+	// Wrap encrypts the data key of d
+	Wrap(d DeCrypto, opts *Opts) (EnCrypto, error)
+	// Unwrap is the inverse of Wrap
+	Unwrap(e EnCrypto, opts *Opts) (DeCrypto, error)
+	// EncryptWriter returns a writer that encrypts a blob with the data key of d to out
+	EncryptWriter(out io.Writer, d *DeCrypto) (io.WriteCloser, error)
+	// DecryptReader returns a reader that decrypts a blob read from in with the data key
+	// of d
+	DecryptReader(in io.Reader, d *DeCrypto) (io.Reader, error)
+	// EncodeCompat adds the fields of e that are particular to the scheme to the query of
+	// its url encoding
+	EncodeCompat(e *EnCrypto, v url.Values) error
+	// DecodeCompat is the inverse of EncodeCompat
+	DecodeCompat(v url.Values, e *EnCrypto) error
+}
+
+// schemes holds the registered schemes by their algos and version
+var schemes = map[Algos]map[int]Scheme{}
+
+// RegisterScheme registers s for the given versions of the format, which must be known.
+// It panics if a scheme is already registered for the algos and one of the versions.
+func RegisterScheme(s Scheme, versions ...int) {
+	if schemes[s.Algos()] == nil {
+		schemes[s.Algos()] = map[int]Scheme{}
+	}
+
+	for _, v := range versions {
+		if _, ok := versionDataStore[v]; !ok {
+			panic("crypto: unknown version " + strconv.Itoa(v) + " for scheme " + string(s.Algos()))
+		}
+		if _, ok := schemes[s.Algos()][v]; ok {
+			panic("crypto: scheme " + string(s.Algos()) + " is already registered for version " + strconv.Itoa(v))
+		}
+		schemes[s.Algos()][v] = s
+	}
+}
+
+// LookupScheme returns the scheme registered for the algos and version
+func LookupScheme(a Algos, version int) (Scheme, error) {
+	byVersion, ok := schemes[a]
+	if !ok {
+		return nil, errors.New("invalid encryption type")
+	}
+
+	s, ok := byVersion[version]
+	if !ok {
+		return nil, errors.New("unknown version")
+	}
+
+	return s, nil
+}
+
+// Schemes returns the registered schemes that support the latest version, sorted by their
+// algos
+func Schemes() []Scheme {
+	var ss []Scheme
+	for _, byVersion := range schemes {
+		if s, ok := byVersion[LatestVersion]; ok {
+			ss = append(ss, s)
+		}
+	}
+
+	sort.Slice(ss, func(i, j int) bool { return ss[i].Algos() < ss[j].Algos() })
+
+	return ss
+}
+
+// EncryptWriter returns a writer that encrypts a blob to out with the scheme and data key
+// of d
+func EncryptWriter(out io.Writer, d *DeCrypto) (io.WriteCloser, error) {
+	s, err := LookupScheme(d.Algos, d.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.EncryptWriter(out, d)
+}
+
+// DecryptReader returns a reader that decrypts a blob read from in with the scheme and
+// data key of d
+func DecryptReader(in io.Reader, d *DeCrypto) (io.Reader, error) {
+	s, err := LookupScheme(d.Algos, d.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.DecryptReader(in, d)
+}
+
+// baseScheme implements the parts of a Scheme that are common to the built in schemes.
+// They differ only in how the data keys are encrypted.
+type baseScheme struct {
+	algos       Algos
+	description string
+	source      KeySource
+}
+
+func (s baseScheme) Algos() Algos {
+	return s.algos
+}
+
+func (s baseScheme) Description() string {
+	return s.description
+}
+
+func (s baseScheme) KeySource() KeySource {
+	return s.source
+}
+
+// NewKey generates a random data key, nonce and salt for the algorithms, cipher and
+// version of opts
+func (s baseScheme) NewKey(opts *Opts) (d *DeCrypto, err error) {
+	d = &DeCrypto{
+		Crypto: Crypto{
+			Algos:   opts.Algos,
+			Version: opts.Version,
+			Nonce:   make([]byte, opts.Cipher.nonceSize()),
+			Salt:    make([]byte, 16),
+			Iters:   opts.kdfCost(),
+		},
+		DecKey: NewSecret(32),
+	}
+
+	// AES256-GCM is left implicit, so that the crypto object is unchanged for clients that
+	// predate the choice of cipher
+	if opts.Cipher == ChaCha20Poly1305 {
+		d.Cipher = opts.Cipher
+	}
+
+	if _, err = rand.Read(d.DecKey); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	if _, err = rand.Read(d.Nonce); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	if _, err = rand.Read(d.Salt); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	return
+}
+
+func (s baseScheme) EncryptWriter(out io.Writer, d *DeCrypto) (io.WriteCloser, error) {
+	return EncBlobWriter(out, d.Cipher, d.DecKey)
+}
+
+func (s baseScheme) DecryptReader(in io.Reader, d *DeCrypto) (io.Reader, error) {
+	return DecBlobReader(in, d.Cipher, d.DecKey)
+}
+
+func (s baseScheme) EncodeCompat(e *EnCrypto, v url.Values) error {
+	return nil
+}
+
+func (s baseScheme) DecodeCompat(v url.Values, e *EnCrypto) error {
+	return nil
+}
+
+// passphraseScheme encrypts the data keys with a key derived from a passphrase
+type passphraseScheme struct {
+	baseScheme
+}
+
+func (s passphraseScheme) Wrap(d DeCrypto, opts *Opts) (e EnCrypto, err error) {
+	e.Crypto = d.Crypto
+
+	passphrase, err := opts.GetPassphrase(StdinPassReader)
+	if err != nil {
+		return
+	}
+
+	e.EncKey, err = enckey(d.format(), d.DecKey, e.Nonce, e.Salt, e.Iters, passphrase)
+	err = errors.WithStack(err)
+
+	return
+}
+
+// Unwrap requires that the data key was encrypted with the algorithms of opts, as the
+// passphrase of opts is only for those
+func (s passphraseScheme) Unwrap(e EnCrypto, opts *Opts) (d DeCrypto, err error) {
+	if e.Algos != opts.Algos {
+		err = utils.NewError("encryption type does not match decryption type", false)
+		return
+	}
+
+	d.Crypto = e.Crypto
+
+	passphrase, err := opts.GetPassphrase(StdinPassReader)
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	if err = checkLengths(d.Crypto); err != nil {
+		return
+	}
+
+	d.DecKey, err = deckey(e.format(), e.EncKey, e.Nonce, e.Salt, e.Iters, passphrase)
+	err = errors.WithStack(err)
+
+	return
+}
+
+func init() {
+	// the blobs of NONE are not encrypted, but its keys are still those of a passphrase
+	RegisterScheme(passphraseScheme{baseScheme{
+		algos:       None,
+		description: "no encryption",
+		source:      NoKey,
+	}}, 0, 1)
+	RegisterScheme(passphraseScheme{baseScheme{
+		algos:       Pbkdf2Aes256Gcm,
+		description: "a key derived from a passphrase with PBKDF2",
+		source:      PassphraseSource,
+	}}, 0, 1)
+}
@@ -0,0 +1,144 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+)
+
+const testAlgos = crypto.Algos("TEST-AES256-GCM")
+
+// testScheme is a scheme plugged in from outside the package. It encrypts like
+// PBKDF2-AES256-GCM, but records its own field in the url encoding.
+type testScheme struct {
+	crypto.Scheme
+}
+
+func (s testScheme) Algos() crypto.Algos {
+	return testAlgos
+}
+
+func (s testScheme) EncodeCompat(e *crypto.EnCrypto, v url.Values) error {
+	v.Set("test", "1")
+	return nil
+}
+
+func (s testScheme) DecodeCompat(v url.Values, e *crypto.EnCrypto) error {
+	if v.Get("test") != "1" {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func TestLookupScheme(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		algos   crypto.Algos
+		version int
+		source  crypto.KeySource
+		errMsg  string
+	}{
+		{crypto.None, crypto.LatestVersion, crypto.NoKey, ""},
+		{crypto.Pbkdf2Aes256Gcm, 0, crypto.PassphraseSource, ""},
+		{crypto.Pbkdf2Aes256Gcm, crypto.LatestVersion, crypto.PassphraseSource, ""},
+		{crypto.X25519MlKem768Aes256Gcm, crypto.LatestVersion, crypto.KeystoreSource, ""},
+		{crypto.WrapAes256Gcm, crypto.LatestVersion, crypto.WrapperSource, ""},
+		{crypto.ShamirAes256Gcm, crypto.LatestVersion, crypto.SharesSource, ""},
+		{crypto.Pbkdf2Aes256Gcm, -1, crypto.NoKey, "unknown version"},
+		{crypto.Algos("ROT13"), 0, crypto.NoKey, "invalid encryption type"},
+	}
+
+	for _, test := range tests {
+		s, err := crypto.LookupScheme(test.algos, test.version)
+		if test.errMsg != "" {
+			assert.EqualError(err, test.errMsg)
+			continue
+		}
+		if assert.NoError(err) {
+			assert.Equal(test.algos, s.Algos())
+			assert.Equal(test.source, s.KeySource())
+			assert.Equal(test.source, test.algos.KeySource())
+		}
+	}
+}
+
+func TestRegisterScheme(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	base, err := crypto.LookupScheme(crypto.Pbkdf2Aes256Gcm, crypto.LatestVersion)
+	require.NoError(err)
+
+	crypto.RegisterScheme(testScheme{base}, crypto.LatestVersion)
+
+	assert.Panics(func() { crypto.RegisterScheme(testScheme{base}, crypto.LatestVersion) })
+	assert.Panics(func() { crypto.RegisterScheme(testScheme{base}, -1) })
+
+	algos, err := crypto.ValidateAlgos(string(testAlgos))
+	require.NoError(err)
+	assert.Equal(testAlgos, algos)
+
+	var listed bool
+	for _, s := range crypto.Schemes() {
+		listed = listed || s.Algos() == testAlgos
+	}
+	assert.True(listed)
+
+	opts := &crypto.Opts{Algos: testAlgos, Version: crypto.LatestVersion}
+	opts.SetPassphrase(passphrase)
+
+	d, err := crypto.NewDecrypto(opts)
+	require.NoError(err)
+
+	e, err := crypto.EncryptKey(*d, opts)
+	require.NoError(err)
+
+	u, err := crypto.NewURLCompat(&e, opts)
+	require.NoError(err)
+	assert.Equal("1", u.Query().Get("test"))
+
+	e1, err := crypto.NewEncryptoCompat([]string{u.String()}, opts)
+	require.NoError(err)
+	assert.Equal(e, e1)
+
+	d1, err := crypto.DecryptKey(e1, opts)
+	require.NoError(err)
+	assert.Equal(*d, d1)
+
+	plaintext := []byte("the quick brown fox")
+
+	ct := &bytes.Buffer{}
+	w, err := crypto.EncryptWriter(ct, d)
+	require.NoError(err)
+	_, err = w.Write(plaintext)
+	require.NoError(err)
+	require.NoError(w.Close())
+
+	r, err := crypto.DecryptReader(ct, &d1)
+	require.NoError(err)
+	pt, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(plaintext, pt)
+}
@@ -0,0 +1,82 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"os"
+	"unsafe"
+)
+
+// Secret is a buffer of key material or a passphrase. Its memory is locked, where the
+// platform allows, so that it is not swapped to disk, and it is wiped explicitly once it is
+// no longer needed, rather than left on the heap until it is collected.
+type Secret []byte
+
+// NewSecret allocates a zeroed Secret of n bytes. Locking it is only attempted, as it fails
+// e.g. beyond the limit of locked memory of the process, in which case it is still wiped.
+func NewSecret(n int) Secret {
+	if n == 0 {
+		return Secret{}
+	}
+
+	// the secret is given pages of its own, so that unlocking them when it is wiped does
+	// not unlock another secret
+	pageSize := os.Getpagesize()
+	size := (n + pageSize - 1) / pageSize * pageSize
+	buf := make([]byte, size+pageSize)
+	off := (pageSize - int(uintptr(unsafe.Pointer(&buf[0]))%uintptr(pageSize))) % pageSize
+
+	lock(buf[off : off+size])
+
+	return Secret(buf[off : off+n : off+size])
+}
+
+// SecretFrom copies b to a new Secret and wipes b
+func SecretFrom(b []byte) Secret {
+	s := NewSecret(len(b))
+	copy(s, b)
+	wipe(b)
+	return s
+}
+
+// Copy copies s to a new Secret, e.g. to give to an owner that wipes it
+func (s Secret) Copy() Secret {
+	c := NewSecret(len(s))
+	copy(c, s)
+	return c
+}
+
+// secretString copies the string p to a new Secret. The string itself cannot be wiped.
+func secretString(p string) Secret {
+	s := NewSecret(len(p))
+	copy(s, p)
+	return s
+}
+
+// Wipe zeroes the secret and unlocks its memory
+func (s Secret) Wipe() {
+	if cap(s) == 0 {
+		return
+	}
+	wipe(s[:cap(s)])
+	unlock(s[:cap(s)])
+}
+
+// wipe zeroes b, e.g. a key encryption key that is only needed briefly
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+)
+
+func TestSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, n := range []int{0, 1, 32, 4096, 5000} {
+		s := crypto.NewSecret(n)
+		assert.Len(s, n)
+		assert.Equal(make([]byte, n), []byte(s))
+
+		for i := range s {
+			s[i] = 0xff
+		}
+		s.Wipe()
+		assert.Equal(make([]byte, n), []byte(s))
+	}
+
+	b := []byte("hunter2")
+	s := crypto.SecretFrom(b)
+	assert.Equal("hunter2", string(s))
+	assert.Equal(make([]byte, 7), b)
+}
+
+func TestWipeKeys(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	calls := 0
+	opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm, Version: crypto.LatestVersion}
+	opts.SetPassphraseProvider(crypto.PassphraseFunc(func() (crypto.Secret, error) {
+		calls++
+		return crypto.SecretFrom([]byte(passphrase)), nil
+	}))
+
+	d, err := crypto.NewDecrypto(opts)
+	require.NoError(err)
+
+	e, err := crypto.EncryptKey(*d, opts)
+	require.NoError(err)
+
+	key := d.DecKey
+	d.Wipe()
+	assert.Nil(d.DecKey)
+	assert.Equal(make([]byte, 32), []byte(key))
+
+	// the passphrase is obtained again once it is wiped
+	opts.Wipe()
+	d1, err := crypto.DecryptKey(e, opts)
+	require.NoError(err)
+	assert.Len(d1.DecKey, 32)
+	assert.NotEqual(make([]byte, 32), []byte(d1.DecKey))
+	assert.Equal(2, calls)
+}
@@ -0,0 +1,30 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package crypto
+
+import "syscall"
+
+// lock locks the pages of b in memory, so that they are not swapped to disk
+func lock(b []byte) {
+	_ = syscall.Mlock(b)
+}
+
+// unlock is the inverse of lock
+func unlock(b []byte) {
+	_ = syscall.Munlock(b)
+}
@@ -0,0 +1,121 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"crypto/rand"
+
+	"github.com/pkg/errors"
+)
+
+// The secret is split byte by byte with Shamir's scheme over GF(2^8), with the reducing
+// polynomial of AES. Each share is the value at its (non-zero) index of a random polynomial
+// of degree threshold-1 whose constant term is the secret.
+
+// gfExp and gfLog are the tables of powers of the generator 3 and their logarithms
+var gfExp, gfLog = gfTables()
+
+func gfTables() (exp [510]byte, log [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = x, x
+		log[x] = byte(i)
+		// multiply by 3 = x + 1
+		x ^= x<<1 ^ byte(int8(x)>>7)&0x1b
+	}
+	return
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// splitSecret splits secret into n shares, any threshold of which recover it. The index of
+// share i is i+1.
+func splitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	if threshold < 1 || threshold > n || n > 255 {
+		return nil, errors.Errorf("invalid threshold %d of %d shares", threshold, n)
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+
+	coeffs := make([]byte, threshold)
+	for j, b := range secret {
+		coeffs[0] = b
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		for i := range shares {
+			// evaluate the polynomial at i+1 by Horner's method
+			x, y := byte(i+1), byte(0)
+			for c := threshold - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coeffs[c]
+			}
+			shares[i][j] = y
+		}
+	}
+
+	return shares, nil
+}
+
+// combineShares recovers the secret from shares by Lagrange interpolation at 0. The
+// indices must be distinct and non-zero, and the shares of the same length.
+func combineShares(indices []byte, shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 || len(indices) != len(shares) {
+		return nil, errors.New("no shares to combine")
+	}
+
+	for i, x := range indices {
+		if x == 0 || len(shares[i]) != len(shares[0]) {
+			return nil, errors.New("invalid share")
+		}
+		for _, y := range indices[:i] {
+			if x == y {
+				return nil, errors.New("duplicate share")
+			}
+		}
+	}
+
+	secret := make([]byte, len(shares[0]))
+	for i, xi := range indices {
+		// the Lagrange basis polynomial of xi at 0; subtraction is addition in GF(2^8)
+		basis := byte(1)
+		for j, xj := range indices {
+			if i != j {
+				basis = gfMul(basis, gfDiv(xj, xj^xi))
+			}
+		}
+
+		for k, y := range shares[i] {
+			secret[k] ^= gfMul(basis, y)
+		}
+	}
+
+	return secret, nil
+}
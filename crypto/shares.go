@@ -0,0 +1,360 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// MaxShares is the most shares that a key may be split into, as shares are indexed by a byte
+const MaxShares = 255
+
+// Share is a share of the key encryption key of SHAMIR-AES256-GCM, encrypted with a
+// passphrase or, if KeyID is set, to a key from the keystore
+type Share struct {
+	Index        byte   `json:"index"`
+	KeyID        string `json:"keyId,omitempty"`
+	Nonce        []byte `json:"nonce"`
+	Salt         []byte `json:"salt"`
+	Iters        int    `json:"iters,omitempty"`
+	EphemeralKey []byte `json:"epk,omitempty"`
+	EncShare     []byte `json:"share"`
+}
+
+// sharesScheme encrypts the data keys with a key that is split into shares
+type sharesScheme struct {
+	baseScheme
+}
+
+func (s sharesScheme) NewKey(opts *Opts) (*DeCrypto, error) {
+	d, err := s.baseScheme.NewKey(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	d.Iters = 0
+	d.Threshold = opts.Threshold
+
+	return d, nil
+}
+
+func (s sharesScheme) Wrap(d DeCrypto, opts *Opts) (e EnCrypto, err error) {
+	e.Crypto = d.Crypto
+	if e.EncKey, e.Shares, err = wrapShares(d, opts); err == nil {
+		e.Threshold = opts.Threshold
+	}
+	return
+}
+
+func (s sharesScheme) Unwrap(e EnCrypto, opts *Opts) (d DeCrypto, err error) {
+	d.Crypto = e.Crypto
+	if err = checkLengths(d.Crypto); err != nil {
+		return
+	}
+	d.DecKey, err = unwrapShares(e, opts)
+	return
+}
+
+func (s sharesScheme) EncodeCompat(e *EnCrypto, v url.Values) error {
+	data, err := json.Marshal(e.Shares)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	v.Set(ThresholdKey, strconv.Itoa(e.Threshold))
+	v.Set(SharesKey, base64.URLEncoding.EncodeToString(data))
+
+	return nil
+}
+
+func (s sharesScheme) DecodeCompat(v url.Values, e *EnCrypto) (err error) {
+	if e.Threshold, err = strconv.Atoi(v.Get(ThresholdKey)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	data, err := base64.URLEncoding.DecodeString(v.Get(SharesKey))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(json.Unmarshal(data, &e.Shares))
+}
+
+func init() {
+	RegisterScheme(sharesScheme{baseScheme{
+		algos:       ShamirAes256Gcm,
+		description: "a key split into shares, a threshold of which decrypt, see --threshold",
+		source:      SharesSource,
+	}}, 0, 1)
+}
+
+// wrapShares encrypts the data key of d with a random key encryption key, which is split
+// into shares that are each encrypted to a key or with a passphrase of opts
+func wrapShares(d DeCrypto, opts *Opts) (enc []byte, shares []Share, err error) {
+	n := len(opts.ShareKeys) + len(opts.SharePassphrases)
+	if n > MaxShares {
+		return nil, nil, utils.NewKindError(
+			utils.KindUsage,
+			fmt.Sprintf("a key cannot be split into more than %d shares", MaxShares),
+		)
+	}
+	if opts.Threshold < 1 || opts.Threshold > n {
+		return nil, nil, utils.NewKindError(
+			utils.KindUsage,
+			fmt.Sprintf("the threshold must be between 1 and the number of shares, %d", n),
+		)
+	}
+
+	kek := NewSecret(32)
+	defer kek.Wipe()
+	if _, err = rand.Read(kek); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	if enc, err = sealKey(d.format(), kek, d.Nonce, d.DecKey, d.Salt); err != nil {
+		return
+	}
+
+	secrets, err := splitSecret(kek, n, opts.Threshold)
+	if err != nil {
+		return
+	}
+	defer func() {
+		for _, secret := range secrets {
+			wipe(secret)
+		}
+	}()
+
+	shares = make([]Share, n)
+	for i, secret := range secrets {
+		s := &shares[i]
+		s.Index = byte(i + 1)
+		s.Nonce, s.Salt = make([]byte, d.Cipher.nonceSize()), make([]byte, 16)
+		if _, err = rand.Read(s.Nonce); err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		if _, err = rand.Read(s.Salt); err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+
+		if i < len(opts.ShareKeys) {
+			k := opts.ShareKeys[i]
+			s.KeyID = k.ID
+			s.EncShare, s.EphemeralKey, err = wrapTo(k, d.format(), s.Nonce, s.Salt, secret)
+		} else {
+			var passphrase Secret
+			if passphrase, err = opts.SharePassphrases[i-len(opts.ShareKeys)].Passphrase(); err != nil {
+				return
+			}
+			s.Iters = opts.kdfCost()
+			s.EncShare, err = enckey(d.format(), secret, s.Nonce, s.Salt, s.Iters, passphrase)
+			passphrase.Wipe()
+		}
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+	}
+
+	return enc, shares, nil
+}
+
+// checkShares checks that the shares of c could have been made by wrapShares: there are no
+// more than MaxShares, each has a distinct non-zero index and the threshold can be met.
+// It derives no keys, so it bounds the work done for a tampered image.
+func checkShares(c Crypto) error {
+	if len(c.Shares) > MaxShares {
+		return utils.NewKindError(
+			utils.KindCrypto,
+			fmt.Sprintf("the key has %d shares, more than the maximum %d", len(c.Shares), MaxShares),
+		)
+	}
+
+	if c.Threshold < 1 || c.Threshold > len(c.Shares) {
+		return utils.NewKindError(
+			utils.KindCrypto,
+			fmt.Sprintf("invalid threshold %d of %d shares", c.Threshold, len(c.Shares)),
+		)
+	}
+
+	seen := make(map[byte]bool, len(c.Shares))
+	for _, s := range c.Shares {
+		if s.Index == 0 || seen[s.Index] {
+			return utils.NewKindError(utils.KindCrypto, fmt.Sprintf("share %d is malformed", s.Index))
+		}
+		seen[s.Index] = true
+	}
+
+	return nil
+}
+
+// unwrapShares recovers the threshold of shares of e needed to decrypt its data key. The
+// shares encrypted to keys are decrypted with the keys of opts.Keys, and the rest with the
+// passphrases of opts.SharePassphrases, or else with passphrases that are prompted for.
+func unwrapShares(e EnCrypto, opts *Opts) ([]byte, error) {
+	if err := checkShares(e.Crypto); err != nil {
+		return nil, err
+	}
+
+	for _, s := range e.Shares {
+		if len(s.Nonce) != e.Cipher.nonceSize() || len(s.Salt) != 16 {
+			return nil, errors.Errorf("share %d is malformed", s.Index)
+		}
+	}
+
+	r := &shareRecovery{e: e, opts: opts, found: make(map[byte][]byte, e.Threshold)}
+	defer func() {
+		for _, secret := range r.found {
+			wipe(secret)
+		}
+	}()
+	r.unwrapKeyShares()
+	if err := r.unwrapPassphraseShares(); err != nil {
+		return nil, err
+	}
+
+	if len(r.found) < e.Threshold {
+		return nil, utils.NewKindError(
+			utils.KindCrypto,
+			fmt.Sprintf("only %d of the %d shares needed to decrypt were recovered", len(r.found), e.Threshold),
+		)
+	}
+
+	indices := make([]byte, 0, len(r.found))
+	secrets := make([][]byte, 0, len(r.found))
+	for i, secret := range r.found {
+		indices, secrets = append(indices, i), append(secrets, secret)
+	}
+
+	kek, err := combineShares(indices, secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(kek)
+
+	return openKey(e.format(), kek, e.Nonce, e.EncKey, e.Salt)
+}
+
+// shareRecovery holds the shares recovered so far
+type shareRecovery struct {
+	e     EnCrypto
+	opts  *Opts
+	found map[byte][]byte
+}
+
+// done reports whether enough shares have been recovered
+func (r *shareRecovery) done() bool {
+	return len(r.found) >= r.e.Threshold
+}
+
+// unwrapKeyShares decrypts the shares encrypted to the keys in the keystore
+func (r *shareRecovery) unwrapKeyShares() {
+	if r.opts.Keys == nil {
+		return
+	}
+
+	for _, s := range r.e.Shares {
+		if r.done() {
+			return
+		} else if s.KeyID == "" || r.found[s.Index] != nil {
+			continue
+		}
+
+		k, err := r.opts.Keys.LookupID(s.KeyID)
+		if err != nil {
+			continue
+		}
+
+		secret, err := unwrapFrom(k, r.e.format(), s.Nonce, s.Salt, s.EphemeralKey, s.EncShare)
+		if err != nil {
+			log.Debug().Err(err).Msgf("Could not decrypt share %d with key %s.", s.Index, k.Name)
+			continue
+		}
+		r.found[s.Index] = secret
+	}
+}
+
+// unwrapPassphraseShares tries each passphrase against the shares encrypted with one.
+// The passphrases that decrypt a share are remembered for the other blobs of the image.
+// Passphrases are prompted for at most once for each such share.
+func (r *shareRecovery) unwrapPassphraseShares() error {
+	remaining := 0
+	for _, s := range r.e.Shares {
+		if s.KeyID == "" && r.found[s.Index] == nil {
+			remaining++
+		}
+	}
+
+	for _, passphrase := range r.opts.sharePassCache {
+		if r.done() {
+			return nil
+		}
+		r.tryPassphrase(passphrase)
+	}
+
+	for ; r.opts.sharePassUsed < len(r.opts.SharePassphrases) && !r.done(); r.opts.sharePassUsed++ {
+		passphrase, err := r.opts.SharePassphrases[r.opts.sharePassUsed].Passphrase()
+		if err != nil {
+			return err
+		}
+		r.remember(passphrase)
+	}
+
+	for prompts := 0; prompts < remaining && !r.done(); prompts++ {
+		prompt := fmt.Sprintf("Enter the passphrase of a share (%d of %d recovered): ", len(r.found), r.e.Threshold)
+		passphrase, err := PromptPassphrase(prompt, StdinPassReader).Passphrase()
+		if err != nil {
+			return err
+		}
+		r.remember(passphrase)
+	}
+
+	return nil
+}
+
+// remember tries a new passphrase and remembers it if it decrypts a share, or else wipes it
+func (r *shareRecovery) remember(passphrase Secret) {
+	if r.tryPassphrase(passphrase) {
+		r.opts.sharePassCache = append(r.opts.sharePassCache, passphrase)
+	} else {
+		passphrase.Wipe()
+		log.Warn().Msg("The passphrase does not decrypt any share.")
+	}
+}
+
+// tryPassphrase decrypts the shares that passphrase decrypts, and reports whether there
+// were any
+func (r *shareRecovery) tryPassphrase(passphrase Secret) (ok bool) {
+	for _, s := range r.e.Shares {
+		if s.KeyID != "" || r.found[s.Index] != nil {
+			continue
+		}
+
+		if secret, err := deckey(r.e.format(), s.EncShare, s.Nonce, s.Salt, s.Iters, passphrase); err == nil {
+			r.found[s.Index] = secret
+			ok = true
+		}
+	}
+	return
+}
@@ -0,0 +1,139 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func staticPassphrase(passphrase string) crypto.PassphraseProvider {
+	return crypto.PassphraseFunc(func() (crypto.Secret, error) {
+		return crypto.SecretFrom([]byte(passphrase)), nil
+	})
+}
+
+func TestShares(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	sym, err := crypto.GenerateKey("sym", crypto.SymmetricKey)
+	require.NoError(err)
+	id, err := crypto.GenerateKey("id", crypto.X25519Identity)
+	require.NoError(err)
+	pub, err := id.PublicOnly()
+	require.NoError(err)
+
+	both := crypto.NewKeystore(filepath.Join(dir, "both.json"), nil)
+	require.NoError(both.Add(sym))
+	require.NoError(both.Add(id))
+
+	// only the public part of the identity, which cannot decrypt its share
+	one := crypto.NewKeystore(filepath.Join(dir, "one.json"), nil)
+	require.NoError(one.Add(sym))
+	require.NoError(one.Add(pub))
+
+	// 3 of 4 shares: one to each key and two with passphrases
+	encOpts := &crypto.Opts{
+		Algos:            crypto.ShamirAes256Gcm,
+		Threshold:        3,
+		ShareKeys:        []*crypto.Key{sym, pub},
+		SharePassphrases: []crypto.PassphraseProvider{staticPassphrase("alice"), staticPassphrase("bob")},
+	}
+
+	c, err := crypto.NewDecrypto(encOpts)
+	require.NoError(err)
+	e, err := crypto.EncryptKey(*c, encOpts)
+	require.NoError(err)
+	assert.Equal(3, e.Threshold)
+	require.Len(e.Shares, 4)
+	assert.Equal(sym.ID, e.Shares[0].KeyID)
+	assert.Equal(id.ID, e.Shares[1].KeyID)
+	assert.Empty(e.Shares[2].KeyID)
+
+	// the shares survive the compat encoding
+	u, err := crypto.NewURLCompat(&e, encOpts)
+	require.NoError(err)
+	parsed, err := crypto.ParseEncryptoCompat([]string{u.String()})
+	require.NoError(err)
+	assert.Equal(e, parsed)
+
+	defer func(r func() ([]byte, error)) { crypto.StdinPassReader = r }(crypto.StdinPassReader)
+
+	tests := []struct {
+		keys        crypto.KeyLookup
+		passphrases []string
+		prompted    string
+		kind        utils.Kind
+		noErr       bool
+	}{
+		{both, []string{"bob"}, "", utils.KindUnknown, true},
+		{one, []string{"carol", "alice", "bob"}, "", utils.KindUnknown, true},
+		{one, []string{"alice"}, "bob", utils.KindUnknown, true},
+		{one, nil, "alice", utils.KindCrypto, false},
+		{one, []string{"alice"}, "carol", utils.KindCrypto, false},
+		{nil, []string{"alice", "bob"}, "carol", utils.KindCrypto, false},
+	}
+
+	for _, test := range tests {
+		prompted := test.prompted
+		crypto.StdinPassReader = func() ([]byte, error) { return []byte(prompted), nil }
+
+		decOpts := &crypto.Opts{Keys: test.keys}
+		for _, p := range test.passphrases {
+			decOpts.SharePassphrases = append(decOpts.SharePassphrases, staticPassphrase(p))
+		}
+
+		d, err := crypto.DecryptKey(e, decOpts)
+		if !test.noErr {
+			if assert.Error(err) {
+				assert.Equal(test.kind, utils.KindOf(err))
+			}
+			continue
+		}
+
+		if !assert.NoError(err) {
+			continue
+		}
+		assert.Equal(c.DecKey, d.DecKey)
+
+		// the passphrases are remembered for the next blob, so nothing is prompted for
+		prompted = "carol"
+		d, err = crypto.DecryptKey(e, decOpts)
+		if assert.NoError(err) {
+			assert.Equal(c.DecKey, d.DecKey)
+		}
+	}
+
+	// the threshold may not exceed the number of shares
+	encOpts.Threshold = 5
+	c, err = crypto.NewDecrypto(encOpts)
+	require.NoError(err)
+	_, err = crypto.EncryptKey(*c, encOpts)
+	if assert.Error(err) {
+		assert.Equal(utils.KindUsage, utils.KindOf(err))
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// VaultWrapperName is the name of the Vault transit provider in crypto metadata
+const VaultWrapperName = "vault"
+
+// VaultWrapper wraps data keys with the transit secrets engine of Vault, or a KMS with the
+// same API. The data key is sent to the server to be encrypted and the ciphertext it returns
+// is stored in the manifest; the key encryption key stays on the server.
+type VaultWrapper struct {
+	// Address is the base URL of the server, e.g. https://vault.example.com:8200
+	Address string
+	// Token authenticates to the server
+	Token string
+	// Mount is the path the transit engine is mounted at
+	Mount string
+	// Client is the client that requests are made with
+	Client *http.Client
+}
+
+// NewVaultWrapper creates a wrapper for the transit engine mounted at mount on the server
+// at address
+func NewVaultWrapper(address, token, mount string, client *http.Client) *VaultWrapper {
+	return &VaultWrapper{Address: address, Token: token, Mount: mount, Client: client}
+}
+
+// Name implements KeyWrapper
+func (v *VaultWrapper) Name() string {
+	return VaultWrapperName
+}
+
+// Wrap implements KeyWrapper
+func (v *VaultWrapper) Wrap(keyID string, key []byte) (_ []byte, err error) {
+	resp := &struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}{}
+
+	if err = v.do("encrypt", keyID, map[string]interface{}{"plaintext": key}, resp); err != nil {
+		return
+	}
+
+	if resp.Data.Ciphertext == "" {
+		return nil, errors.New("vault returned no ciphertext")
+	}
+
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+// Unwrap implements KeyWrapper
+func (v *VaultWrapper) Unwrap(keyID string, wrapped []byte) (_ []byte, err error) {
+	resp := &struct {
+		Data struct {
+			Plaintext []byte `json:"plaintext"`
+		} `json:"data"`
+	}{}
+
+	if err = v.do("decrypt", keyID, map[string]interface{}{"ciphertext": string(wrapped)}, resp); err != nil {
+		return
+	}
+
+	return resp.Data.Plaintext, nil
+}
+
+// do posts body to the endpoint of the operation for keyID and decodes the response into out
+func (v *VaultWrapper) do(op, keyID string, body, out interface{}) (err error) {
+	u, err := url.Parse(v.Address)
+	if err != nil {
+		return utils.WithKind(utils.KindUsage, errors.Wrap(err, "invalid vault address"))
+	}
+	u.Path = path.Join(u.Path, "v1", v.Mount, op, url.PathEscape(keyID))
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", v.Token)
+
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return utils.WithKind(utils.KindNetwork, errors.Wrapf(err, "vault %s failed", op))
+	}
+	defer func() { err = utils.CheckedClose(resp.Body, err) }()
+
+	if resp.StatusCode != http.StatusOK {
+		return vaultError(op, keyID, resp)
+	}
+
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(out), "could not decode vault %s response", op)
+}
+
+// vaultError describes an unsuccessful response, with the messages in its body
+func vaultError(op, keyID string, resp *http.Response) error {
+	errs := &struct {
+		Errors []string `json:"errors"`
+	}{}
+	if data, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 64 << 10}); err == nil {
+		_ = json.Unmarshal(data, errs)
+	}
+
+	msg := resp.Status
+	if len(errs.Errors) > 0 {
+		msg += ": " + strings.Join(errs.Errors, "; ")
+	}
+	err := errors.Errorf("vault %s with key %s failed: %s", op, keyID, msg)
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return utils.WithKind(utils.KindAuth, err)
+	case resp.StatusCode >= 500:
+		return utils.WithKind(utils.KindNetwork, err)
+	case op == "decrypt" && resp.StatusCode == http.StatusBadRequest:
+		return utils.WithKind(utils.KindCrypto, err)
+	}
+
+	return err
+}
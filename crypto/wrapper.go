@@ -0,0 +1,121 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"net/url"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// KeyWrapper wraps and unwraps data keys with keys that it holds and that never leave it,
+// such as the keys of a KMS
+type KeyWrapper interface {
+	// Name identifies the provider in the crypto metadata of the blobs it wrapped the keys of
+	Name() string
+	// Wrap encrypts a data key with the key identified by keyID
+	Wrap(keyID string, key []byte) ([]byte, error)
+	// Unwrap decrypts a data key wrapped by Wrap with the same key ID
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// wrapperScheme has a key wrapping provider wrap the data keys
+type wrapperScheme struct {
+	baseScheme
+}
+
+func (s wrapperScheme) NewKey(opts *Opts) (*DeCrypto, error) {
+	if opts.Wrapper == nil || opts.WrapKeyID == "" {
+		return nil, utils.NewKindError(utils.KindUsage, "no key wrapping provider and key ID were given to encrypt with")
+	}
+
+	d, err := s.baseScheme.NewKey(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	d.Iters = 0
+	d.KeyID = opts.WrapKeyID
+	d.Provider = opts.Wrapper.Name()
+
+	return d, nil
+}
+
+func (s wrapperScheme) Wrap(d DeCrypto, opts *Opts) (e EnCrypto, err error) {
+	e.Crypto = d.Crypto
+	if e.EncKey, err = wrapWithWrapper(d, opts); err == nil {
+		e.KeyID, e.Provider = opts.WrapKeyID, opts.Wrapper.Name()
+	}
+	return
+}
+
+func (s wrapperScheme) Unwrap(e EnCrypto, opts *Opts) (d DeCrypto, err error) {
+	d.Crypto = e.Crypto
+	if err = checkLengths(d.Crypto); err != nil {
+		return
+	}
+	d.DecKey, err = unwrapWithWrapper(e, opts)
+	return
+}
+
+func (s wrapperScheme) EncodeCompat(e *EnCrypto, v url.Values) error {
+	v.Set(KeyIDKey, e.KeyID)
+	v.Set(ProviderKey, e.Provider)
+	return nil
+}
+
+func (s wrapperScheme) DecodeCompat(v url.Values, e *EnCrypto) error {
+	e.KeyID = v.Get(KeyIDKey)
+	e.Provider = v.Get(ProviderKey)
+	return nil
+}
+
+func init() {
+	RegisterScheme(wrapperScheme{baseScheme{
+		algos:       WrapAes256Gcm,
+		description: "a key of a key wrapping provider, see --wrap-provider",
+		source:      WrapperSource,
+	}}, 0, 1)
+}
+
+// wrapWithWrapper wraps the data key of d with the wrapper and key ID of opts
+func wrapWithWrapper(d DeCrypto, opts *Opts) ([]byte, error) {
+	if opts.Wrapper == nil || opts.WrapKeyID == "" {
+		return nil, utils.NewKindError(utils.KindUsage, "no key wrapping provider and key ID were given to encrypt with")
+	}
+
+	return opts.Wrapper.Wrap(opts.WrapKeyID, d.DecKey)
+}
+
+// unwrapWithWrapper unwraps the data key of e with the wrapper of opts named in its metadata
+func unwrapWithWrapper(e EnCrypto, opts *Opts) ([]byte, error) {
+	for _, w := range opts.Wrappers {
+		if w.Name() == e.Provider {
+			key, err := w.Unwrap(e.KeyID, e.EncKey)
+			if err != nil {
+				return nil, err
+			}
+			if len(key) != 32 {
+				return nil, utils.NewKindError(utils.KindCrypto, "key wrapping provider "+e.Provider+" returned a key of the wrong length")
+			}
+			return key, nil
+		}
+	}
+
+	return nil, utils.NewKindError(
+		utils.KindUsage,
+		"the image was encrypted with key "+e.KeyID+" of key wrapping provider "+e.Provider+", which was not configured",
+	)
+}
@@ -0,0 +1,222 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+const vaultToken = "s.test"
+
+// vaultTransit is a stand-in for the transit engine of Vault with a single key
+type vaultTransit struct {
+	keyID string
+	aead  cipher.AEAD
+}
+
+func newVaultTransit(t *testing.T, keyID string) *httptest.Server {
+	kek := make([]byte, 32)
+	_, err := rand.Read(kek)
+	require.NoError(t, err)
+	block, err := aes.NewCipher(kek)
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+
+	return httptest.NewServer(&vaultTransit{keyID: keyID, aead: aead})
+}
+
+func (v *vaultTransit) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	fail := func(status int, msg string) {
+		rw.WriteHeader(status)
+		_ = json.NewEncoder(rw).Encode(map[string][]string{"errors": {msg}})
+	}
+
+	if req.Header.Get("X-Vault-Token") != vaultToken {
+		fail(http.StatusForbidden, "permission denied")
+		return
+	}
+
+	body := map[string]string{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var data map[string]string
+	switch req.URL.Path {
+	case "/v1/transit/encrypt/" + v.keyID:
+		plaintext, err := base64.StdEncoding.DecodeString(body["plaintext"])
+		if err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		nonce := make([]byte, v.aead.NonceSize())
+		_, _ = rand.Read(nonce)
+		ct := v.aead.Seal(nonce, nonce, plaintext, nil)
+		data = map[string]string{"ciphertext": "vault:v1:" + base64.StdEncoding.EncodeToString(ct)}
+	case "/v1/transit/decrypt/" + v.keyID:
+		ct, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(body["ciphertext"], "vault:v1:"))
+		if err != nil || len(ct) < v.aead.NonceSize() {
+			fail(http.StatusBadRequest, "invalid ciphertext")
+			return
+		}
+		plaintext, err := v.aead.Open(nil, ct[:v.aead.NonceSize()], ct[v.aead.NonceSize():], nil)
+		if err != nil {
+			fail(http.StatusBadRequest, "cipher: message authentication failed")
+			return
+		}
+		data = map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}
+	default:
+		fail(http.StatusBadRequest, "encryption key not found")
+		return
+	}
+
+	_ = json.NewEncoder(rw).Encode(map[string]interface{}{"data": data})
+}
+
+// TestKeyProviderHelper is not a test, but the keyprovider run by TestKeyWrappers. It
+// "wraps" keys by XORing them with the key ID.
+func TestKeyProviderHelper(t *testing.T) {
+	if os.Getenv("CRYPTO_CLI_KEYPROVIDER_HELPER") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	in := &crypto.KeyProviderInput{}
+	if err := json.NewDecoder(os.Stdin).Decode(in); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	xor := func(params crypto.KeyProviderConfig, data []byte) []byte {
+		id := params.Parameters["keyid"][0]
+		out := make([]byte, len(data))
+		for i := range data {
+			out[i] = data[i] ^ id[i%len(id)]
+		}
+		return out
+	}
+
+	out := &crypto.KeyProviderOutput{}
+	switch in.Operation {
+	case "keywrap":
+		out.KeyWrapResults = &crypto.KeyWrapResults{
+			Annotation: xor(in.KeyWrapParams.EncryptConfig, in.KeyWrapParams.OptsData),
+		}
+	case "keyunwrap":
+		if string(in.KeyUnwrapParams.DecryptConfig.Parameters["keyid"][0]) == "unknown" {
+			fmt.Fprintln(os.Stderr, "unknown key")
+			os.Exit(1)
+		}
+		out.KeyUnwrapResults = &crypto.KeyUnwrapResults{
+			OptsData: xor(in.KeyUnwrapParams.DecryptConfig, in.KeyUnwrapParams.Annotation),
+		}
+	}
+
+	_ = json.NewEncoder(os.Stdout).Encode(out)
+}
+
+func TestKeyWrappers(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newVaultTransit(t, "images")
+	defer server.Close()
+
+	vault := crypto.NewVaultWrapper(server.URL, vaultToken, "transit", server.Client())
+	badToken := crypto.NewVaultWrapper(server.URL, "s.wrong", "transit", server.Client())
+	helper := crypto.NewCommandWrapper(
+		"helper",
+		"CRYPTO_CLI_KEYPROVIDER_HELPER=1 "+os.Args[0]+" -test.run=TestKeyProviderHelper",
+	)
+
+	tests := []struct {
+		wrapper  crypto.KeyWrapper
+		keyID    string
+		wrappers []crypto.KeyWrapper
+		encErr   bool
+		encKind  utils.Kind
+		decKind  utils.Kind
+	}{
+		{vault, "images", []crypto.KeyWrapper{helper, vault}, false, utils.KindUnknown, utils.KindUnknown},
+		{helper, "images", []crypto.KeyWrapper{vault, helper}, false, utils.KindUnknown, utils.KindUnknown},
+		{helper, "unknown", []crypto.KeyWrapper{helper}, false, utils.KindUnknown, utils.KindCrypto},
+		{vault, "images", []crypto.KeyWrapper{badToken}, false, utils.KindUnknown, utils.KindAuth},
+		{vault, "images", []crypto.KeyWrapper{helper}, false, utils.KindUnknown, utils.KindUsage},
+		{vault, "other", nil, true, utils.KindUnknown, utils.KindUnknown},
+		{badToken, "images", nil, true, utils.KindAuth, utils.KindUnknown},
+	}
+
+	for _, test := range tests {
+		encOpts := &crypto.Opts{Algos: crypto.WrapAes256Gcm, Wrapper: test.wrapper, WrapKeyID: test.keyID}
+
+		c, err := crypto.NewDecrypto(encOpts)
+		if !assert.NoError(err) {
+			continue
+		}
+
+		e, err := crypto.EncryptKey(*c, encOpts)
+		if test.encErr {
+			if assert.Error(err) {
+				assert.Equal(test.encKind, utils.KindOf(err))
+			}
+			continue
+		}
+		if !assert.NoError(err) {
+			continue
+		}
+		assert.Equal(test.keyID, e.KeyID)
+		assert.Equal(test.wrapper.Name(), e.Provider)
+		assert.False(bytes.Contains(e.EncKey, c.DecKey))
+
+		// the provider and key ID survive the compat encoding
+		u, err := crypto.NewURLCompat(&e, encOpts)
+		if assert.NoError(err) {
+			parsed, err := crypto.ParseEncryptoCompat([]string{u.String()})
+			if assert.NoError(err) {
+				assert.Equal(e, parsed)
+			}
+		}
+
+		d, err := crypto.DecryptKey(e, &crypto.Opts{Wrappers: test.wrappers})
+		if test.decKind != utils.KindUnknown {
+			if assert.Error(err) {
+				assert.Equal(test.decKind, utils.KindOf(err))
+			}
+			continue
+		}
+
+		if assert.NoError(err) {
+			assert.Equal(c.DecKey, d.DecKey)
+		}
+	}
+}
@@ -53,7 +53,7 @@ type clearFields struct {
 
 // DecConfig is config that may be encrypted
 type DecConfig interface {
-	Encrypt(key, nonce, salt []byte) (EncConfig, error)
+	Encrypt(d *crypto.DeCrypto) (EncConfig, error)
 }
 
 type decConfig struct {
@@ -80,15 +80,15 @@ func (c *decConfig) MarshalJSON() (_ []byte, err error) {
 	return json.Marshal(sorted)
 }
 
-func (c *decConfig) Encrypt(key, nonce, salt []byte) (_ EncConfig, err error) {
+func (c *decConfig) Encrypt(d *crypto.DeCrypto) (_ EncConfig, err error) {
 	out := &encConfig{clearFields: c.clearFields}
-	out.Enc, err = crypto.EncryptJSON(c.secretFields, key, nonce, salt)
+	out.Enc, err = crypto.EncryptJSON(c.secretFields, d)
 	return out, err
 }
 
 // EncConfig has the secretFields encrypted
 type EncConfig interface {
-	Decrypt(key, nonce, salt []byte, opts *crypto.Opts) (DecConfig, error)
+	Decrypt(d *crypto.DeCrypto, opts *crypto.Opts) (DecConfig, error)
 }
 
 type encConfig struct {
@@ -96,8 +96,8 @@ type encConfig struct {
 	clearFields
 }
 
-func (c *encConfig) Decrypt(key, nonce, salt []byte, opts *crypto.Opts) (dc DecConfig, err error) {
+func (c *encConfig) Decrypt(d *crypto.DeCrypto, opts *crypto.Opts) (dc DecConfig, err error) {
 	dc = &decConfig{clearFields: c.clearFields}
-	err = crypto.DecryptJSON(c.Enc, key, nonce, salt, dc)
+	err = crypto.DecryptJSON(c.Enc, d, dc)
 	return dc, err
 }
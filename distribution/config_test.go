@@ -57,13 +57,19 @@ func TestUnMarshalling(t *testing.T) {
 	}
 	opts.SetPassphrase("hunter2")
 
-	nonce := []byte("012345678901")
-	salt := []byte("0123456789012345")
+	d := &crypto.DeCrypto{
+		Crypto: crypto.Crypto{
+			Nonce:   []byte("012345678901"),
+			Salt:    []byte("0123456789012345"),
+			Version: crypto.LatestVersion,
+		},
+		DecKey: key,
+	}
 
-	ec, err := val.Encrypt(key, nonce, salt)
+	ec, err := val.Encrypt(d)
 	require.NoError(err)
 
-	dc, err := ec.Decrypt(key, nonce, salt, opts)
+	dc, err := ec.Decrypt(d, opts)
 	require.NoError(err)
 
 	require.Equal(val, dc)
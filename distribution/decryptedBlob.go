@@ -43,7 +43,10 @@ type decryptedBlob struct {
 	*crypto.DeCrypto `json:"-"`
 }
 
+// EncryptBlob wipes the data key once the blob is encrypted
 func (db *decryptedBlob) EncryptBlob(opts *crypto.Opts, outname string) (eb EncryptedBlob, err error) {
+	defer db.DeCrypto.Wipe()
+
 	r, err := db.ReadCloser()
 	if err != nil {
 		err = errors.WithStack(err)
@@ -62,7 +65,7 @@ func (db *decryptedBlob) EncryptBlob(opts *crypto.Opts, outname string) (eb Encr
 	mw := io.MultiWriter(digester.Hash(), out)
 	cw := &utils.CounterWriter{Writer: mw}
 
-	ew, err := crypto.EncBlobWriter(cw, db.DecKey)
+	ew, err := crypto.EncryptWriter(cw, db.DeCrypto)
 	if err != nil {
 		err = errors.WithStack(err)
 		return
@@ -121,7 +124,10 @@ type decryptedConfig struct {
 	*crypto.DeCrypto `json:"-"`
 }
 
+// EncryptBlob wipes the data key once the config is encrypted
 func (db *decryptedConfig) EncryptBlob(opts *crypto.Opts, outname string) (eb EncryptedBlob, err error) {
+	defer db.DeCrypto.Wipe()
+
 	r, err := db.ReadCloser()
 	if err != nil {
 		err = errors.WithStack(err)
@@ -145,7 +151,7 @@ func (db *decryptedConfig) EncryptBlob(opts *crypto.Opts, outname string) (eb En
 		return
 	}
 
-	ec, err := dc.Encrypt(db.DecKey, db.Nonce, db.Salt)
+	ec, err := dc.Encrypt(db.DeCrypto)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,102 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+
+	dimage "github.com/docker/docker/image"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// DiffIDs reads the digests of the uncompressed layers from the rootfs of a plaintext config file
+func DiffIDs(filename string) (_ []digest.Digest, err error) {
+	// filename is always a file that this application created
+	fh, err := os.Open(filename) // #nosec
+	if err != nil {
+		err = errors.Wrapf(err, "could not open file: %s", filename)
+		return
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	config := &struct {
+		RootFS *dimage.RootFS `json:"rootfs"`
+	}{}
+	if err = json.NewDecoder(fh).Decode(config); err != nil {
+		err = errors.Wrapf(err, "could not decode config: %s", filename)
+		return
+	}
+
+	if config.RootFS == nil {
+		err = errors.New("config does not contain a rootfs")
+		return
+	}
+
+	diffIDs := make([]digest.Digest, len(config.RootFS.DiffIDs))
+	for i, d := range config.RootFS.DiffIDs {
+		diffIDs[i] = digest.Digest(d)
+	}
+
+	return diffIDs, nil
+}
+
+// DiffID computes the digest of the decrypted, uncompressed data of a downloaded layer
+// without writing the plaintext to disk. The layer is authenticated as it is decrypted, and
+// its data key is wiped afterwards.
+func DiffID(l Blob, opts *crypto.Opts) (_ digest.Digest, err error) {
+	if eb, ok := l.(EncryptedBlob); ok {
+		if l, err = eb.DecryptKey(opts); err != nil {
+			return
+		}
+	}
+
+	rc, err := l.ReadCloser()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(rc, err) }()
+
+	var r io.Reader = rc
+	switch blob := l.(type) {
+	case *keyDecryptedBlob:
+		defer blob.DeCrypto.Wipe()
+		if r, err = crypto.DecryptReader(rc, blob.DeCrypto); err != nil {
+			return
+		}
+	case *NoncryptedBlob:
+	default:
+		return "", errors.Errorf("layer is of wrong type: %T", blob)
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(zr, err) }()
+
+	digester := digest.Canonical.Digester()
+	if _, err = io.Copy(digester.Hash(), zr); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return digester.Digest(), nil
+}
@@ -0,0 +1,115 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestDiffID(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, test := range []*crypto.Opts{opts, optsCompat, optsChaCha} {
+		test.SetPassphrase(passphrase)
+
+		c, err := crypto.NewDecrypto(test)
+		if !assert.NoError(err) {
+			continue
+		}
+
+		dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+		defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+		size, d, fn, err := mkRandFile(t, dir)
+		if !assert.NoError(err) {
+			continue
+		}
+
+		enc, err := distribution.NewLayer(fn, d, size, c).EncryptBlob(test, filepath.Join(dir, "enc"))
+		if !assert.NoError(err) {
+			continue
+		}
+
+		diffID, err := distribution.DiffID(enc, test)
+		if assert.NoError(err) {
+			assert.Equal(d, diffID)
+		}
+
+		// tamper with the ciphertext
+		data, err := ioutil.ReadFile(enc.GetFilename())
+		if !assert.NoError(err) {
+			continue
+		}
+		data[len(data)/2] ^= 1
+		if !assert.NoError(ioutil.WriteFile(enc.GetFilename(), data, 0600)) {
+			continue
+		}
+
+		_, err = distribution.DiffID(enc, test)
+		assert.Error(err)
+	}
+}
+
+func TestDiffIDs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	require.NoError(os.MkdirAll(dir, 0700))
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	d1 := digest.Canonical.FromString("layer 1")
+	d2 := digest.Canonical.FromString("layer 2")
+
+	tests := []struct {
+		config  string
+		diffIDs []digest.Digest
+		hasErr  bool
+	}{
+		{`{"rootfs":{"type":"layers","diff_ids":["` + d1.String() + `","` + d2.String() + `"]}}`, []digest.Digest{d1, d2}, false},
+		{`{"rootfs":{"type":"layers"}}`, []digest.Digest{}, false},
+		{`{"architecture":"amd64"}`, nil, true},
+		{`not json`, nil, true},
+	}
+
+	for _, test := range tests {
+		fn := filepath.Join(dir, uuid.New().String())
+		if !assert.NoError(ioutil.WriteFile(fn, []byte(test.config), 0600)) {
+			continue
+		}
+
+		diffIDs, err := distribution.DiffIDs(fn)
+		if test.hasErr {
+			assert.Error(err)
+			continue
+		}
+
+		if assert.NoError(err) {
+			assert.Equal(test.diffIDs, diffIDs)
+		}
+	}
+}
@@ -24,8 +24,9 @@ var (
 	//passphrase = "196884 = 196883 + 1"
 	passphrase = "hunter2"
 	opts       = &crypto.Opts{
-		Algos:  crypto.Pbkdf2Aes256Gcm,
-		Compat: false,
+		Algos:   crypto.Pbkdf2Aes256Gcm,
+		Compat:  false,
+		Version: crypto.LatestVersion,
 	}
 	optsNone = &crypto.Opts{
 		Algos:  crypto.None,
@@ -35,6 +36,12 @@ var (
 		Algos:  crypto.Pbkdf2Aes256Gcm,
 		Compat: true,
 	}
+	optsChaCha = &crypto.Opts{
+		Algos:   crypto.Pbkdf2Aes256Gcm,
+		Cipher:  crypto.ChaCha20Poly1305,
+		Version: crypto.LatestVersion,
+		Compat:  true,
+	}
 	optsMock = &crypto.Opts{
 		Algos: crypto.Algos("mock"),
 	}
@@ -82,6 +89,9 @@ func TestCryptoBlobsEncDec(t *testing.T) {
 			continue
 		}
 
+		// the data key is wiped once the blob is encrypted
+		assert.Nil(c.DecKey)
+
 		kdec, err := enc.DecryptKey(test.opts)
 		if !assert.NoError(err) {
 			continue
@@ -30,6 +30,8 @@ type EncryptedBlob interface {
 	// in the "Filename"
 	DecryptBlob(opts *crypto.Opts, outfile string) (DecryptedBlob, error)
 	DecryptKey(opts *crypto.Opts) (KeyDecryptedBlob, error)
+	// GetEnCrypto returns the encrypted key and the parameters used to encrypt it
+	GetEnCrypto() (*crypto.EnCrypto, error)
 }
 
 // EncryptedBlob is the go type for an encrypted element in the layer array
@@ -46,6 +48,8 @@ func (eb *encryptedBlobNew) DecryptBlob(opts *crypto.Opts, outname string) (_ De
 	return kb.DecryptFile(opts, outname)
 }
 
+func (eb *encryptedBlobNew) GetEnCrypto() (*crypto.EnCrypto, error) { return eb.EnCrypto, nil }
+
 func (eb *encryptedBlobNew) DecryptKey(opts *crypto.Opts) (_ KeyDecryptedBlob, err error) {
 	dk, err := crypto.DecryptKey(*eb.EnCrypto, opts)
 	if err != nil {
@@ -77,6 +81,11 @@ func (e *encryptedBlobCompat) DecryptBlob(opts *crypto.Opts, outname string) (_
 	return eb.DecryptBlob(opts, outname)
 }
 
+func (e *encryptedBlobCompat) GetEnCrypto() (*crypto.EnCrypto, error) {
+	ek, err := crypto.ParseEncryptoCompat(e.URLs)
+	return &ek, err
+}
+
 func (e *encryptedBlobCompat) DecryptKey(opts *crypto.Opts) (_ KeyDecryptedBlob, err error) {
 	ek, err := crypto.NewEncryptoCompat(e.URLs, opts)
 	if err != nil {
@@ -107,6 +116,8 @@ func (ec *encryptedConfigNew) DecryptBlob(opts *crypto.Opts, outname string) (_
 	return kc.DecryptFile(opts, outname)
 }
 
+func (ec *encryptedConfigNew) GetEnCrypto() (*crypto.EnCrypto, error) { return ec.EnCrypto, nil }
+
 func (ec *encryptedConfigNew) DecryptKey(opts *crypto.Opts) (_ KeyDecryptedBlob, err error) {
 	dk, err := crypto.DecryptKey(*ec.EnCrypto, opts)
 	if err != nil {
@@ -137,6 +148,11 @@ func (e *encryptedConfigCompat) DecryptBlob(opts *crypto.Opts, outname string) (
 	return eb.DecryptBlob(opts, outname)
 }
 
+func (e *encryptedConfigCompat) GetEnCrypto() (*crypto.EnCrypto, error) {
+	ek, err := crypto.ParseEncryptoCompat(e.URLs)
+	return &ek, err
+}
+
 func (e *encryptedConfigCompat) DecryptKey(opts *crypto.Opts) (_ KeyDecryptedBlob, err error) {
 	ek, err := crypto.NewEncryptoCompat(e.URLs, opts)
 	if err != nil {
@@ -154,3 +170,14 @@ func (e *encryptedConfigCompat) DecryptKey(opts *crypto.Opts) (_ KeyDecryptedBlo
 		DeCrypto:       &dk,
 	}, nil
 }
+
+// IsCompat reports whether the encryption data of blob is stored in the urls field,
+// so that the manifest is compatible with the Docker image manifest schema v2.2
+func IsCompat(blob Blob) bool {
+	switch blob.(type) {
+	case *encryptedBlobCompat, *encryptedConfigCompat:
+		return true
+	default:
+		return false
+	}
+}
@@ -41,14 +41,17 @@ type keyDecryptedBlob struct {
 	*crypto.DeCrypto `json:"-"`
 }
 
+// DecryptFile wipes the data key once the blob is decrypted
 func (kb *keyDecryptedBlob) DecryptFile(opts *crypto.Opts, outfile string) (DecryptedBlob, error) {
+	defer kb.DeCrypto.Wipe()
+
 	r, err := kb.ReadCloser()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	defer func() { err = utils.CheckedClose(r, err) }()
 
-	dec, err := crypto.DecBlobReader(r, kb.DeCrypto.DecKey)
+	dec, err := crypto.DecryptReader(r, kb.DeCrypto)
 	if err != nil {
 		return nil, err
 	}
@@ -106,7 +109,10 @@ type keyDecryptedConfig struct {
 	*crypto.DeCrypto `json:"-"`
 }
 
+// DecryptFile wipes the data key once the config is decrypted
 func (kc *keyDecryptedConfig) DecryptFile(opts *crypto.Opts, outname string) (DecryptedBlob, error) {
+	defer kc.DeCrypto.Wipe()
+
 	r, err := kc.ReadCloser()
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -127,7 +133,7 @@ func (kc *keyDecryptedConfig) DecryptFile(opts *crypto.Opts, outname string) (De
 		return nil, err
 	}
 
-	dc, err := ec.Decrypt(kc.DecKey, kc.Nonce, kc.Salt, opts)
+	dc, err := ec.Decrypt(kc.DeCrypto, opts)
 	if err != nil {
 		return nil, err
 	}
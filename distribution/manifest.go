@@ -24,8 +24,8 @@ import (
 	"regexp"
 
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
+	dimage "github.com/docker/docker/image"
 	"github.com/google/uuid"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
@@ -52,6 +52,7 @@ type ImageManifest struct {
 
 // NewManifest creates an unencrypted manifest (with the data necessary for encryption)
 func NewManifest(
+	ctx context.Context,
 	ref names.NamedTaggedRepository,
 	opts *crypto.Opts,
 	tempDir string,
@@ -59,27 +60,25 @@ func NewManifest(
 	manifest *ImageManifest,
 	err error,
 ) {
-	ctx := context.Background()
-
 	// create client to docker API
 	// TODO: fix hardcoded version if necessary
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion("1.37"))
 	if err != nil {
-		err = errors.Wrap(err, "could not create client for docker daemon")
+		err = utils.WithKind(utils.KindDaemon, errors.Wrap(err, "could not create client for docker daemon"))
 		return
 	}
 
 	// run docker inspect to optain the image ID
 	inspt, _, err := cli.ImageInspectWithRaw(ctx, ref.String())
 	if err != nil {
-		err = errors.WithStack(err)
+		err = DaemonError(err)
 		return
 	}
 
 	// docker save the image to an archive (as a ReadCloser)
 	imageTar, err := cli.ImageSave(ctx, []string{inspt.ID})
 	if err != nil {
-		err = errors.WithStack(err)
+		err = DaemonError(err)
 		return
 	}
 	defer func() { err = utils.CheckedClose(imageTar, err) }()
@@ -99,6 +98,14 @@ func NewManifest(
 		DirName:       filepath.Join(tempDir, uuid.New().String()),
 	}
 
+	// do not leave a partially extracted image behind, e.g. if ctx is cancelled
+	defer func() {
+		if err != nil {
+			err = utils.CleanUp(manifest.DirName, err)
+			manifest = nil
+		}
+	}()
+
 	// extract image archive and fill out manifest
 	if err = extractTarBall(imageTar, inspt.Size, manifest); err != nil {
 		return
@@ -116,8 +123,47 @@ func NewManifest(
 	return
 }
 
-// Encrypt an image, generating an image manifest suitable for upload to a repo
+// NewManifestFromArchive creates an unencrypted manifest (with the data necessary for
+// encryption) from an extracted image archive in dir, such as that produced by docker save.
+// Unlike NewManifest, the layers to encrypt are determined from the history in the image
+// config, so the docker daemon is not required.
+func NewManifestFromArchive(dir string, opts *crypto.Opts) (manifest *ImageManifest, err error) {
+	// manifestfile is always a file that this application created
+	manifestfile := filepath.Join(dir, "manifest.json")
+	manifestFH, err := os.Open(manifestfile) // #nosec
+	if err != nil {
+		err = errors.Wrapf(err, "could not open file: %s", manifestfile)
+		return
+	}
+	defer func() { err = utils.CheckedClose(manifestFH, err) }()
+
+	image, err := NewImageArchiveManifest(manifestFH)
+	if err != nil {
+		return
+	}
+
+	layers, err := layersToEncryptFromConfig(filepath.Join(dir, image.Config))
+	if err != nil {
+		return
+	}
+
+	log.Debug().Msgf("The following layers are to be encrypted: %v", layers)
+
+	manifest = &ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		DirName:       dir,
+	}
+
+	manifest.Config, manifest.Layers, err = mkBlobs("", "", dir, layers, opts)
+
+	return
+}
+
+// Encrypt an image, generating an image manifest suitable for upload to a repo.
+// ctx is checked before each blob is encrypted.
 func (m *ImageManifest) Encrypt(
+	ctx context.Context,
 	ref names.NamedTaggedRepository,
 	opts *crypto.Opts,
 ) (
@@ -147,6 +193,10 @@ func (m *ImageManifest) Encrypt(
 	}
 
 	for i := 0; i < len(m.Layers) && err == nil; i++ {
+		if err = errors.WithStack(ctx.Err()); err != nil {
+			return
+		}
+
 		switch blob := m.Layers[i].(type) {
 		case DecryptedBlob:
 			log.Debug().Msgf("encrypting layer %d: %s", i, blob.GetFilename())
@@ -190,8 +240,10 @@ func (m *ImageManifest) DecryptKeys(
 	return
 }
 
-// Decrypt decrypt a manifest, both the keys and layer data
+// Decrypt decrypt a manifest, both the keys and layer data.
+// ctx is checked before each layer is decrypted.
 func (m *ImageManifest) Decrypt(
+	ctx context.Context,
 	ref names.NamedTaggedRepository,
 	opts *crypto.Opts,
 ) (out *ImageManifest, err error) {
@@ -219,12 +271,48 @@ func (m *ImageManifest) Decrypt(
 	// decrypt keys and files for layers
 	out.Layers = make([]Blob, len(m.Layers))
 	for i := 0; i < len(m.Layers) && err == nil; i++ {
-		out.Layers[i], err = decryptLayer(ref, opts, m.Layers[i])
+		if err = errors.WithStack(ctx.Err()); err == nil {
+			out.Layers[i], err = decryptLayer(ref, opts, m.Layers[i])
+		}
+	}
+	if err != nil {
+		return
 	}
 
+	err = out.checkDiffIDs()
 	return
 }
 
+// checkDiffIDs verifies that the digests of the decrypted, uncompressed layers match
+// the rootfs of the decrypted config, so that mismatched layers are never loaded
+func (m *ImageManifest) checkDiffIDs() error {
+	diffIDs, err := DiffIDs(m.Config.GetFilename())
+	if err != nil {
+		return err
+	}
+
+	if len(diffIDs) != len(m.Layers) {
+		return errors.Errorf(
+			"config lists %d layers but the manifest has %d, refusing to load the image",
+			len(diffIDs),
+			len(m.Layers),
+		)
+	}
+
+	for i, l := range m.Layers {
+		if l.GetDigest() != diffIDs[i] {
+			return errors.Errorf(
+				"layer %d has diff ID %s but the config expects %s, refusing to load the image",
+				i,
+				l.GetDigest(),
+				diffIDs[i],
+			)
+		}
+	}
+
+	return nil
+}
+
 // extractTarBall extracts the tarball from a docker save and fills out the
 // provided image manifest that with details about the layers
 func extractTarBall(r io.Reader, size int64, manifest *ImageManifest) (err error) {
@@ -325,14 +413,15 @@ func mkBlobs(
 		return
 	}
 
-	switch opts.Algos {
-	case crypto.Pbkdf2Aes256Gcm:
-		return pbkdf2Aes256GcmEncrypt(path, layerSet, image, opts)
-	case crypto.None:
+	scheme, err := crypto.LookupScheme(opts.Algos, opts.Version)
+	if err != nil {
+		return
+	}
+
+	if scheme.KeySource() == crypto.NoKey {
 		return noneEncrypt(path, layerSet, image, opts)
-	default:
 	}
-	return nil, nil, errors.Errorf("%v is not a valid encryption type", opts.Algos)
+	return schemeEncrypt(path, layerSet, image, opts)
 }
 
 // noneEncrypt encrypts the images's Blob structs when the enctype is NONE
@@ -355,9 +444,8 @@ func noneEncrypt(
 	return
 }
 
-// pbkdf2Aes256GcmEncrypt encrypts the images's Blob structs when the enctype
-// is Pbkdf2Aes256Gcm
-func pbkdf2Aes256GcmEncrypt(
+// schemeEncrypt encrypts the images's Blob structs with the scheme of the enctype
+func schemeEncrypt(
 	path string,
 	layerSet map[string]bool,
 	image *ImageArchiveManifest,
@@ -367,23 +455,29 @@ func pbkdf2Aes256GcmEncrypt(
 	layerBlobs []Blob,
 	err error,
 ) {
+	// the keys are wiped when their blobs are encrypted, so wipe them here if that
+	// will never happen
+	var decs []*crypto.DeCrypto
+	defer func() {
+		if err != nil {
+			for _, dec := range decs {
+				dec.Wipe()
+			}
+		}
+	}()
+
 	// make the config
-	//var dec *crypto.DeCrypto
 	dec, err := crypto.NewDecrypto(opts)
 	if err != nil {
 		return
 	}
+	decs = append(decs, dec)
 	configBlob = NewConfig(filepath.Join(path, image.Config), "", 0, dec)
 
 	layerBlobs = make([]Blob, len(image.Layers))
 	for i, f := range image.Layers {
 		basename := filepath.Join(path, f)
 
-		dec, err = crypto.NewDecrypto(opts)
-		if err != nil {
-			return
-		}
-
 		var d digest.Digest
 		d, err = fileDigest(basename)
 		if err != nil {
@@ -392,11 +486,17 @@ func pbkdf2Aes256GcmEncrypt(
 		}
 
 		log.Debug().Msgf("preparing %s", d)
-		if layerSet[d.String()] {
-			layerBlobs[i] = NewLayer(filepath.Join(path, f), d, 0, dec)
-		} else {
+		if !layerSet[d.String()] {
 			layerBlobs[i] = NewPlainLayer(filepath.Join(path, f), d, 0)
+			continue
 		}
+
+		dec, err = crypto.NewDecrypto(opts)
+		if err != nil {
+			return
+		}
+		decs = append(decs, dec)
+		layerBlobs[i] = NewLayer(filepath.Join(path, f), d, 0, dec)
 	}
 
 	return
@@ -424,12 +524,22 @@ func layersToEncrypt(
 	// get the history
 	hist, err := cli.ImageHistory(ctx, inspt.ID)
 	if err != nil {
-		err = errors.WithStack(err)
+		err = DaemonError(err)
 		return
 	}
 
+	// the daemon lists the history newest first
+	re := regexp.MustCompile(createdRE)
+	entries := make([]historyEntry, len(hist))
+	for i, h := range hist {
+		entries[len(hist)-1-i] = historyEntry{
+			createdBy:  h.CreatedBy,
+			emptyLayer: h.Size == 0 && re.MatchString(h.CreatedBy),
+		}
+	}
+
 	// the positions of the layers to encrypt
-	eps, err := encryptPositions(hist)
+	eps, err := encryptPositions(entries)
 	if err != nil {
 		return
 	}
@@ -449,29 +559,87 @@ func layersToEncrypt(
 	return diffIDsToEncrypt, nil
 }
 
-// encryptPositions gives the positions in the image history that correspond to encrypted layers
-// the length of the output array is the number of layers that are to be encrypted
-func encryptPositions(hist []image.HistoryResponseItem) (encryptPos []int, err error) {
+// layersToEncryptFromConfig returns the diffIDs of the layers that have been marked for
+// encryption, as determined by the history in the image config stored in filename
+func layersToEncryptFromConfig(filename string) (_ []string, err error) {
+	// filename is always a file that this application created
+	fh, err := os.Open(filename) // #nosec
+	if err != nil {
+		err = errors.Wrapf(err, "could not open file: %s", filename)
+		return
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	config := &struct {
+		History []dimage.History `json:"history"`
+		RootFS  *dimage.RootFS   `json:"rootfs"`
+	}{}
+	if err = json.NewDecoder(fh).Decode(config); err != nil {
+		err = errors.Wrapf(err, "could not decode config: %s", filename)
+		return
+	}
+
+	if config.RootFS == nil {
+		err = errors.New("config does not contain a rootfs")
+		return
+	}
+
+	// the config lists the history oldest first
+	entries := make([]historyEntry, len(config.History))
+	for i, h := range config.History {
+		entries[i] = historyEntry{createdBy: h.CreatedBy, emptyLayer: h.EmptyLayer}
+	}
+
+	eps, err := encryptPositions(entries)
+	if err != nil {
+		return
+	}
+
+	diffIDsToEncrypt := make([]string, len(eps))
+	for i, n := range eps {
+		if n >= len(config.RootFS.DiffIDs) {
+			err = errors.New("config history does not match its rootfs")
+			return
+		}
+		diffIDsToEncrypt[i] = config.RootFS.DiffIDs[n].String()
+	}
+
+	return diffIDsToEncrypt, nil
+}
+
+// historyEntry is an entry in the history of an image
+type historyEntry struct {
+	createdBy  string
+	emptyLayer bool
+}
+
+// encryptPositions gives the positions in the image history (oldest first) that correspond to
+// encrypted layers the length of the output array is the number of layers that are to be encrypted
+func encryptPositions(hist []historyEntry) (encryptPos []int, err error) {
 	n := 0
 	toEncrypt := false
 	re := regexp.MustCompile(createdRE)
 
-	for i := len(hist) - 1; i >= 0; i-- {
-		matches := re.FindSubmatch([]byte(hist[i].CreatedBy))
-
-		if hist[i].Size != 0 || len(matches) == 0 {
+	for _, h := range hist {
+		if !h.emptyLayer {
 			if toEncrypt {
 				encryptPos = append(encryptPos, n)
 			}
 			n++
-		} else {
-			switch string(matches[1]) {
-			case "true":
-				toEncrypt = true
-			case "false":
-				toEncrypt = false
-			default:
-			}
+			continue
+		}
+
+		matches := re.FindStringSubmatch(h.createdBy)
+		if len(matches) == 0 {
+			continue
+		}
+
+		switch matches[1] {
+		case "true":
+			toEncrypt = true
+		case "false":
+			toEncrypt = false
+		default:
 		}
 	}
 
@@ -540,3 +708,12 @@ func decryptLayer(
 	}
 	return
 }
+
+// DaemonError classifies an error returned by the docker daemon, which is KindNotFound if
+// the daemon does not have the image and KindDaemon otherwise
+func DaemonError(err error) error {
+	if client.IsErrNotFound(err) {
+		return utils.WithKind(utils.KindNotFound, errors.WithStack(err))
+	}
+	return utils.WithKind(utils.KindDaemon, errors.WithStack(err))
+}
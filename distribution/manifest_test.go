@@ -16,8 +16,10 @@ package distribution_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -60,7 +62,7 @@ func TestImageMock(t *testing.T) {
 	nTRep, err := names.CastToTagged(ref)
 	require.NoError(err)
 
-	manifest, err := distribution.NewManifest(nTRep, opts, dir)
+	manifest, err := distribution.NewManifest(context.Background(), nTRep, opts, dir)
 	require.NoError(err)
 
 	mockConfig := &distribution.ImageManifest{
@@ -109,17 +111,17 @@ func TestImageMock(t *testing.T) {
 	for _, test := range tests {
 		test.opts.SetPassphrase(test.passphrase)
 
-		if _, err = test.manifest.Encrypt(nTRep, &test.opts); err != nil {
+		if _, err = test.manifest.Encrypt(context.Background(), nTRep, &test.opts); err != nil {
 			assert.EqualError(err, test.errMsgEnc)
 		}
 
 		err = test.manifest.DecryptKeys(nTRep, &test.opts)
 		assert.EqualError(err, test.errMsgDec1)
 
-		_, err = test.manifest.Decrypt(nTRep, &test.opts)
+		_, err = test.manifest.Decrypt(context.Background(), nTRep, &test.opts)
 		assert.EqualError(err, test.errMsgDec1)
 
-		emanifest, err := manifest.Encrypt(nTRep, &test.opts)
+		emanifest, err := manifest.Encrypt(context.Background(), nTRep, &test.opts)
 		if !assert.NoError(err) {
 			continue
 		}
@@ -129,7 +131,7 @@ func TestImageMock(t *testing.T) {
 		err = emanifest.DecryptKeys(nTRep, &test.opts)
 		assert.EqualError(err, test.errMsgDec2)
 
-		_, err = emanifest.Decrypt(nTRep, &test.opts)
+		_, err = emanifest.Decrypt(context.Background(), nTRep, &test.opts)
 		assert.EqualError(err, test.errMsgDec2)
 	}
 }
@@ -183,12 +185,12 @@ func TestImageEncryptDecrypt(t *testing.T) {
 	for _, test := range tests {
 		test.opts.SetPassphrase(test.passphrase)
 
-		manifest, err := distribution.NewManifest(test.ref, test.opts, dir)
+		manifest, err := distribution.NewManifest(context.Background(), test.ref, test.opts, dir)
 		if err != nil && assert.EqualError(err, test.errMsg) || !assert.Equal(test.errMsg, "") {
 			continue
 		}
 
-		emanifest, err := manifest.Encrypt(test.ref, test.opts)
+		emanifest, err := manifest.Encrypt(context.Background(), test.ref, test.opts)
 		if !assert.NoError(err) {
 			continue
 		}
@@ -199,7 +201,7 @@ func TestImageEncryptDecrypt(t *testing.T) {
 			}
 		}
 
-		dmanifest, err := emanifest.Decrypt(test.ref, test.opts)
+		dmanifest, err := emanifest.Decrypt(context.Background(), test.ref, test.opts)
 		if !assert.NoError(err) {
 			continue
 		}
@@ -231,3 +233,76 @@ func checkFiles(m1, m2 *distribution.ImageManifest) (err error) {
 
 	return
 }
+
+func TestDecryptDiffIDs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ref, err := reference.ParseNormalizedNamed(imageName)
+	require.NoError(err)
+
+	nTRep, err := names.CastToTagged(ref)
+	require.NoError(err)
+
+	opts.SetPassphrase(passphrase)
+
+	tests := []struct {
+		diffID func(digest.Digest) digest.Digest
+		hasErr bool
+	}{
+		{func(d digest.Digest) digest.Digest { return d }, false},
+		{func(d digest.Digest) digest.Digest { return digest.Canonical.FromString("other") }, true},
+	}
+
+	for _, test := range tests {
+		dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+		defer func() { assert.NoError((utils.CleanUp(dir, nil))) }()
+
+		size, d, fn, err := mkRandFile(t, dir)
+		if !assert.NoError(err) {
+			continue
+		}
+
+		c, err := crypto.NewDecrypto(opts)
+		if !assert.NoError(err) {
+			continue
+		}
+
+		layer, err := distribution.NewLayer(fn, d, size, c).EncryptBlob(opts, filepath.Join(dir, "layer.enc"))
+		if !assert.NoError(err) {
+			continue
+		}
+
+		configFn := filepath.Join(dir, "config.json")
+		configJSON := []byte(`{"rootfs":{"type":"layers","diff_ids":["` + test.diffID(d).String() + `"]}}`)
+		if !assert.NoError(ioutil.WriteFile(configFn, configJSON, 0600)) {
+			continue
+		}
+
+		c, err = crypto.NewDecrypto(opts)
+		if !assert.NoError(err) {
+			continue
+		}
+
+		config := distribution.NewConfig(configFn, digest.Canonical.FromBytes(configJSON), int64(len(configJSON)), c)
+		econfig, err := config.EncryptBlob(opts, filepath.Join(dir, "config.enc"))
+		if !assert.NoError(err) {
+			continue
+		}
+
+		emanifest := &distribution.ImageManifest{
+			SchemaVersion: 2,
+			MediaType:     distribution.MediaTypeManifest,
+			Config:        econfig,
+			Layers:        []distribution.Blob{layer},
+			DirName:       dir,
+		}
+
+		_, err = emanifest.Decrypt(context.Background(), nTRep, opts)
+		if test.hasErr {
+			assert.Error(err)
+		} else {
+			assert.NoError(err)
+		}
+	}
+}
@@ -15,11 +15,9 @@
 package images
 
 import (
-	"net/http"
-	"net/url"
+	"context"
 
 	"github.com/docker/distribution/reference"
-	"github.com/docker/distribution/registry/api/v2"
 	dregistry "github.com/docker/docker/registry"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
@@ -28,63 +26,12 @@ import (
 	"github.com/Senetas/crypto-cli/registry/auth"
 	"github.com/Senetas/crypto-cli/registry/httpclient"
 	"github.com/Senetas/crypto-cli/registry/names"
-	"github.com/Senetas/crypto-cli/utils"
 )
 
-// useTLS determines whether the registry requires TLS
-func useTLS(
-	ref names.NamedRepository,
-	repoInfo dregistry.RepositoryInfo,
-	endpoint dregistry.APIEndpoint,
-) (_ bool, err error) {
-	endpoint.URL.Scheme = "http"
-	bldr := v2.NewURLBuilder(endpoint.URL, false)
-
-	urlStr, err := bldr.BuildBaseURL()
-	if err != nil {
-		err = errors.Wrapf(err, "base = %s", endpoint.URL)
-		return
-	}
-
-	req, err := http.NewRequest("GET", urlStr, nil)
-	if err != nil {
-		err = errors.Wrapf(err, "url = %s", urlStr)
-		return
-	}
-
-	httpClient := *httpclient.DefaultClient
-	httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
-	}
-
-	resp, err := httpclient.DoRequest(&httpClient, req, true, false)
-	if resp != nil {
-		defer func() { err = utils.CheckedClose(resp.Body, err) }()
-	}
-	if err != nil {
-		return
-	}
-
-	switch resp.StatusCode {
-	case http.StatusMovedPermanently:
-		loc := resp.Header.Get("Location")
-		u, err := url.Parse(loc)
-		if err != nil {
-			return false, errors.WithStack(err)
-		}
-		if u.Scheme == "https" {
-			endpoint.URL.Scheme = "https"
-			return true, nil
-		}
-		return false, nil
-	case http.StatusOK:
-		return false, nil
-	default:
-		return false, errors.Errorf("status code %s from server", resp.Status)
-	}
-}
-
-func authProcedure(ref reference.Named) (
+// authProcedure authenticates with the registry of ref for the given actions on its
+// repository, i.e. "pull" and/or "push". The token is nil if the registry does not
+// require authentication.
+func authProcedure(ctx context.Context, ref reference.Named, actions ...string) (
 	token auth.Token,
 	nTRep names.NamedTaggedRepository,
 	endpoint *dregistry.APIEndpoint,
@@ -102,24 +49,24 @@ func authProcedure(ref reference.Named) (
 	}
 
 	log.Debug().Msgf("%v %v", ref, *repoInfo)
-	endpoint, err = registry.GetEndpoint(ref, *repoInfo)
+	endpoint, err = registry.GetEndpoint(ctx, ref, *repoInfo)
 	if err != nil {
 		err = errors.Wrapf(err, "could not get endpoint ref = %v, repoInfo = %v", ref, *repoInfo)
 		return
 	}
 
-	tls, err := useTLS(nTRep, *repoInfo, *endpoint)
-	if err != nil || !tls {
+	creds, err := auth.NewDefaultCreds(repoInfo)
+	if err != nil {
 		return
 	}
 
-	creds, err := auth.NewDefaultCreds(repoInfo)
+	header, err := auth.ChallengeHeader(ctx, nTRep, *repoInfo, *endpoint, creds)
 	if err != nil {
 		return
 	}
 
-	header, err := auth.ChallengeHeader(nTRep, *repoInfo, *endpoint, creds)
-	if err != nil {
+	if header == "" {
+		log.Debug().Msg("The registry does not require authentication.")
 		return
 	}
 
@@ -127,8 +74,9 @@ func authProcedure(ref reference.Named) (
 	if err != nil {
 		return
 	}
+	ch.SetScope(reference.Path(ref), actions...)
 
-	token, err = auth.NewAuthenticator(httpclient.DefaultClient, creds).Authenticate(ch)
+	token, err = auth.NewAuthenticator(httpclient.DefaultClient, creds).Authenticate(ctx, ch)
 	if err != nil {
 		return
 	}
@@ -37,6 +37,7 @@ import (
 // It downloads and decrypts the config and layers if necessary. In fact, only a reader of a tarball
 // is return, with an error changed containing errors from writing the tar
 func constructImageArchive(
+	ctx context.Context,
 	manifest *distribution.ImageManifest,
 	ref auth.Scope,
 	opts *crypto.Opts,
@@ -70,7 +71,7 @@ func constructImageArchive(
 
 	go mkTar(manifest.DirName, contents, pw, errCh)
 
-	if err = loadArchive(pr); err != nil {
+	if err = loadArchive(ctx, pr); err != nil {
 		return
 	}
 
@@ -97,20 +98,20 @@ func writeArchiveManifestFile(
 	return
 }
 
-func loadArchive(pr io.Reader) (err error) {
+func loadArchive(ctx context.Context, pr io.Reader) (err error) {
 	// TODO: stop hardcoding version
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion("1.37"))
 	if err != nil {
-		err = errors.WithStack(err)
+		err = utils.WithKind(utils.KindDaemon, errors.WithStack(err))
 		return
 	}
 
-	resp, err := cli.ImageLoad(context.Background(), pr, false)
-	defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	resp, err := cli.ImageLoad(ctx, pr, false)
 	if err != nil {
-		err = errors.WithStack(err)
+		err = distribution.DaemonError(err)
 		return
 	}
+	defer func() { err = utils.CheckedClose(resp.Body, err) }()
 
 	if resp.Body != nil && resp.JSON {
 		dec := json.NewDecoder(resp.Body)
@@ -133,11 +134,11 @@ func loadArchive(pr io.Reader) (err error) {
 			}
 		}
 
-		return errors.New("image load failed for unknown reasons")
+		return utils.WithKind(utils.KindDaemon, errors.New("image load failed for unknown reasons"))
 	}
 
 	_, err = io.Copy(os.Stderr, resp.Body)
-	return utils.Errors{errors.New("filed to import image"), err}
+	return utils.Errors{utils.WithKind(utils.KindDaemon, errors.New("failed to import image")), err}
 }
 
 func mkTar(dir string, contents []string, w io.WriteCloser, errCh chan<- error) {
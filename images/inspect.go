@@ -0,0 +1,290 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/docker/docker/api/types/container"
+	dimage "github.com/docker/docker/image"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// Inspection describes how the image in a repository is encrypted
+type Inspection struct {
+	Name      string            `json:"name"`
+	MediaType string            `json:"mediaType"`
+	Config    BlobInspection    `json:"config"`
+	Layers    []BlobInspection  `json:"layers"`
+	History   []dimage.History  `json:"history,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// BlobInspection describes how a blob in a manifest is encrypted
+type BlobInspection struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	Size      int64         `json:"size"`
+	Encrypted bool          `json:"encrypted"`
+	Compat    bool          `json:"compat,omitempty"`
+	Algos     crypto.Algos  `json:"algos,omitempty"`
+	Cipher    string        `json:"cipher,omitempty"`
+	Version   int           `json:"version,omitempty"`
+	Iters     int           `json:"iters,omitempty"`
+	SaltSize  int           `json:"saltSize,omitempty"`
+	KeySlots  int           `json:"keySlots,omitempty"`
+	Threshold int           `json:"threshold,omitempty"`
+	KeyID     string        `json:"keyId,omitempty"`
+	Provider  string        `json:"provider,omitempty"`
+}
+
+// InspectImage obtains the manifest of an image from the registry and describes how it is
+// encrypted. If decrypt is true, the config is also downloaded and decrypted so that the
+// history and labels of the image may be reported.
+func InspectImage(
+	ctx context.Context,
+	ref reference.Named,
+	opts *crypto.Opts,
+	decrypt bool,
+	tempDir string,
+) (_ *Inspection, err error) {
+	token, nTRep, endpoint, err := authProcedure(ctx, ref, "pull")
+	if err != nil {
+		return
+	}
+
+	dir := filepath.Join(tempDir, uuid.New().String())
+
+	err = os.MkdirAll(dir, 0700)
+	defer func() { err = utils.CleanUp(dir, err) }()
+	if err != nil {
+		err = errors.Wrapf(err, "dir = %s", dir)
+		return
+	}
+
+	bldr := v2.NewURLBuilder(endpoint.URL, false)
+
+	manifest, err := registry.PullManifest(ctx, token, nTRep, bldr, dir)
+	if err != nil {
+		return
+	}
+
+	insp, err := InspectManifest(ref.String(), manifest)
+	if err != nil {
+		return
+	}
+
+	if !decrypt {
+		return insp, nil
+	}
+
+	// validate manifest to prevent local file injections
+	if err = manifest.Config.GetDigest().Validate(); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	filename, err := registry.PullFromDigest(ctx, token, nTRep, manifest.Config.GetDigest(), bldr, dir)
+	if err != nil {
+		return
+	}
+	manifest.Config.SetFilename(filename)
+
+	config := manifest.Config
+	if eb, ok := config.(distribution.EncryptedBlob); ok {
+		if config, err = eb.DecryptBlob(opts, filename+".dec"); err != nil {
+			return
+		}
+	}
+
+	if err = insp.readConfig(config.GetFilename()); err != nil {
+		return
+	}
+
+	return insp, nil
+}
+
+// InspectManifest describes how the blobs of the manifest of the image name are encrypted,
+// from the crypto objects in the manifest alone
+func InspectManifest(name string, manifest *distribution.ImageManifest) (_ *Inspection, err error) {
+	insp := &Inspection{
+		Name:      name,
+		MediaType: manifest.MediaType,
+		Layers:    make([]BlobInspection, len(manifest.Layers)),
+	}
+
+	if insp.Config, err = inspectBlob(manifest.Config); err != nil {
+		return
+	}
+
+	for i, l := range manifest.Layers {
+		if insp.Layers[i], err = inspectBlob(l); err != nil {
+			return
+		}
+	}
+
+	return insp, nil
+}
+
+// inspectBlob describes the encryption of a single blob
+func inspectBlob(blob distribution.Blob) (bi BlobInspection, err error) {
+	bi = BlobInspection{
+		Digest:    blob.GetDigest(),
+		MediaType: blob.GetMediaType(),
+		Size:      blob.GetSize(),
+	}
+
+	eb, ok := blob.(distribution.EncryptedBlob)
+	if !ok {
+		return
+	}
+
+	ek, err := eb.GetEnCrypto()
+	if err != nil {
+		return
+	}
+
+	bi.Encrypted = true
+	bi.Compat = distribution.IsCompat(eb)
+	bi.Algos = ek.Algos
+	bi.Cipher = ek.Cipher.String()
+	bi.Version = ek.Version
+	bi.Iters = ek.Iters
+	bi.SaltSize = len(ek.Salt)
+	bi.KeySlots = 1
+	if len(ek.Shares) > 0 {
+		bi.KeySlots = len(ek.Shares)
+		bi.Threshold = ek.Threshold
+	}
+	bi.KeyID = ek.KeyID
+	bi.Provider = ek.Provider
+
+	return
+}
+
+// WriteTable writes a human readable table describing insp to w
+func (insp *Inspection) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Name:\t%s\n", insp.Name)
+	fmt.Fprintf(tw, "Media type:\t%s\n\n", insp.MediaType)
+
+	fmt.Fprintln(tw, "BLOB\tDIGEST\tSIZE\tENCRYPTED\tALGORITHMS\tCIPHER\tVERSION\tITERATIONS\tKEY SLOTS\tKEY ID\tCOMPAT")
+	insp.Config.writeRow(tw, "config")
+	for i, l := range insp.Layers {
+		l.writeRow(tw, fmt.Sprintf("layer %d", i))
+	}
+
+	if len(insp.History) > 0 {
+		fmt.Fprintln(tw, "\nCREATED\tCREATED BY\tEMPTY")
+		for _, h := range insp.History {
+			fmt.Fprintf(tw, "%s\t%s\t%t\n", h.Created.Format("2006-01-02 15:04:05"), h.CreatedBy, h.EmptyLayer)
+		}
+	}
+
+	if len(insp.Labels) > 0 {
+		keys := make([]string, 0, len(insp.Labels))
+		for k := range insp.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintln(tw, "\nLABEL\tVALUE")
+		for _, k := range keys {
+			fmt.Fprintf(tw, "%s\t%s\n", k, insp.Labels[k])
+		}
+	}
+
+	return errors.WithStack(tw.Flush())
+}
+
+// writeRow writes the row of the table of WriteTable that describes bi
+func (bi BlobInspection) writeRow(w io.Writer, name string) {
+	if !bi.Encrypted {
+		fmt.Fprintf(w, "%s\t%s\t%d\tno\t%s\n", name, bi.Digest, bi.Size, strings.Repeat("\t-", 7)[1:])
+		return
+	}
+
+	keyID := "-"
+	if bi.Provider != "" {
+		keyID = bi.Provider + ":" + bi.KeyID
+	} else if bi.KeyID != "" {
+		keyID = bi.KeyID
+	}
+
+	keySlots := strconv.Itoa(bi.KeySlots)
+	if bi.Threshold > 0 {
+		keySlots = fmt.Sprintf("%d of %d", bi.Threshold, bi.KeySlots)
+	}
+
+	fmt.Fprintf(
+		w,
+		"%s\t%s\t%d\tyes\t%s\t%s\t%d\t%d\t%s\t%s\t%t\n",
+		name,
+		bi.Digest,
+		bi.Size,
+		bi.Algos,
+		bi.Cipher,
+		bi.Version,
+		bi.Iters,
+		keySlots,
+		keyID,
+		bi.Compat,
+	)
+}
+
+// readConfig reads the history and labels from a plaintext config file
+func (insp *Inspection) readConfig(filename string) (err error) {
+	// filename is always a file that this application created
+	fh, err := os.Open(filename) // #nosec
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	config := &struct {
+		Config  *container.Config `json:"config"`
+		History []dimage.History  `json:"history"`
+	}{}
+
+	if err = json.NewDecoder(fh).Decode(config); err != nil {
+		return errors.Wrapf(err, "filename = %s", filename)
+	}
+
+	insp.History = config.History
+	if config.Config != nil {
+		insp.Labels = config.Config.Labels
+	}
+
+	return
+}
@@ -0,0 +1,213 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/images"
+)
+
+// descriptor is a blob in a manifest with its crypto object in either format
+type descriptor struct {
+	MediaType string           `json:"mediaType"`
+	Size      int64            `json:"size"`
+	Digest    digest.Digest    `json:"digest"`
+	Crypto    *crypto.EnCrypto `json:"crypto,omitempty"`
+	URLs      []string         `json:"urls,omitempty"`
+}
+
+func TestInspectManifest(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	nonce, salt := bytes.Repeat([]byte{1}, 12), bytes.Repeat([]byte{2}, 16)
+	base := func(algos crypto.Algos) crypto.Crypto {
+		return crypto.Crypto{Algos: algos, Nonce: nonce, Salt: salt, Version: crypto.LatestVersion}
+	}
+
+	pbkdf2 := base(crypto.Pbkdf2Aes256Gcm)
+	pbkdf2.Iters = crypto.Pbkdf2Iter
+
+	legacy := pbkdf2
+	legacy.Version = 0
+
+	key := base(crypto.KeyAes256Gcm)
+	key.KeyID = "a1b2c3"
+
+	x25519 := base(crypto.X25519Aes256Gcm)
+	x25519.KeyID = "d4e5f6"
+	x25519.EphemeralKey = bytes.Repeat([]byte{3}, 32)
+
+	hybrid := base(crypto.X25519MlKem768Aes256Gcm)
+	hybrid.KeyID = "a7b8c9"
+	hybrid.EphemeralKey = bytes.Repeat([]byte{4}, 64)
+
+	wrap := base(crypto.WrapAes256Gcm)
+	wrap.KeyID = "transit/crypto-cli"
+	wrap.Provider = "vault"
+
+	shamir := base(crypto.ShamirAes256Gcm)
+	shamir.Cipher = crypto.ChaCha20Poly1305
+	shamir.Nonce = bytes.Repeat([]byte{1}, 24)
+	shamir.Threshold = 2
+	shamir.Shares = []crypto.Share{
+		{Index: 1, KeyID: "d4e5f6", Nonce: shamir.Nonce, Salt: salt, EncShare: []byte{5}},
+		{Index: 2, Nonce: shamir.Nonce, Salt: salt, Iters: crypto.Pbkdf2Iter, EncShare: []byte{6}},
+		{Index: 3, Nonce: shamir.Nonce, Salt: salt, Iters: crypto.Pbkdf2Iter, EncShare: []byte{7}},
+	}
+
+	tests := []struct {
+		c   crypto.Crypto
+		bi  images.BlobInspection
+		row string
+	}{
+		{
+			pbkdf2,
+			images.BlobInspection{Version: 1, Iters: crypto.Pbkdf2Iter, SaltSize: 16, KeySlots: 1},
+			"PBKDF2-AES256-GCM AES256-GCM 1 40000 1 -",
+		},
+		{
+			legacy,
+			images.BlobInspection{Iters: crypto.Pbkdf2Iter, SaltSize: 16, KeySlots: 1},
+			"PBKDF2-AES256-GCM AES256-GCM 0 40000 1 -",
+		},
+		{
+			key,
+			images.BlobInspection{Version: 1, SaltSize: 16, KeySlots: 1, KeyID: "a1b2c3"},
+			"KEY-AES256-GCM AES256-GCM 1 0 1 a1b2c3",
+		},
+		{
+			x25519,
+			images.BlobInspection{Version: 1, SaltSize: 16, KeySlots: 1, KeyID: "d4e5f6"},
+			"X25519-AES256-GCM AES256-GCM 1 0 1 d4e5f6",
+		},
+		{
+			hybrid,
+			images.BlobInspection{Version: 1, SaltSize: 16, KeySlots: 1, KeyID: "a7b8c9"},
+			"X25519-MLKEM768-AES256-GCM AES256-GCM 1 0 1 a7b8c9",
+		},
+		{
+			wrap,
+			images.BlobInspection{Version: 1, SaltSize: 16, KeySlots: 1, KeyID: "transit/crypto-cli", Provider: "vault"},
+			"WRAP-AES256-GCM AES256-GCM 1 0 1 vault:transit/crypto-cli",
+		},
+		{
+			shamir,
+			images.BlobInspection{Version: 1, SaltSize: 16, KeySlots: 3, Threshold: 2},
+			"SHAMIR-AES256-GCM CHACHA20-POLY1305 1 0 2 of 3 -",
+		},
+	}
+
+	plain := descriptor{MediaType: distribution.MediaTypeLayer, Size: 3, Digest: digest.Canonical.FromString("abc")}
+	configDigest := digest.Canonical.FromString("config")
+	layerDigest := digest.Canonical.FromString("layer")
+
+	for _, test := range tests {
+		e := &crypto.EnCrypto{Crypto: test.c, EncKey: []byte{8}}
+
+		u, err := crypto.NewURLCompat(e, &crypto.Opts{})
+		require.NoError(err, test.c.Algos)
+
+		for _, compat := range []bool{false, true} {
+			config := descriptor{MediaType: distribution.MediaTypeImageConfig, Size: 6, Digest: configDigest}
+			layer := descriptor{MediaType: distribution.MediaTypeLayer, Size: 5, Digest: layerDigest}
+			if compat {
+				config.URLs, layer.URLs = []string{u.String()}, []string{u.String()}
+			} else {
+				config.Crypto, layer.Crypto = e, e
+			}
+
+			data, err := json.Marshal(map[string]interface{}{
+				"schemaVersion": 2,
+				"mediaType":     distribution.MediaTypeManifest,
+				"config":        config,
+				"layers":        []descriptor{layer, plain},
+			})
+			require.NoError(err)
+
+			manifest := &distribution.ImageManifest{}
+			require.NoError(json.Unmarshal(data, manifest))
+
+			insp, err := images.InspectManifest("cryptocli/alpine:latest", manifest)
+			if !assert.NoError(err, "%s compat=%t", test.c.Algos, compat) {
+				continue
+			}
+
+			want := test.bi
+			want.Encrypted = true
+			want.Compat = compat
+			want.Algos = test.c.Algos
+			want.Cipher = test.c.Cipher.String()
+
+			wantConfig := want
+			wantConfig.Digest, wantConfig.MediaType, wantConfig.Size = configDigest, distribution.MediaTypeImageConfig, 6
+			wantLayer := want
+			wantLayer.Digest, wantLayer.MediaType, wantLayer.Size = layerDigest, distribution.MediaTypeLayer, 5
+
+			assert.Equal("cryptocli/alpine:latest", insp.Name)
+			assert.Equal(distribution.MediaTypeManifest, insp.MediaType)
+			assert.Equal(wantConfig, insp.Config, "%s compat=%t", test.c.Algos, compat)
+			if assert.Len(insp.Layers, 2) {
+				assert.Equal(wantLayer, insp.Layers[0], "%s compat=%t", test.c.Algos, compat)
+				assert.Equal(
+					images.BlobInspection{Digest: plain.Digest, MediaType: plain.MediaType, Size: plain.Size},
+					insp.Layers[1],
+				)
+			}
+
+			// the table has a row for each blob, with the columns separated by spaces
+			out := &bytes.Buffer{}
+			require.NoError(insp.WriteTable(out))
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			if assert.Len(lines, 7) {
+				assert.Equal([]string{"Name:", "cryptocli/alpine:latest"}, strings.Fields(lines[0]))
+				assert.Equal(
+					strings.Fields("BLOB DIGEST SIZE ENCRYPTED ALGORITHMS CIPHER VERSION ITERATIONS KEY SLOTS KEY ID COMPAT"),
+					strings.Fields(lines[3]),
+				)
+
+				row := test.row + " " + strconv.FormatBool(compat)
+				assert.Equal(strings.Fields("config "+configDigest.String()+" 6 yes "+row), strings.Fields(lines[4]))
+				assert.Equal(strings.Fields("layer 0 "+layerDigest.String()+" 5 yes "+row), strings.Fields(lines[5]))
+				assert.Equal(
+					strings.Fields("layer 1 "+plain.Digest.String()+" 3 no - - - - - - -"),
+					strings.Fields(lines[6]),
+				)
+			}
+
+			// the JSON output omits the fields that do not apply
+			data, err = json.Marshal(insp)
+			require.NoError(err)
+			decoded := &images.Inspection{}
+			require.NoError(json.Unmarshal(data, decoded))
+			assert.Equal(insp, decoded)
+			assert.Contains(
+				string(data),
+				`{"digest":"`+plain.Digest.String()+`","mediaType":"`+plain.MediaType+`","size":3,"encrypted":false}`,
+			)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/docker/distribution/registry/api/v2"
+	dregistry "github.com/docker/docker/registry"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/auth"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// Login checks that the registry with the given index name (i.e. host) accepts username
+// and password and, if so, stores them in the same credential store that is used to
+// authenticate pushes and pulls
+func Login(ctx context.Context, indexName, username, password string) (err error) {
+	if auth.ServerAddress(indexName) == dregistry.IndexServer {
+		indexName = dregistry.IndexName
+	} else {
+		indexName = dregistry.ConvertToHostname(indexName)
+	}
+
+	endpoint, err := registry.LookupEndpoint(ctx, indexName)
+	if err != nil {
+		return
+	}
+
+	bldr := v2.NewURLBuilder(endpoint.URL, false)
+
+	urlStr, err := bldr.BuildBaseURL()
+	if err != nil {
+		return errors.Wrapf(err, "base = %s", endpoint.URL)
+	}
+
+	header, status, err := ping(ctx, urlStr, nil)
+	if err != nil {
+		return
+	}
+
+	switch status {
+	case http.StatusOK:
+		log.Info().Msgf("%s does not require authentication.", indexName)
+	case http.StatusUnauthorized:
+		var ch *auth.Challenge
+		if ch, err = auth.ParseChallengeHeader(header); err != nil {
+			return
+		}
+
+		creds := auth.NewCreds(username, password)
+
+		var token auth.Token
+		if token, err = auth.NewAuthenticator(httpclient.DefaultClient, creds).Authenticate(ctx, ch); err != nil {
+			return
+		}
+
+		// for basic auth this is the only check of the credentials
+		if _, status, err = ping(ctx, urlStr, token); err != nil {
+			return
+		} else if status != http.StatusOK {
+			return utils.NewKindError(utils.KindAuth, "login failed: the registry rejected the credentials")
+		}
+	default:
+		return errors.Errorf("login failed with status: %d", status)
+	}
+
+	return auth.StoreCreds(indexName, username, password)
+}
+
+// ping checks the API version of the registry at urlStr, returning the status and
+// challenge header of the response
+func ping(ctx context.Context, urlStr string, token auth.Token) (header string, status int, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	if err != nil {
+		err = errors.Wrapf(err, "url = %s", urlStr)
+		return
+	}
+	auth.AddToRequest(token, req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return
+	}
+
+	return strings.Join(resp.Header["Www-Authenticate"], ", "), resp.StatusCode, nil
+}
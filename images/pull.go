@@ -15,6 +15,7 @@
 package images
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 
@@ -24,13 +25,15 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
 	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/names"
 	"github.com/Senetas/crypto-cli/utils"
 )
 
 // PullImage pulls an image from the registry
-func PullImage(ref reference.Named, opts *crypto.Opts, tempDir string) (err error) {
-	token, nTRep, endpoint, err := authProcedure(ref)
+func PullImage(ctx context.Context, ref reference.Named, opts *crypto.Opts, tempDir string) (err error) {
+	nTRep, err := names.CastToTagged(ref)
 	if err != nil {
 		return
 	}
@@ -44,17 +47,36 @@ func PullImage(ref reference.Named, opts *crypto.Opts, tempDir string) (err erro
 		return
 	}
 
-	emanifest, err := registry.PullImage(token, nTRep, endpoint, opts, dir)
+	manifest, err := DecryptImage(ctx, ref, opts, dir)
 	if err != nil {
 		return
 	}
 
-	s := spinner.StartNew("Decrypting...")
-	manifest, err := emanifest.Decrypt(nTRep, opts)
+	return constructImageArchive(ctx, manifest, nTRep, opts)
+}
+
+// DecryptImage downloads an image from the registry into dir and decrypts it.
+// The returned manifest references the plaintext config and (uncompressed)
+// layers in dir. It is the caller's responsibility to clean up dir.
+func DecryptImage(
+	ctx context.Context,
+	ref reference.Named,
+	opts *crypto.Opts,
+	dir string,
+) (manifest *distribution.ImageManifest, err error) {
+	token, nTRep, endpoint, err := authProcedure(ctx, ref, "pull")
 	if err != nil {
 		return
 	}
+
+	emanifest, err := registry.PullImage(ctx, token, nTRep, endpoint, opts, dir)
+	if err != nil {
+		return
+	}
+
+	s := spinner.StartNew("Decrypting...")
+	manifest, err = emanifest.Decrypt(ctx, nTRep, opts)
 	s.Stop()
 
-	return constructImageArchive(manifest, nTRep, opts)
+	return
 }
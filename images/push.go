@@ -15,34 +15,67 @@
 package images
 
 import (
+	"context"
+
 	"github.com/docker/distribution/reference"
+	dregistry "github.com/docker/docker/registry"
 	"github.com/janeczku/go-spinner"
 
 	"github.com/Senetas/crypto-cli/crypto"
 	"github.com/Senetas/crypto-cli/distribution"
 	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/auth"
+	"github.com/Senetas/crypto-cli/registry/names"
 	"github.com/Senetas/crypto-cli/utils"
 )
 
 // PushImage encrypts then pushes an image
-func PushImage(ref reference.Named, opts *crypto.Opts, tempDir string) (err error) {
-	token, nTRep, endpoint, err := authProcedure(ref)
+func PushImage(ctx context.Context, ref reference.Named, opts *crypto.Opts, tempDir string) (err error) {
+	token, nTRep, endpoint, err := authProcedure(ctx, ref, "pull", "push")
 	if err != nil {
 		return err
 	}
 
-	manifest, err := distribution.NewManifest(nTRep, opts, tempDir)
+	manifest, err := distribution.NewManifest(ctx, nTRep, opts, tempDir)
 	if err != nil {
 		return err
 	}
 	defer func() { err = utils.CleanUp(manifest.DirName, err) }()
 
+	return encryptAndPush(ctx, token, nTRep, endpoint, manifest, opts)
+}
+
+// EncryptImage encrypts an unencrypted manifest, such as one created by
+// distribution.NewManifestFromArchive, then pushes it to the registry as ref.
+// It is the caller's responsibility to clean up manifest.DirName.
+func EncryptImage(
+	ctx context.Context,
+	ref reference.Named,
+	manifest *distribution.ImageManifest,
+	opts *crypto.Opts,
+) error {
+	token, nTRep, endpoint, err := authProcedure(ctx, ref, "pull", "push")
+	if err != nil {
+		return err
+	}
+
+	return encryptAndPush(ctx, token, nTRep, endpoint, manifest, opts)
+}
+
+func encryptAndPush(
+	ctx context.Context,
+	token auth.Token,
+	nTRep names.NamedTaggedRepository,
+	endpoint *dregistry.APIEndpoint,
+	manifest *distribution.ImageManifest,
+	opts *crypto.Opts,
+) error {
 	s := spinner.StartNew("Encrypting...")
-	encManifest, err := manifest.Encrypt(nTRep, opts)
+	encManifest, err := manifest.Encrypt(ctx, nTRep, opts)
 	s.Stop()
 	if err != nil {
 		return err
 	}
 
-	return registry.PushImage(token, nTRep, encManifest, endpoint)
+	return registry.PushImage(ctx, token, nTRep, encManifest, endpoint)
 }
@@ -0,0 +1,184 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/auth"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// VerifyReport is the result of verifying each blob of an image
+type VerifyReport struct {
+	Name  string
+	Blobs []BlobReport
+}
+
+// BlobReport is the result of verifying a single blob. Err is nil if the blob downloaded,
+// matched its digest, decrypted and (for layers) matched its diff ID in the config.
+type BlobReport struct {
+	Name   string
+	Digest digest.Digest
+	DiffID digest.Digest
+	Err    error
+}
+
+// Passed reports whether every blob was verified
+func (r *VerifyReport) Passed() bool {
+	for _, b := range r.Blobs {
+		if b.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyImage downloads every blob of an image and checks that it matches its digest, that it
+// decrypts and authenticates under opts and that the uncompressed layers match the diff IDs
+// in the config. Nothing is loaded into docker and plaintext layers are never written to disk.
+// An error is returned only if the manifest could not be obtained; failures of individual
+// blobs are recorded in the report.
+func VerifyImage(
+	ctx context.Context,
+	ref reference.Named,
+	opts *crypto.Opts,
+	tempDir string,
+) (report *VerifyReport, err error) {
+	token, nTRep, endpoint, err := authProcedure(ctx, ref, "pull")
+	if err != nil {
+		return
+	}
+
+	dir := filepath.Join(tempDir, uuid.New().String())
+
+	err = os.MkdirAll(dir, 0700)
+	defer func() { err = utils.CleanUp(dir, err) }()
+	if err != nil {
+		err = errors.Wrapf(err, "dir = %s", dir)
+		return
+	}
+
+	bldr := v2.NewURLBuilder(endpoint.URL, false)
+
+	manifest, err := registry.PullManifest(ctx, token, nTRep, bldr, dir)
+	if err != nil {
+		return
+	}
+	log.Info().Msg("Manifest obtained.")
+
+	v := &verifier{token: token, ref: nTRep, bldr: bldr, dir: dir, opts: opts}
+
+	report = &VerifyReport{Name: ref.String(), Blobs: make([]BlobReport, 0, len(manifest.Layers)+1)}
+
+	diffIDs, cerr := v.config(ctx, manifest.Config)
+	report.Blobs = append(report.Blobs, BlobReport{
+		Name:   "config",
+		Digest: manifest.Config.GetDigest(),
+		Err:    cerr,
+	})
+
+	if cerr == nil && len(diffIDs) != len(manifest.Layers) {
+		report.Blobs[0].Err = errors.Errorf(
+			"config lists %d layers but the manifest has %d",
+			len(diffIDs),
+			len(manifest.Layers),
+		)
+	}
+
+	for i, l := range manifest.Layers {
+		// a cancelled verification has no meaningful result
+		if err = errors.WithStack(ctx.Err()); err != nil {
+			return nil, err
+		}
+
+		br := BlobReport{Name: fmt.Sprintf("layer %d", i), Digest: l.GetDigest()}
+		if br.DiffID, br.Err = v.layer(ctx, l); br.Err == nil && i < len(diffIDs) && br.DiffID != diffIDs[i] {
+			br.Err = errors.Errorf("diff ID does not match the config: %s", diffIDs[i])
+		}
+		report.Blobs = append(report.Blobs, br)
+	}
+
+	return report, nil
+}
+
+// verifier holds what is needed to download and check the blobs of an image
+type verifier struct {
+	token auth.Token
+	ref   names.NamedTaggedRepository
+	bldr  *v2.URLBuilder
+	dir   string
+	opts  *crypto.Opts
+}
+
+// download downloads a blob, verifying it against its digest
+func (v *verifier) download(ctx context.Context, blob distribution.Blob) (err error) {
+	// validate manifest to prevent local file injections
+	if err = blob.GetDigest().Validate(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.Info().Msgf("Downloading: %s.", blob.GetDigest())
+	filename, err := registry.PullFromDigest(ctx, v.token, v.ref, blob.GetDigest(), v.bldr, v.dir)
+	if err != nil {
+		return
+	}
+	blob.SetFilename(filename)
+
+	return
+}
+
+// config downloads and decrypts the config and returns its diff IDs
+func (v *verifier) config(ctx context.Context, blob distribution.Blob) (_ []digest.Digest, err error) {
+	if err = v.download(ctx, blob); err != nil {
+		return
+	}
+
+	filename := blob.GetFilename()
+	if eb, ok := blob.(distribution.EncryptedBlob); ok {
+		var db distribution.DecryptedBlob
+		if db, err = eb.DecryptBlob(v.opts, filename+".dec"); err != nil {
+			return
+		}
+		filename = db.GetFilename()
+	}
+
+	return distribution.DiffIDs(filename)
+}
+
+// layer downloads, decrypts and decompresses a layer and returns its diff ID.
+// The downloaded file is removed afterwards.
+func (v *verifier) layer(ctx context.Context, blob distribution.Blob) (_ digest.Digest, err error) {
+	if err = v.download(ctx, blob); err != nil {
+		return
+	}
+	defer func() { err = utils.CleanUp(blob.GetFilename(), err) }()
+
+	return distribution.DiffID(blob, v.opts)
+}
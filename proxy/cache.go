@@ -0,0 +1,177 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// blobCache stores plaintext blobs on disk, encrypted under a key that only
+// lives in memory for the lifetime of the cache
+type blobCache struct {
+	dir   string
+	key   crypto.Secret
+	mu    sync.RWMutex
+	sizes map[digest.Digest]int64
+	// puts serialises the puts of each blob
+	puts map[digest.Digest]*sync.Mutex
+}
+
+// newBlobCache creates a cache that stores its files in dir
+func newBlobCache(dir string) (c *blobCache, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		err = errors.Wrapf(err, "could not create: %s", dir)
+		return
+	}
+
+	c = &blobCache{
+		dir:   dir,
+		key:   crypto.NewSecret(32),
+		sizes: make(map[digest.Digest]int64),
+		puts:  make(map[digest.Digest]*sync.Mutex),
+	}
+
+	if _, err = rand.Read(c.key); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	return
+}
+
+// has reports whether the blob with digest d is in the cache and its plaintext size
+func (c *blobCache) has(d digest.Digest) (size int64, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	size, ok = c.sizes[d]
+	return
+}
+
+// put encrypts the plaintext in filename into the cache under the digest d. The
+// ciphertext is written to a temporary file that is renamed into place, so that a
+// blob in the cache is never partially written.
+func (c *blobCache) put(d digest.Digest, filename string) (err error) {
+	if err = d.Validate(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	unlock := c.lockPut(d)
+	defer unlock()
+
+	if _, ok := c.has(d); ok {
+		return
+	}
+
+	// filename is always a file that this application created
+	in, err := os.Open(filename) // #nosec
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(in, err) }()
+
+	out, err := ioutil.TempFile(c.dir, d.Encoded()+".")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(out.Name())
+		}
+	}()
+
+	// closing the encrypting writer also closes out
+	ew, err := crypto.EncBlobWriter(out, crypto.Aes256Gcm, c.key)
+	if err != nil {
+		return utils.CheckedClose(out, err)
+	}
+
+	size, err := io.Copy(ew, in)
+	if err = utils.CheckedClose(ew, errors.WithStack(err)); err != nil {
+		return
+	}
+
+	// the digest has been validated so this cannot escape the cache directory
+	fn := filepath.Join(c.dir, d.Encoded())
+	if err = os.Rename(out.Name(), fn); err != nil {
+		return errors.Wrapf(err, "filename = %s", fn)
+	}
+
+	c.mu.Lock()
+	c.sizes[d] = size
+	c.mu.Unlock()
+
+	return
+}
+
+// lockPut waits until no other put of the blob with digest d is in progress and returns
+// the function that lets the next one proceed
+func (c *blobCache) lockPut(d digest.Digest) func() {
+	c.mu.Lock()
+	l, ok := c.puts[d]
+	if !ok {
+		l = new(sync.Mutex)
+		c.puts[d] = l
+	}
+	c.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// get returns a reader of the plaintext of the blob with digest d.
+// It is the caller's responsibility to close the reader.
+func (c *blobCache) get(d digest.Digest) (_ io.ReadCloser, size int64, err error) {
+	size, ok := c.has(d)
+	if !ok {
+		return nil, 0, errors.Errorf("blob %s is not in the cache", d)
+	}
+
+	fh, err := os.Open(filepath.Join(c.dir, d.Encoded()))
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	dr, err := crypto.DecBlobReader(fh, crypto.Aes256Gcm, c.key)
+	if err != nil {
+		return nil, 0, utils.CheckedClose(fh, err)
+	}
+
+	return &readCloser{Reader: dr, Closer: fh}, size, nil
+}
+
+// clear deletes the cache from disk and wipes its key. The cache may not be used afterwards.
+func (c *blobCache) clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sizes = make(map[digest.Digest]int64)
+	c.key.Wipe()
+	return utils.CleanUp(c.dir, nil)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,119 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/gorilla/mux"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/registry"
+)
+
+// serveRouter dispatches a request to router with the headers common to all responses
+func serveRouter(router *mux.Router, w http.ResponseWriter, r *http.Request) {
+	log.Debug().Msgf("%s %s", r.Method, r.URL)
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	router.ServeHTTP(w, r)
+}
+
+// serveBase responds to the API version check
+func serveBase(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("{}"))
+}
+
+// serveBlob serves a blob from the cache
+func (c *blobCache) serveBlob(w http.ResponseWriter, r *http.Request) {
+	if !isReadMethod(r) {
+		serveUnsupported(w, r)
+		return
+	}
+
+	d, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		serveError(w, v2.ErrorCodeDigestInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	if _, ok := c.has(d); !ok {
+		serveError(w, v2.ErrorCodeBlobUnknown.WithDetail(d))
+		return
+	}
+
+	rc, size, err := c.get(d)
+	if err != nil {
+		serveError(w, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+		return
+	}
+	defer func() {
+		if err := rc.Close(); err != nil {
+			log.Error().Err(err).Msgf("could not close cached blob %s", d)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Docker-Content-Digest", d.String())
+	w.Header().Set("Etag", `"`+d.String()+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodGet {
+		if _, err = io.Copy(w, rc); err != nil {
+			log.Error().Err(err).Msgf("could not serve blob %s", d)
+		}
+	}
+}
+
+func isReadMethod(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+func serveUnsupported(w http.ResponseWriter, r *http.Request) {
+	serveError(w, errcode.ErrorCodeUnsupported.WithDetail(r.Method+" "+r.URL.Path))
+}
+
+func serveError(w http.ResponseWriter, err error) {
+	if err2 := errcode.ServeJSON(w, err); err2 != nil {
+		log.Error().Err(err2).Msg("could not write error response")
+	}
+}
+
+// upstreamError converts an error from the upstream registry into the errors that it
+// reported, so that clients of the proxy receive the same codes
+func upstreamError(err error) error {
+	apiErr, ok := registry.AsAPIError(err)
+	if !ok || len(apiErr.Errors) == 0 {
+		return errcode.ErrorCodeUnknown.WithDetail(err.Error())
+	}
+
+	errs := make(errcode.Errors, len(apiErr.Errors))
+	for i, e := range apiErr.Errors {
+		ee := errcode.ParseErrorCode(string(e.Code)).WithMessage(e.Message)
+		if len(e.Detail) > 0 {
+			ee = ee.WithDetail(e.Detail)
+		}
+		errs[i] = ee
+	}
+
+	return errs
+}
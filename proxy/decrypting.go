@@ -0,0 +1,242 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// DecryptingProxy implements the read side of the registry v2 API. It serves
+// decrypted copies of the images in an upstream registry so that they may be
+// consumed by clients that know nothing about encryption, e.g. docker pull.
+type DecryptingProxy struct {
+	upstream string
+	opts     *crypto.Opts
+	tempDir  string
+	router   *mux.Router
+	cache    *blobCache
+
+	// fetchMu serialises fetches from upstream, in particular passphrase prompts
+	fetchMu   sync.Mutex
+	mu        sync.RWMutex
+	manifests map[digest.Digest][]byte
+}
+
+// NewDecryptingProxy creates a proxy for the registry upstream (e.g. docker.io).
+// Decrypted blobs are cached in a subdirectory of tempDir.
+func NewDecryptingProxy(
+	upstream string,
+	opts *crypto.Opts,
+	tempDir string,
+) (p *DecryptingProxy, err error) {
+	if strings.Contains(upstream, "://") {
+		err = errors.Errorf("upstream should be a registry host, not a url: %s", upstream)
+		return
+	}
+
+	cache, err := newBlobCache(filepath.Join(tempDir, uuid.New().String()))
+	if err != nil {
+		return
+	}
+
+	p = &DecryptingProxy{
+		upstream:  strings.TrimSuffix(upstream, "/"),
+		opts:      opts,
+		tempDir:   tempDir,
+		router:    v2.Router(),
+		cache:     cache,
+		manifests: make(map[digest.Digest][]byte),
+	}
+
+	p.router.Get(v2.RouteNameBase).HandlerFunc(serveBase)
+	p.router.Get(v2.RouteNameManifest).HandlerFunc(p.serveManifest)
+	p.router.Get(v2.RouteNameBlob).HandlerFunc(p.cache.serveBlob)
+	for _, name := range []string{
+		v2.RouteNameTags,
+		v2.RouteNameCatalog,
+		v2.RouteNameBlobUpload,
+		v2.RouteNameBlobUploadChunk,
+	} {
+		p.router.Get(name).HandlerFunc(serveUnsupported)
+	}
+
+	return
+}
+
+// ServeHTTP implements http.Handler
+func (p *DecryptingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveRouter(p.router, w, r)
+}
+
+// Close deletes all cached blobs
+func (p *DecryptingProxy) Close() error {
+	return p.cache.clear()
+}
+
+func (p *DecryptingProxy) serveManifest(w http.ResponseWriter, r *http.Request) {
+	if !isReadMethod(r) {
+		serveUnsupported(w, r)
+		return
+	}
+
+	vars := mux.Vars(r)
+	name, ref := vars["name"], vars["reference"]
+
+	var (
+		dgst digest.Digest
+		body []byte
+		err  error
+	)
+
+	if d, err2 := digest.Parse(ref); err2 == nil {
+		var ok bool
+		p.mu.RLock()
+		body, ok = p.manifests[d]
+		p.mu.RUnlock()
+		if !ok {
+			serveError(w, v2.ErrorCodeManifestUnknown.WithDetail(ref))
+			return
+		}
+		dgst = d
+	} else {
+		p.fetchMu.Lock()
+		dgst, body, err = p.fetch(r.Context(), name, ref)
+		p.fetchMu.Unlock()
+		if err != nil {
+			log.Error().Err(err).Msgf("could not obtain %s:%s from %s", name, ref, p.upstream)
+			serveError(w, upstreamError(err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", distribution.MediaTypeManifest)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.Header().Set("Etag", `"`+dgst.String()+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(body)
+	}
+}
+
+// fetch downloads and decrypts name:tag from upstream, stores the plaintext blobs in
+// the cache and returns the digest and body of a plaintext manifest that references them
+func (p *DecryptingProxy) fetch(
+	ctx context.Context,
+	name, tag string,
+) (dgst digest.Digest, body []byte, err error) {
+	ref, err := reference.ParseNormalizedNamed(p.upstream + "/" + name + ":" + tag)
+	if err != nil {
+		err = errors.Wrapf(err, "name = %s, tag = %s", name, tag)
+		return
+	}
+
+	log.Info().Msgf("Obtaining manifest for image: %s", ref)
+
+	dir := filepath.Join(p.tempDir, uuid.New().String())
+
+	err = os.MkdirAll(dir, 0700)
+	defer func() { err = utils.CleanUp(dir, err) }()
+	if err != nil {
+		err = errors.Wrapf(err, "dir = %s", dir)
+		return
+	}
+
+	manifest, err := images.DecryptImage(ctx, ref, p.opts, dir)
+	if err != nil {
+		return
+	}
+
+	plain, err := p.cacheManifest(manifest)
+	if err != nil {
+		return
+	}
+
+	if body, err = json.Marshal(plain); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	dgst = digest.Canonical.FromBytes(body)
+
+	p.mu.Lock()
+	p.manifests[dgst] = body
+	p.mu.Unlock()
+
+	log.Info().Msgf("Serving %s as %s", ref, dgst)
+
+	return
+}
+
+// cacheManifest moves the decrypted blobs of manifest into the cache, compressing
+// the layers, and returns a plaintext manifest that references them
+func (p *DecryptingProxy) cacheManifest(
+	manifest *distribution.ImageManifest,
+) (plain *distribution.ImageManifest, err error) {
+	plain = &distribution.ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     distribution.MediaTypeManifest,
+		Layers:        make([]distribution.Blob, len(manifest.Layers)),
+	}
+
+	config := manifest.Config
+	if err = p.cache.put(config.GetDigest(), config.GetFilename()); err != nil {
+		return
+	}
+	plain.Config = distribution.NewPlainConfig("", config.GetDigest(), config.GetSize())
+
+	for i, l := range manifest.Layers {
+		dl, ok := l.(distribution.DecompressedBlob)
+		if !ok {
+			err = errors.Errorf("layer is of wrong type: %T", l)
+			return
+		}
+
+		var cl distribution.CompressedBlob
+		cl, err = dl.Compress(dl.GetFilename() + ".gz")
+		if err != nil {
+			return
+		}
+
+		if err = p.cache.put(cl.GetDigest(), cl.GetFilename()); err != nil {
+			return
+		}
+
+		plain.Layers[i] = distribution.NewPlainLayer("", cl.GetDigest(), cl.GetSize())
+	}
+
+	return
+}
@@ -0,0 +1,149 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/proxy"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestDecryptingProxy(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm}
+	opts.SetPassphrase("hunter2")
+
+	_, err := proxy.NewDecryptingProxy("https://docker.io", opts, dir)
+	require.Error(err)
+
+	p, err := proxy.NewDecryptingProxy("docker.io", opts, dir)
+	require.NoError(err)
+	defer func() { assert.NoError(p.Close()) }()
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	unknown := digest.Canonical.FromString("unknown")
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		code   string
+	}{
+		{"GET", "/v2/", http.StatusOK, ""},
+		{"GET", "/v2/cryptocli/alpine/manifests/" + unknown.String(), http.StatusNotFound, "MANIFEST_UNKNOWN"},
+		{"HEAD", "/v2/cryptocli/alpine/blobs/" + unknown.String(), http.StatusNotFound, ""},
+		{"GET", "/v2/cryptocli/alpine/blobs/" + unknown.String(), http.StatusNotFound, "BLOB_UNKNOWN"},
+		{"PUT", "/v2/cryptocli/alpine/manifests/latest", http.StatusMethodNotAllowed, "UNSUPPORTED"},
+		{"POST", "/v2/cryptocli/alpine/blobs/uploads/", http.StatusMethodNotAllowed, "UNSUPPORTED"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, server.URL+test.path, nil)
+		if !assert.NoError(err) {
+			continue
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(err) {
+			continue
+		}
+
+		assert.Equal(test.status, resp.StatusCode, "%s %s", test.method, test.path)
+		assert.Equal("registry/2.0", resp.Header.Get("Docker-Distribution-API-Version"))
+
+		if test.code != "" {
+			var body struct {
+				Errors []struct {
+					Code string `json:"code"`
+				} `json:"errors"`
+			}
+			if assert.NoError(json.NewDecoder(resp.Body).Decode(&body)) && assert.Len(body.Errors, 1) {
+				assert.Equal(test.code, body.Errors[0].Code)
+			}
+		}
+
+		assert.NoError(resp.Body.Close())
+	}
+}
+
+func TestDecryptingProxyUpstreamError(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm}
+	opts.SetPassphrase("hunter2")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v2/" {
+			rw.WriteHeader(http.StatusOK)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusNotFound)
+		_, _ = rw.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown upstream","detail":{"Tag":"latest"}}]}`))
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	require.NoError(err)
+
+	p, err := proxy.NewDecryptingProxy(u.Host, opts, dir)
+	require.NoError(err)
+	defer func() { assert.NoError(p.Close()) }()
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v2/cryptocli/alpine/manifests/latest")
+	require.NoError(err)
+	defer func() { assert.NoError(resp.Body.Close()) }()
+
+	// the error reported by upstream is passed on
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if assert.NoError(json.NewDecoder(resp.Body).Decode(&body)) && assert.Len(body.Errors, 1) {
+		assert.Equal("MANIFEST_UNKNOWN", body.Errors[0].Code)
+		assert.Equal("manifest unknown upstream", body.Errors[0].Message)
+	}
+}
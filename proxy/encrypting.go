@@ -0,0 +1,493 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+const (
+	// mediaTypeOCIManifest is the mediaType of an OCI image manifest, which has the same
+	// structure as a docker image manifest schema v2.2
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	// maxManifestSize is the largest manifest that will be accepted
+	maxManifestSize = 4 << 20
+)
+
+// EncryptingProxy implements the write side of the registry v2 API. It buffers the
+// blobs and manifests pushed to it by clients that know nothing about encryption,
+// e.g. docker push, then encrypts the image and pushes it to an upstream registry.
+type EncryptingProxy struct {
+	upstream string
+	opts     *crypto.Opts
+	tempDir  string
+	router   *mux.Router
+	blobs    *blobCache
+
+	// pushMu serialises pushes to upstream
+	pushMu  sync.Mutex
+	mu      sync.Mutex
+	uploads map[string]*upload
+}
+
+// upload is a blob upload in progress. Its chunks may be sent concurrently, so mu is held
+// while the file is written or read and while size is used.
+type upload struct {
+	filename string
+	mu       sync.Mutex
+	size     int64
+}
+
+// descriptor references a blob in a manifest
+type descriptor struct {
+	MediaType string        `json:"mediaType"`
+	Size      int64         `json:"size"`
+	Digest    digest.Digest `json:"digest"`
+}
+
+// plainManifest is an unencrypted docker image manifest schema v2.2
+type plainManifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+// NewEncryptingProxy creates a proxy for the registry upstream (e.g. docker.io).
+// Uploaded blobs are buffered in a subdirectory of tempDir.
+func NewEncryptingProxy(
+	upstream string,
+	opts *crypto.Opts,
+	tempDir string,
+) (p *EncryptingProxy, err error) {
+	if strings.Contains(upstream, "://") {
+		err = errors.Errorf("upstream should be a registry host, not a url: %s", upstream)
+		return
+	}
+
+	dir := filepath.Join(tempDir, uuid.New().String())
+
+	blobs, err := newBlobCache(filepath.Join(dir, "blobs"))
+	if err != nil {
+		return
+	}
+
+	p = &EncryptingProxy{
+		upstream: strings.TrimSuffix(upstream, "/"),
+		opts:     opts,
+		tempDir:  dir,
+		router:   v2.Router(),
+		blobs:    blobs,
+		uploads:  make(map[string]*upload),
+	}
+
+	p.router.Get(v2.RouteNameBase).HandlerFunc(serveBase)
+	p.router.Get(v2.RouteNameManifest).HandlerFunc(p.serveManifest)
+	p.router.Get(v2.RouteNameBlob).HandlerFunc(p.blobs.serveBlob)
+	p.router.Get(v2.RouteNameBlobUpload).HandlerFunc(p.serveUpload)
+	p.router.Get(v2.RouteNameBlobUploadChunk).HandlerFunc(p.serveUploadChunk)
+	p.router.Get(v2.RouteNameTags).HandlerFunc(serveUnsupported)
+	p.router.Get(v2.RouteNameCatalog).HandlerFunc(serveUnsupported)
+
+	return
+}
+
+// ServeHTTP implements http.Handler
+func (p *EncryptingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveRouter(p.router, w, r)
+}
+
+// Close deletes all buffered blobs and uploads
+func (p *EncryptingProxy) Close() error {
+	p.mu.Lock()
+	p.uploads = make(map[string]*upload)
+	p.mu.Unlock()
+	return utils.CleanUp(p.tempDir, p.blobs.clear())
+}
+
+// serveUpload starts a blob upload. Cross repository mounts are not supported,
+// so a mount request is treated as a request to start an upload.
+func (p *EncryptingProxy) serveUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		serveUnsupported(w, r)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	id := uuid.New().String()
+	u := &upload{filename: filepath.Join(p.tempDir, id)}
+
+	fh, err := os.OpenFile(u.filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err == nil {
+		err = fh.Close()
+	}
+	if err != nil {
+		serveError(w, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+		return
+	}
+
+	p.mu.Lock()
+	p.uploads[id] = u
+	p.mu.Unlock()
+
+	// a monolithic upload
+	if r.URL.Query().Get("digest") != "" {
+		p.completeUpload(w, r, name, id, u)
+		return
+	}
+
+	p.serveUploadStatus(w, name, id, u, http.StatusAccepted)
+}
+
+// serveUploadChunk handles the requests for a blob upload that is in progress
+func (p *EncryptingProxy) serveUploadChunk(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, id := vars["name"], vars["uuid"]
+
+	p.mu.Lock()
+	u, ok := p.uploads[id]
+	p.mu.Unlock()
+	if !ok {
+		serveError(w, v2.ErrorCodeBlobUploadUnknown.WithDetail(id))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		p.serveUploadStatus(w, name, id, u, http.StatusNoContent)
+	case http.MethodPatch:
+		if err := u.append(r.Body); err != nil {
+			serveError(w, v2.ErrorCodeBlobUploadInvalid.WithDetail(err.Error()))
+			return
+		}
+		p.serveUploadStatus(w, name, id, u, http.StatusAccepted)
+	case http.MethodPut:
+		p.completeUpload(w, r, name, id, u)
+	case http.MethodDelete:
+		if err := p.cancelUpload(id, u); err != nil {
+			serveError(w, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		serveUnsupported(w, r)
+	}
+}
+
+// serveUploadStatus responds with the progress of an upload
+func (p *EncryptingProxy) serveUploadStatus(
+	w http.ResponseWriter,
+	name, id string,
+	u *upload,
+	status int,
+) {
+	end := u.length() - 1
+	if end < 0 {
+		end = 0
+	}
+	w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+id)
+	w.Header().Set("Range", "0-"+strconv.FormatInt(end, 10))
+	w.Header().Set("Docker-Upload-UUID", id)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(status)
+}
+
+// completeUpload appends the final chunk (if any) to the upload, verifies it against the
+// digest in the query and moves it into the blob store
+func (p *EncryptingProxy) completeUpload(
+	w http.ResponseWriter,
+	r *http.Request,
+	name, id string,
+	u *upload,
+) {
+	d, err := digest.Parse(r.URL.Query().Get("digest"))
+	if err != nil {
+		serveError(w, v2.ErrorCodeDigestInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	if err = u.append(r.Body); err != nil {
+		serveError(w, v2.ErrorCodeBlobUploadInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	if err = u.verify(d); err != nil {
+		_ = p.cancelUpload(id, u)
+		serveError(w, v2.ErrorCodeDigestInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	if err = p.blobs.put(d, u.filename); err != nil {
+		_ = p.cancelUpload(id, u)
+		serveError(w, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+		return
+	}
+
+	if err = p.cancelUpload(id, u); err != nil {
+		log.Error().Err(err).Msgf("could not remove upload %s", id)
+	}
+
+	w.Header().Set("Location", "/v2/"+name+"/blobs/"+d.String())
+	w.Header().Set("Docker-Content-Digest", d.String())
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// cancelUpload forgets an upload and removes its file
+func (p *EncryptingProxy) cancelUpload(id string, u *upload) error {
+	p.mu.Lock()
+	delete(p.uploads, id)
+	p.mu.Unlock()
+	return errors.WithStack(os.Remove(u.filename))
+}
+
+// append writes the data in r to the end of the upload
+func (u *upload) append(r io.Reader) (err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	fh, err := os.OpenFile(u.filename, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	n, err := io.Copy(fh, r)
+	u.size += n
+	return errors.WithStack(err)
+}
+
+// length returns the number of bytes uploaded so far
+func (u *upload) length() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.size
+}
+
+// verify checks that the upload matches the digest d
+func (u *upload) verify(d digest.Digest) (err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	fh, err := os.Open(u.filename)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	vw := d.Verifier()
+	if _, err = io.Copy(vw, fh); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !vw.Verified() {
+		return errors.Errorf("upload does not match digest %s", d)
+	}
+
+	return nil
+}
+
+// serveManifest accepts a manifest, then encrypts and pushes the image it references upstream
+func (p *EncryptingProxy) serveManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		serveUnsupported(w, r)
+		return
+	}
+
+	vars := mux.Vars(r)
+	name, tag := vars["name"], vars["reference"]
+
+	if _, err := digest.Parse(tag); err == nil {
+		serveError(w, v2.ErrorCodeTagInvalid.WithDetail("manifests must be pushed by tag"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxManifestSize))
+	if err != nil {
+		serveError(w, v2.ErrorCodeManifestInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	manifest := &plainManifest{}
+	if err = json.Unmarshal(body, manifest); err != nil {
+		serveError(w, v2.ErrorCodeManifestInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	if manifest.MediaType == "" {
+		manifest.MediaType = r.Header.Get("Content-Type")
+	}
+
+	switch manifest.MediaType {
+	case distribution.MediaTypeManifest, mediaTypeOCIManifest:
+	default:
+		serveError(w, v2.ErrorCodeManifestInvalid.WithDetail(
+			"unsupported manifest media type: "+manifest.MediaType,
+		))
+		return
+	}
+
+	for _, d := range append([]descriptor{manifest.Config}, manifest.Layers...) {
+		if _, ok := p.blobs.has(d.Digest); !ok {
+			serveError(w, v2.ErrorCodeManifestBlobUnknown.WithDetail(d.Digest))
+			return
+		}
+	}
+
+	p.pushMu.Lock()
+	err = p.push(r.Context(), name, tag, manifest)
+	p.pushMu.Unlock()
+	if err != nil {
+		log.Error().Err(err).Msgf("could not push %s:%s to %s", name, tag, p.upstream)
+		serveError(w, upstreamError(err))
+		return
+	}
+
+	dgst := digest.Canonical.FromBytes(body)
+	w.Header().Set("Location", "/v2/"+name+"/manifests/"+dgst.String())
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// push encrypts the image referenced by manifest and pushes it upstream as name:tag
+func (p *EncryptingProxy) push(
+	ctx context.Context,
+	name, tag string,
+	manifest *plainManifest,
+) (err error) {
+	ref, err := reference.ParseNormalizedNamed(p.upstream + "/" + name + ":" + tag)
+	if err != nil {
+		return errors.Wrapf(err, "name = %s, tag = %s", name, tag)
+	}
+
+	log.Info().Msgf("Pushing image: %s.", ref)
+
+	dir := filepath.Join(p.tempDir, uuid.New().String())
+
+	err = os.MkdirAll(dir, 0700)
+	defer func() { err = utils.CleanUp(dir, err) }()
+	if err != nil {
+		return errors.Wrapf(err, "dir = %s", dir)
+	}
+
+	if err = p.mkArchive(dir, ref, manifest); err != nil {
+		return
+	}
+
+	m, err := distribution.NewManifestFromArchive(dir, p.opts)
+	if err != nil {
+		return
+	}
+
+	return images.EncryptImage(ctx, ref, m, p.opts)
+}
+
+// mkArchive extracts the blobs referenced by manifest into dir, laid out as in the
+// archive produced by docker save
+func (p *EncryptingProxy) mkArchive(
+	dir string,
+	ref reference.Named,
+	manifest *plainManifest,
+) (err error) {
+	archiveManifest := &distribution.ArchiveManifest{
+		Config:   manifest.Config.Digest.Encoded() + ".json",
+		RepoTags: []string{ref.String()},
+		Layers:   make([]string, len(manifest.Layers)),
+	}
+
+	if err = p.extractBlob(manifest.Config, filepath.Join(dir, archiveManifest.Config), false); err != nil {
+		return
+	}
+
+	for i, l := range manifest.Layers {
+		archiveManifest.Layers[i] = filepath.Join(l.Digest.Encoded(), "layer.tar")
+
+		if err = os.MkdirAll(filepath.Join(dir, l.Digest.Encoded()), 0700); err != nil {
+			return errors.WithStack(err)
+		}
+
+		compressed := l.MediaType != distribution.MediaTypeUncompressedLayer
+		if err = p.extractBlob(l, filepath.Join(dir, archiveManifest.Layers[i]), compressed); err != nil {
+			return
+		}
+	}
+
+	manifestfile := filepath.Join(dir, "manifest.json")
+	fh, err := os.Create(manifestfile)
+	if err != nil {
+		return errors.Wrapf(err, "filename = %s", manifestfile)
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	if err = json.NewEncoder(fh).Encode([]*distribution.ArchiveManifest{archiveManifest}); err != nil {
+		return errors.Wrapf(err, "%#v", archiveManifest)
+	}
+
+	return
+}
+
+// extractBlob writes the plaintext of a buffered blob to filename, decompressing it if necessary
+func (p *EncryptingProxy) extractBlob(d descriptor, filename string, decompress bool) (err error) {
+	rc, _, err := p.blobs.get(d.Digest)
+	if err != nil {
+		return
+	}
+	defer func() { err = utils.CheckedClose(rc, err) }()
+
+	var r io.Reader = rc
+	if decompress {
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(rc); err != nil {
+			return errors.Wrapf(err, "could not decompress layer %s", d.Digest)
+		}
+		defer func() { err = utils.CheckedClose(zr, err) }()
+		r = zr
+	}
+
+	fh, err := os.Create(filename)
+	if err != nil {
+		return errors.Wrapf(err, "filename = %s", filename)
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	_, err = io.Copy(fh, r)
+	return errors.WithStack(err)
+}
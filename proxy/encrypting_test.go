@@ -0,0 +1,309 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy_test
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/proxy"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestEncryptingProxy(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm}
+	opts.SetPassphrase("hunter2")
+
+	_, err := proxy.NewEncryptingProxy("https://docker.io", opts, dir)
+	require.Error(err)
+
+	p, err := proxy.NewEncryptingProxy("docker.io", opts, dir)
+	require.NoError(err)
+	defer func() { assert.NoError(p.Close()) }()
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	do := func(method, path string, body io.Reader) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, body)
+		require.NoError(err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		return resp
+	}
+
+	errorCode := func(resp *http.Response) string {
+		var body struct {
+			Errors []struct {
+				Code string `json:"code"`
+			} `json:"errors"`
+		}
+		if assert.NoError(json.NewDecoder(resp.Body).Decode(&body)) && assert.Len(body.Errors, 1) {
+			return body.Errors[0].Code
+		}
+		return ""
+	}
+
+	blob := "some layer data"
+	d := digest.Canonical.FromString(blob)
+
+	// chunked upload
+	resp := do("POST", "/v2/cryptocli/alpine/blobs/uploads/", nil)
+	assert.NoError(resp.Body.Close())
+	require.Equal(http.StatusAccepted, resp.StatusCode)
+	location := resp.Header.Get("Location")
+	require.True(strings.HasPrefix(location, "/v2/cryptocli/alpine/blobs/uploads/"))
+
+	resp = do("PATCH", location, strings.NewReader(blob[:4]))
+	assert.NoError(resp.Body.Close())
+	assert.Equal(http.StatusAccepted, resp.StatusCode)
+	assert.Equal("0-3", resp.Header.Get("Range"))
+
+	resp = do("PUT", location+"?digest="+d.String(), strings.NewReader(blob[4:]))
+	assert.NoError(resp.Body.Close())
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	assert.Equal(d.String(), resp.Header.Get("Docker-Content-Digest"))
+
+	// the upload is finished
+	resp = do("GET", location, nil)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+	assert.Equal("BLOB_UPLOAD_UNKNOWN", errorCode(resp))
+	assert.NoError(resp.Body.Close())
+
+	resp = do("HEAD", "/v2/cryptocli/alpine/blobs/"+d.String(), nil)
+	assert.NoError(resp.Body.Close())
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	resp = do("GET", "/v2/cryptocli/alpine/blobs/"+d.String(), nil)
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(err)
+	assert.NoError(resp.Body.Close())
+	assert.Equal(blob, string(data))
+
+	// monolithic upload with the wrong digest
+	wrong := digest.Canonical.FromString("other data")
+	resp = do("POST", "/v2/cryptocli/alpine/blobs/uploads/?digest="+wrong.String(), strings.NewReader(blob))
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.Equal("DIGEST_INVALID", errorCode(resp))
+	assert.NoError(resp.Body.Close())
+
+	resp = do("HEAD", "/v2/cryptocli/alpine/blobs/"+wrong.String(), nil)
+	assert.NoError(resp.Body.Close())
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+	manifest := `{
+	"schemaVersion": 2,
+	"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+	"config": {"mediaType": "application/vnd.docker.container.image.v1+json", "size": 2, "digest": "` + wrong.String() + `"},
+	"layers": [{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": 15, "digest": "` + d.String() + `"}]
+}`
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"GET", "/v2/", "", http.StatusOK, ""},
+		{"PUT", "/v2/cryptocli/alpine/manifests/latest", manifest, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN"},
+		{"PUT", "/v2/cryptocli/alpine/manifests/latest", "{}", http.StatusBadRequest, "MANIFEST_INVALID"},
+		{"PUT", "/v2/cryptocli/alpine/manifests/" + d.String(), manifest, http.StatusBadRequest, "TAG_INVALID"},
+		{"GET", "/v2/cryptocli/alpine/manifests/latest", "", http.StatusMethodNotAllowed, "UNSUPPORTED"},
+		{"GET", "/v2/cryptocli/alpine/tags/list", "", http.StatusMethodNotAllowed, "UNSUPPORTED"},
+		{"PATCH", "/v2/cryptocli/alpine/blobs/uploads/" + uuid.New().String(), "", http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN"},
+	}
+
+	for _, test := range tests {
+		resp := do(test.method, test.path, strings.NewReader(test.body))
+
+		assert.Equal(test.status, resp.StatusCode, "%s %s", test.method, test.path)
+		assert.Equal("registry/2.0", resp.Header.Get("Docker-Distribution-API-Version"))
+
+		if test.code != "" {
+			assert.Equal(test.code, errorCode(resp), "%s %s", test.method, test.path)
+		}
+
+		assert.NoError(resp.Body.Close())
+	}
+}
+
+func TestEncryptingProxyConcurrentChunks(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm}
+	opts.SetPassphrase("hunter2")
+
+	p, err := proxy.NewEncryptingProxy("docker.io", opts, dir)
+	require.NoError(err)
+	defer func() { assert.NoError(p.Close()) }()
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	do := func(method, path string, body io.Reader) (*http.Response, error) {
+		req, err := http.NewRequest(method, server.URL+path, body)
+		if err != nil {
+			return nil, err
+		}
+		return http.DefaultClient.Do(req)
+	}
+
+	resp, err := do("POST", "/v2/cryptocli/alpine/blobs/uploads/", nil)
+	require.NoError(err)
+	assert.NoError(resp.Body.Close())
+	require.Equal(http.StatusAccepted, resp.StatusCode)
+	location := resp.Header.Get("Location")
+
+	// the chunks are the same, so the blob is the same whichever is appended first, but
+	// differs if they are interleaved. The second half of each is only sent once the first
+	// halves of both have been, so that the server reads them at the same time.
+	const n = 2
+	chunk := strings.Repeat("a", 1<<16) + strings.Repeat("b", 1<<16)
+
+	var halves, wg sync.WaitGroup
+	halves.Add(n)
+	statuses := make([]int, n)
+	for i := 0; i < n; i++ {
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := io.WriteString(pw, chunk[:len(chunk)/2])
+			halves.Done()
+			halves.Wait()
+			if err == nil {
+				_, err = io.WriteString(pw, chunk[len(chunk)/2:])
+			}
+			assert.NoError(pw.CloseWithError(err))
+		}()
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := do("PATCH", location, pr)
+			if assert.NoError(err) {
+				statuses[i] = resp.StatusCode
+				assert.NoError(resp.Body.Close())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, status := range statuses {
+		assert.Equal(http.StatusAccepted, status)
+	}
+
+	resp, err = do("GET", location, nil)
+	require.NoError(err)
+	assert.NoError(resp.Body.Close())
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	assert.Equal("0-"+strconv.Itoa(n*len(chunk)-1), resp.Header.Get("Range"))
+
+	d := digest.Canonical.FromString(strings.Repeat(chunk, n))
+	resp, err = do("PUT", location+"?digest="+d.String(), nil)
+	require.NoError(err)
+	assert.NoError(resp.Body.Close())
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+}
+
+func TestEncryptingProxyConcurrentPuts(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm}
+	opts.SetPassphrase("hunter2")
+
+	p, err := proxy.NewEncryptingProxy("docker.io", opts, dir)
+	require.NoError(err)
+	defer func() { assert.NoError(p.Close()) }()
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	blob := strings.Repeat("some layer data", 1<<18)
+	d := digest.Canonical.FromString(blob)
+
+	// the same blob is uploaded by many clients at once. The end of each is only sent
+	// once the rest of all of them has been, so that they are put in the cache together.
+	const n = 8
+	var rest, wg sync.WaitGroup
+	rest.Add(n)
+	statuses := make([]int, n)
+	for i := 0; i < n; i++ {
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := io.WriteString(pw, blob[:len(blob)-1])
+			rest.Done()
+			rest.Wait()
+			if err == nil {
+				_, err = io.WriteString(pw, blob[len(blob)-1:])
+			}
+			assert.NoError(pw.CloseWithError(err))
+		}()
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Post(
+				server.URL+"/v2/cryptocli/alpine/blobs/uploads/?digest="+d.String(),
+				"application/octet-stream",
+				pr,
+			)
+			if assert.NoError(err) {
+				statuses[i] = resp.StatusCode
+				assert.NoError(resp.Body.Close())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, status := range statuses {
+		assert.Equal(http.StatusCreated, status)
+	}
+
+	resp, err := http.Get(server.URL + "/v2/cryptocli/alpine/blobs/" + d.String())
+	require.NoError(err)
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(err)
+	assert.NoError(resp.Body.Close())
+	assert.Equal(blob, string(data))
+}
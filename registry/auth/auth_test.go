@@ -16,16 +16,24 @@ package auth_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 
+	"github.com/docker/cli/cli/config"
 	"github.com/docker/distribution/reference"
 	dregistry "github.com/docker/docker/registry"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -33,6 +41,7 @@ import (
 	"github.com/Senetas/crypto-cli/registry/auth"
 	"github.com/Senetas/crypto-cli/registry/httpclient"
 	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
 )
 
 const (
@@ -91,7 +100,7 @@ func TestAuthenticator(t *testing.T) {
 		if !assert.NoError(err) {
 			continue
 		}
-		_, err = auth.NewAuthenticator(httpclient.DefaultClient, creds).Authenticate(ch)
+		_, err = auth.NewAuthenticator(httpclient.DefaultClient, creds).Authenticate(context.Background(), ch)
 		if err != nil && assert.EqualError(err, test.errMsg) || !assert.Equal(test.errMsg, "") {
 			continue
 		}
@@ -110,19 +119,19 @@ func TestChallenger(t *testing.T) {
 	repoInfo, err := dregistry.ParseRepositoryInfo(ref)
 	require.NoError(err)
 
-	endpoint, err := registry.GetEndpoint(ref, *repoInfo)
+	endpoint, err := registry.GetEndpoint(context.Background(), ref, *repoInfo)
 	require.NoError(err)
 
 	creds, err := auth.NewDefaultCreds(repoInfo)
 	require.NoError(err)
 
-	header, err := auth.ChallengeHeader(nTRep, *repoInfo, *endpoint, creds)
+	header, err := auth.ChallengeHeader(context.Background(), nTRep, *repoInfo, *endpoint, creds)
 	require.NoError(err)
 
 	ch, err := auth.ParseChallengeHeader(header)
 	require.NoError(err)
 
-	_, err = auth.NewAuthenticator(httpclient.DefaultClient, creds).Authenticate(ch)
+	_, err = auth.NewAuthenticator(httpclient.DefaultClient, creds).Authenticate(context.Background(), ch)
 	require.NoError(err)
 }
 
@@ -211,7 +220,7 @@ func TestChallengeHeader(t *testing.T) {
 	repoInfo, err := dregistry.ParseRepositoryInfo(ref)
 	require.NoError(err)
 
-	endpoint, err := registry.GetEndpoint(ref, *repoInfo)
+	endpoint, err := registry.GetEndpoint(context.Background(), ref, *repoInfo)
 	require.NoError(err)
 
 	creds, err := auth.NewDefaultCreds(repoInfo)
@@ -250,7 +259,7 @@ func TestChallengeHeader(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		_, err = auth.ChallengeHeader(test.ref, test.repoInfo, *test.endpoint, test.creds)
+		_, err = auth.ChallengeHeader(context.Background(), test.ref, test.repoInfo, *test.endpoint, test.creds)
 		_ = err != nil && assert.EqualError(err, test.errMsg) || !assert.Equal(test.errMsg, "")
 	}
 }
@@ -261,16 +270,18 @@ func TestToken(t *testing.T) {
 	tokenStr := "this is the token"
 
 	tests := []struct {
-		tokenStr string
+		tokenRaw string
+		fresh    bool
 		errMsg   string
 	}{
-		{tokenStr, ""},
-		{"", "malformed response from auth server"},
+		{fmt.Sprintf(`{"token": "%s"}`, tokenStr), true, ""},
+		{fmt.Sprintf(`{"access_token": "%s", "expires_in": 300}`, tokenStr), true, ""},
+		{fmt.Sprintf(`{"token": "%s", "expires_in": 1}`, tokenStr), false, ""},
+		{`{"token": ""}`, false, "malformed response from auth server"},
 	}
 
 	for _, test := range tests {
-		tokenRaw := fmt.Sprintf(`{"token": "%s"}`, test.tokenStr)
-		tokenJSON := bytes.NewBuffer([]byte(tokenRaw))
+		tokenJSON := bytes.NewBuffer([]byte(test.tokenRaw))
 		token, err := auth.NewTokenFromResp(tokenJSON)
 		if err != nil && assert.EqualError(err, test.errMsg) || !assert.Equal(test.errMsg, "") {
 			continue
@@ -278,7 +289,7 @@ func TestToken(t *testing.T) {
 		if !assert.Equal(tokenStr, token.String()) {
 			continue
 		}
-		if !assert.False(token.Fresh()) {
+		if !assert.Equal(test.fresh, token.Fresh(), test.tokenRaw) {
 			continue
 		}
 		req, err := http.NewRequest("GET", "http://localhost", nil)
@@ -286,6 +297,290 @@ func TestToken(t *testing.T) {
 			continue
 		}
 		auth.AddToRequest(token, req)
-		assert.Equal(req.Header.Get("Authorization"), fmt.Sprintf("Bearer %s", test.tokenStr))
+		assert.Equal(req.Header.Get("Authorization"), fmt.Sprintf("Bearer %s", tokenStr))
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var issued, posts int32
+
+	authServer := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "GET":
+				if u, p, ok := r.BasicAuth(); !ok || u != user || p != pass {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+			case "POST":
+				atomic.AddInt32(&posts, 1)
+				assert.NoError(r.ParseForm())
+				assert.Equal("refresh_token", r.PostForm.Get("grant_type"))
+				assert.Equal("crypto-cli", r.PostForm.Get("client_id"))
+				assert.Equal("repository:a/b:pull", r.PostForm.Get("scope"))
+				if rt := r.PostForm.Get("refresh_token"); rt != "refresh" && rt != "identity" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+			}
+			n := atomic.AddInt32(&issued, 1)
+			_, err := fmt.Fprintf(w, `{"token":"tok-%d","expires_in":3600,"refresh_token":"refresh"}`, n)
+			assert.NoError(err)
+		}),
+	)
+	defer authServer.Close()
+
+	// the registry only accepts the most recently issued token
+	regServer := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != fmt.Sprintf("Bearer tok-%d", atomic.LoadInt32(&issued)) {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}),
+	)
+	defer regServer.Close()
+
+	ch, err := auth.ParseChallengeHeader(fmt.Sprintf(`Bearer realm="%s",service="registry.example.com"`, authServer.URL))
+	require.NoError(err)
+	ch.SetScope("a/b", "pull")
+
+	token, err := auth.NewAuthenticator(http.DefaultClient, auth.NewCreds(user, pass)).Authenticate(context.Background(), ch)
+	require.NoError(err)
+	assert.Equal("tok-1", token.String())
+
+	send := func(body io.Reader) int {
+		req, rerr := http.NewRequest("PUT", regServer.URL, body)
+		require.NoError(rerr)
+		resp, rerr := auth.DoRequest(http.DefaultClient, token, req, true, true)
+		require.NoError(rerr)
+		require.NoError(resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	assert.Equal(http.StatusOK, send(nil))
+
+	// revoke the token, it is refreshed with the refresh token and the request retried
+	atomic.AddInt32(&issued, 1)
+	assert.Equal(http.StatusOK, send(strings.NewReader("body")))
+	assert.Equal("tok-3", token.String())
+	assert.Equal(int32(1), atomic.LoadInt32(&posts))
+
+	// a request whose body cannot be replayed is not retried
+	atomic.AddInt32(&issued, 1)
+	assert.Equal(http.StatusUnauthorized, send(ioutil.NopCloser(strings.NewReader("body"))))
+
+	// identity tokens stored by docker login are exchanged with the OAuth2 flow
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	require.NoError(os.MkdirAll(dir, 0700))
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	oldDir := config.Dir()
+	config.SetDir(dir)
+	defer config.SetDir(oldDir)
+
+	confJSON := `{"auths":{"https://registry.example.com":{"auth":"PHRva2VuPjo=","identitytoken":"identity"}}}`
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, config.ConfigFileName), []byte(confJSON), 0600))
+
+	ref, err := reference.ParseNormalizedNamed("registry.example.com/a/b")
+	require.NoError(err)
+	repoInfo, err := dregistry.ParseRepositoryInfo(ref)
+	require.NoError(err)
+	creds, err := auth.NewDefaultCreds(repoInfo)
+	require.NoError(err)
+
+	token, err = auth.NewAuthenticator(http.DefaultClient, creds).Authenticate(context.Background(), ch)
+	require.NoError(err)
+	assert.Equal(fmt.Sprintf("tok-%d", atomic.LoadInt32(&issued)), token.String())
+	assert.Equal(int32(2), atomic.LoadInt32(&posts))
+}
+
+func TestDefaultCreds(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	require.NoError(os.MkdirAll(dir, 0700))
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	oldDir := config.Dir()
+	config.SetDir(dir)
+	defer config.SetDir(oldDir)
+
+	basic := func(user, pass string) string {
+		return base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+	}
+
+	confJSON := fmt.Sprintf(
+		`{"auths":{"%s":{"auth":"%s"},"https://registry.example.com":{"auth":"%s"}}}`,
+		dregistry.IndexServer,
+		basic("hub", "hubpass"),
+		basic("private", "privatepass"),
+	)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, config.ConfigFileName), []byte(confJSON), 0600))
+
+	require.NoError(auth.StoreCreds("localhost:5000", "local", "localpass"))
+
+	tests := []struct {
+		image  string
+		header string
+	}{
+		{"cryptocli/alpine:test", "Basic " + basic("hub", "hubpass")},
+		{"registry.example.com/cryptocli/alpine:test", "Basic " + basic("private", "privatepass")},
+		{"localhost:5000/cryptocli/alpine:test", "Basic " + basic("local", "localpass")},
+		{"other.example.com/cryptocli/alpine:test", ""},
+	}
+
+	for _, test := range tests {
+		ref, err := reference.ParseNormalizedNamed(test.image)
+		require.NoError(err)
+
+		repoInfo, err := dregistry.ParseRepositoryInfo(ref)
+		require.NoError(err)
+
+		creds, err := auth.NewDefaultCreds(repoInfo)
+		if !assert.NoError(err) {
+			continue
+		}
+
+		req, err := http.NewRequest("GET", "https://example.com", nil)
+		require.NoError(err)
+
+		// requests are anonymous if there are no credentials
+		assert.Equal(test.header, creds.SetAuth(req).Header.Get("Authorization"), test.image)
+	}
+
+	auth.OverrideDefaultCreds(auth.NewCreds(user, pass))
+	defer auth.OverrideDefaultCreds(nil)
+
+	ref, err := reference.ParseNormalizedNamed(imageName)
+	require.NoError(err)
+
+	repoInfo, err := dregistry.ParseRepositoryInfo(ref)
+	require.NoError(err)
+
+	creds, err := auth.NewDefaultCreds(repoInfo)
+	require.NoError(err)
+	assert.Equal(auth.NewCreds(user, pass), creds)
+}
+
+func TestParseChallenges(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		header  string
+		schemes []string
+		scheme  string
+		realm   string
+		hasErr  bool
+	}{
+		{validHeader, []string{"bearer"}, "bearer", "https://auth.docker.io/token", false},
+		{
+			`Bearer scope="repository:a/b:pull", service=registry.example.com ,realm="https://auth.example.com/token"`,
+			[]string{"bearer"},
+			"bearer",
+			"https://auth.example.com/token",
+			false,
+		},
+		{`Basic realm="Registry Realm"`, []string{"basic"}, "basic", "", false},
+		{
+			`Basic realm="Registry Realm", Bearer realm="https://auth.example.com/token",service="r"`,
+			[]string{"basic", "bearer"},
+			"bearer",
+			"https://auth.example.com/token",
+			false,
+		},
+		{`Negotiate, Basic realm="a \"quoted\" realm"`, []string{"negotiate", "basic"}, "basic", "", false},
+		{`Negotiate`, []string{"negotiate"}, "", "", true},
+		{invalidHeader, nil, "", "", true},
+		{`Bearer service="r"`, nil, "", "", true},
+		{`Basic realm="unterminated`, nil, "", "", true},
+		{``, nil, "", "", true},
+	}
+
+	for _, test := range tests {
+		chs, err := auth.ParseChallenges(test.header)
+		if test.schemes == nil {
+			assert.Error(err, test.header)
+			continue
+		}
+		if !assert.NoError(err, test.header) || !assert.Len(chs, len(test.schemes), test.header) {
+			continue
+		}
+		for i, ch := range chs {
+			assert.Equal(test.schemes[i], ch.Scheme(), test.header)
+		}
+
+		ch, err := auth.ParseChallengeHeader(test.header)
+		if test.hasErr {
+			assert.Error(err, test.header)
+			continue
+		}
+		if assert.NoError(err, test.header) {
+			assert.Equal(test.scheme, ch.Scheme(), test.header)
+		}
+	}
+}
+
+func TestAuthenticateSchemes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", user, pass)))
+
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// an anonymous token may only pull
+			if r.Header.Get("Authorization") == "" && r.URL.Query().Get("scope") != "repository:a/b:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			account := r.URL.Query().Get("account")
+			if account == "" {
+				account = "anonymous"
+			}
+			_, err := w.Write([]byte(`{"token":"` + account + `"}`))
+			assert.NoError(err)
+		}),
+	)
+	defer server.Close()
+
+	bearer := fmt.Sprintf(`Bearer realm="%s",service="registry.example.com"`, server.URL)
+
+	tests := []struct {
+		header  string
+		creds   auth.Credentials
+		actions []string
+		auth    string
+		hasErr  bool
+	}{
+		{`Basic realm="Registry Realm"`, auth.NewCreds(user, pass), nil, "Basic " + encoded, false},
+		{`Basic realm="Registry Realm"`, auth.NewCreds("", ""), nil, "", false},
+		{bearer, auth.NewCreds(user, pass), []string{"pull", "push"}, "Bearer " + user, false},
+		{bearer, auth.NewCreds("", ""), []string{"pull"}, "Bearer anonymous", false},
+		{bearer, auth.NewCreds("", ""), []string{"pull", "push"}, "", true},
+	}
+
+	for _, test := range tests {
+		ch, err := auth.ParseChallengeHeader(test.header)
+		require.NoError(err)
+		ch.SetScope("a/b", test.actions...)
+
+		token, err := auth.NewAuthenticator(http.DefaultClient, test.creds).Authenticate(context.Background(), ch)
+		if test.hasErr {
+			assert.Error(err)
+			continue
+		}
+		if !assert.NoError(err) {
+			continue
+		}
+
+		req, err := http.NewRequest("GET", "http://localhost", nil)
+		require.NoError(err)
+
+		auth.AddToRequest(token, req)
+		assert.Equal(test.auth, req.Header.Get("Authorization"))
 	}
 }
@@ -15,16 +15,23 @@
 package auth
 
 import (
+	"context"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/Senetas/crypto-cli/registry/httpclient"
 	"github.com/Senetas/crypto-cli/utils"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 )
 
+// clientID identifies this application to auth servers in the OAuth2 flow
+const clientID = "crypto-cli"
+
 // Authenticator produces a Bearer token to authenticate with the HTTP API
 type Authenticator interface {
-	Authenticate(c *Challenge) (Token, error)
+	Authenticate(ctx context.Context, c *Challenge) (Token, error)
 }
 
 type authenticator struct {
@@ -40,29 +47,108 @@ func NewAuthenticator(client *http.Client, credentials Credentials) Authenticato
 	}
 }
 
-func (a *authenticator) Authenticate(c *Challenge) (_ Token, err error) {
+// Authenticate responds to the challenge. For a basic challenge the credentials
+// themselves are the token, for a bearer challenge a token is requested from the
+// auth server, anonymously if the credentials are empty.
+func (a *authenticator) Authenticate(ctx context.Context, c *Challenge) (_ Token, err error) {
+	switch c.scheme {
+	case SchemeBasic:
+		return &basicToken{credentials: a.credentials}, nil
+	case SchemeBearer:
+	default:
+		err = errors.Errorf("unsupported authentication scheme: %s", c.scheme)
+		return
+	}
+
+	t, err := a.fetch(ctx, c, "")
+	if err != nil {
+		return
+	}
+
+	t.authenticator = a
+	t.challenge = c
+
+	return t, nil
+}
+
+// fetch obtains a token from the auth server of a bearer challenge. If a refresh token is
+// given, or the credentials are an identity token, the OAuth2 flow is used; otherwise the
+// token is requested with the username and password.
+func (a *authenticator) fetch(ctx context.Context, c *Challenge, refreshToken string) (_ *token, err error) {
+	if refreshToken != "" {
+		t, rerr := a.fetchOAuth(ctx, c, refreshToken)
+		if rerr == nil {
+			return t, nil
+		}
+		log.Debug().Err(rerr).Msg("Refresh token rejected, authenticating with credentials.")
+	}
+
+	if creds, ok := a.credentials.(*credentials); ok && creds.IdentityToken != "" {
+		return a.fetchOAuth(ctx, c, creds.IdentityToken)
+	}
+
 	reqURL := c.buildURL()
-	req, err := http.NewRequest("GET", reqURL.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL.String(), nil)
 	if err != nil {
 		err = errors.Wrapf(err, "url = %s", reqURL)
 		return
 	}
 
 	req = a.credentials.SetAuth(req)
+	if username, _, ok := req.BasicAuth(); ok {
+		q := req.URL.Query()
+		q.Set("account", username)
+		req.URL.RawQuery = q.Encode()
+	}
+
+	return a.doFetch(req)
+}
+
+// fetchOAuth obtains a token from the auth server with the OAuth2 refresh token grant
+func (a *authenticator) fetchOAuth(ctx context.Context, c *Challenge, refreshToken string) (_ *token, err error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {clientID},
+	}
+	if c.service != "" {
+		form.Set("service", c.service)
+	}
+	if c.scope != "" {
+		form.Set("scope", c.scope)
+	}
 
+	realm := c.realm.String()
+	req, err := http.NewRequestWithContext(ctx, "POST", realm, strings.NewReader(form.Encode()))
+	if err != nil {
+		err = errors.Wrapf(err, "url = %s", realm)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return a.doFetch(req)
+}
+
+// doFetch sends a request for a token to the auth server and parses the response
+func (a *authenticator) doFetch(req *http.Request) (_ *token, err error) {
 	resp, err := httpclient.DoRequest(a.httpClient, req, true, true)
 	if resp != nil {
 		defer func() { err = utils.CheckedClose(resp.Body, err) }()
 	}
 	if err != nil {
-		err = errors.Wrapf(err, "req = %#v", req)
+		err = errors.Wrapf(err, "%s %s", req.Method, req.URL)
 		return
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		err = utils.WithKind(utils.KindAuth, errors.Errorf("authentication failed with status: %s", resp.Status))
+		return
+	default:
 		err = errors.Errorf("authentication failed with status: %s", resp.Status)
 		return
 	}
 
-	return NewTokenFromResp(resp.Body)
+	return newTokenFromResp(resp.Body)
 }
@@ -15,55 +15,141 @@
 package auth
 
 import (
+	"context"
 	"net/http"
 	"net/url"
-	"regexp"
+	"strings"
 
-	"github.com/Senetas/crypto-cli/registry/httpclient"
-	"github.com/Senetas/crypto-cli/utils"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/distribution/registry/api/v2"
 	dregistry "github.com/docker/docker/registry"
 	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
 )
 
-var challengeRE = regexp.MustCompile(`^\s*Bearer\s+realm="([^"]+)",service="([^"]+)"(,scope="([^"]+)")?\s*$`)
+const (
+	// SchemeBearer is the scheme of a challenge to obtain a token from an auth server
+	SchemeBearer = "bearer"
+
+	// SchemeBasic is the scheme of a challenge to send a username and password with each request
+	SchemeBasic = "basic"
+)
 
 // Challenge from a auth server
 type Challenge struct {
+	scheme  string
+	params  map[string]string
 	realm   *url.URL
 	service string
 	scope   string
 }
 
-// ParseChallengeHeader parses the challenge header and extract the relevant parts
-func ParseChallengeHeader(header string) (ch *Challenge, err error) {
-	match := challengeRE.FindAllStringSubmatch(header, -1)
+// Scheme returns the (lower case) authentication scheme of the challenge
+func (c *Challenge) Scheme() string {
+	return c.scheme
+}
+
+// SetScope sets the scope of the token requested in response to a bearer challenge
+// to the given actions (e.g. "pull", "push") on the repository at path
+func (c *Challenge) SetScope(path string, actions ...string) {
+	c.scope = "repository:" + path + ":" + strings.Join(actions, ",")
+}
 
-	if len(match) != 1 {
-		err = errors.Errorf("malformed challenge header: %s", header)
+// ParseChallengeHeader parses the challenge header and returns the challenge of the most
+// preferred scheme that is supported, bearer then basic
+func ParseChallengeHeader(header string) (ch *Challenge, err error) {
+	chs, err := ParseChallenges(header)
+	if err != nil {
 		return
 	}
 
-	ch = &Challenge{
-		service: match[0][2],
-		scope:   match[0][4],
+	for _, scheme := range []string{SchemeBearer, SchemeBasic} {
+		for _, ch = range chs {
+			if ch.scheme == scheme {
+				return ch, nil
+			}
+		}
+	}
+
+	return nil, errors.Errorf("no supported challenge in header: %s", header)
+}
+
+// ParseChallenges parses all of the challenges in the value of a WWW-Authenticate
+// header. Each challenge is a scheme followed by comma separated parameters, which may
+// appear in any order and whose values may be tokens or quoted strings.
+func ParseChallenges(header string) (chs []*Challenge, err error) {
+	malformed := errors.Errorf("malformed challenge header: %s", header)
+
+	var ch *Challenge
+	for s := header; ; {
+		if s = skipSpaceAndCommas(s); s == "" {
+			break
+		}
+
+		var tok string
+		if tok, s = expectToken(s); tok == "" {
+			return nil, malformed
+		}
+
+		rest := skipSpace(s)
+		if ch == nil || !strings.HasPrefix(rest, "=") {
+			// the start of a new challenge
+			ch = &Challenge{scheme: strings.ToLower(tok), params: make(map[string]string)}
+			chs = append(chs, ch)
+			continue
+		}
+
+		var value string
+		var ok bool
+		if value, s, ok = expectTokenOrQuoted(skipSpace(rest[1:])); !ok {
+			return nil, malformed
+		}
+		ch.params[strings.ToLower(tok)] = value
 	}
 
-	ch.realm, err = url.Parse(match[0][1])
-	if err != nil {
-		err = errors.WithStack(err)
+	if len(chs) == 0 {
+		return nil, malformed
+	}
+
+	for _, ch := range chs {
+		if err = ch.validate(); err != nil {
+			return nil, errors.Wrap(malformed, err.Error())
+		}
+	}
+
+	return chs, nil
+}
+
+// validate fills out the fields of the challenge from its parameters
+func (c *Challenge) validate() (err error) {
+	c.service = c.params["service"]
+	c.scope = c.params["scope"]
+
+	if c.scheme != SchemeBearer {
 		return
 	}
 
+	realm := c.params["realm"]
+	if realm == "" {
+		return errors.New("missing realm")
+	}
+
+	if c.realm, err = url.Parse(realm); err != nil {
+		return errors.WithStack(err)
+	}
+
 	return
 }
 
 // buildURL creates the url to respond to the challenge
 func (c *Challenge) buildURL() *url.URL {
 	authURL := *c.realm
-	authParams := make(url.Values)
-	authParams.Set("service", c.service)
+	authParams := authURL.Query()
+	if c.service != "" {
+		authParams.Set("service", c.service)
+	}
 	if c.scope != "" {
 		authParams.Set("scope", c.scope)
 	}
@@ -71,8 +157,51 @@ func (c *Challenge) buildURL() *url.URL {
 	return &authURL
 }
 
-// ChallengeHeader requests the challenge header from the auth server
+func isTokenChar(c byte) bool {
+	return c > ' ' && c < 0x7f && !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, rune(c))
+}
+
+func skipSpace(s string) string {
+	return strings.TrimLeft(s, " \t")
+}
+
+func skipSpaceAndCommas(s string) string {
+	return strings.TrimLeft(s, " \t,")
+}
+
+func expectToken(s string) (token, rest string) {
+	i := 0
+	for ; i < len(s) && isTokenChar(s[i]); i++ {
+	}
+	return s[:i], s[i:]
+}
+
+func expectTokenOrQuoted(s string) (value, rest string, ok bool) {
+	if !strings.HasPrefix(s, `"`) {
+		value, rest = expectToken(s)
+		return value, rest, value != ""
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:], true
+		case '\\':
+			if i++; i == len(s) {
+				return "", "", false
+			}
+		}
+		b.WriteByte(s[i])
+	}
+
+	return "", "", false
+}
+
+// ChallengeHeader requests the challenge header from the registry by checking its
+// API version. The header is empty if the registry does not require authentication.
 func ChallengeHeader(
+	ctx context.Context,
 	ref reference.Named,
 	repoInfo dregistry.RepositoryInfo,
 	endpoint dregistry.APIEndpoint,
@@ -80,13 +209,13 @@ func ChallengeHeader(
 ) (auth string, err error) {
 	bldr := v2.NewURLBuilder(endpoint.URL, false)
 
-	urlStr, err := bldr.BuildManifestURL(ref)
+	urlStr, err := bldr.BuildBaseURL()
 	if err != nil {
 		err = errors.Wrapf(err, "base = %s", endpoint.URL)
 		return
 	}
 
-	req, err := http.NewRequest("PUT", urlStr, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
 	if err != nil {
 		return
 	}
@@ -101,7 +230,7 @@ func ChallengeHeader(
 
 	switch resp.StatusCode {
 	case http.StatusUnauthorized:
-		auth = resp.Header.Get("Www-Authenticate")
+		auth = strings.Join(resp.Header["Www-Authenticate"], ", ")
 		if auth == "" {
 			err = errors.New("login error")
 		}
@@ -43,34 +43,83 @@ func NewCreds(username, password string) Credentials {
 	}
 }
 
-// NewDefaultCreds creates a credentials struct from the credentials in
-// the default conf file, typically ~/.docker/config.json. the struct is lazy,
-// i.e. the file is only read if the username or password is accessed
+// overrideCreds, if set, are returned by NewDefaultCreds instead of the stored credentials
+var overrideCreds Credentials
+
+// OverrideDefaultCreds makes NewDefaultCreds return creds for every registry,
+// e.g. when a username and password are given on the command line
+func OverrideDefaultCreds(creds Credentials) {
+	overrideCreds = creds
+}
+
+// ServerAddress returns the key under which the credentials for the registry with
+// the given index name (i.e. host) are stored in the docker config file
+func ServerAddress(indexName string) string {
+	switch indexName {
+	case "", dregistry.IndexName, dregistry.IndexHostname, dregistry.IndexServer:
+		return dregistry.IndexServer
+	default:
+		return dregistry.ConvertToHostname(indexName)
+	}
+}
+
+// NewDefaultCreds creates a credentials struct from the credentials for the registry
+// of repoInfo in the default conf file, typically ~/.docker/config.json. The
+// credentials are taken from the credential helper for the registry (credHelpers), the
+// default credential store (credsStore) or the conf file itself (auths), in that order.
 func NewDefaultCreds(repoInfo *dregistry.RepositoryInfo) (creds Credentials, err error) {
+	if overrideCreds != nil {
+		return overrideCreds, nil
+	}
+
 	confFile, err := config.Load("")
 	if err != nil {
 		err = errors.WithStack(err)
 		return
 	}
 
-	serverAddress := dregistry.IndexServer
-	store := confFile.GetCredentialsStore(serverAddress)
+	serverAddress := ServerAddress(repoInfo.Index.Name)
 
-	authConfig, err := store.Get(serverAddress)
+	authConfig, err := confFile.GetAuthConfig(serverAddress)
 	if err != nil {
-		err = errors.WithStack(err)
+		err = errors.Wrapf(err, "could not obtain credentials for %s", serverAddress)
 		return
 	}
 
-	creds = NewCreds(authConfig.Username, authConfig.Password)
+	creds = &credentials{authConfig}
+
+	return
+}
+
+// StoreCreds stores a username and password for the registry with the given index
+// name in the credential store that NewDefaultCreds reads them from
+func StoreCreds(indexName, username, password string) (err error) {
+	confFile, err := config.Load("")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	serverAddress := ServerAddress(indexName)
+
+	authConfig := types.AuthConfig{
+		Username:      username,
+		Password:      password,
+		ServerAddress: serverAddress,
+	}
+
+	if err = confFile.GetCredentialsStore(serverAddress).Store(authConfig); err != nil {
+		return errors.Wrapf(err, "could not store credentials for %s", serverAddress)
+	}
 
 	return
 }
 
+// SetAuth sets the basic authorization of the request, unless the credentials are
+// empty, in which case the request is left anonymous
 func (c *credentials) SetAuth(req *http.Request) *http.Request {
+	if c.Username == "" && c.Password == "" {
+		return req
+	}
 	req.SetBasicAuth(c.Username, c.Password)
-	q := req.URL.Query()
-	q.Set("account", c.Username)
-	req.URL.RawQuery = q.Encode()
 	return req
 }
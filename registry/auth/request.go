@@ -0,0 +1,71 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"net/http"
+
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// DoRequest adds the token to the request and sends it. If the registry rejects the token with
+// 401 Unauthorized, the token is refreshed and the request is retried once, provided its body
+// may be sent again. Otherwise the 401 response is returned to the caller.
+func DoRequest(
+	client *http.Client,
+	t auth.Scope,
+	req *http.Request,
+	dumpReqBody, dumpRespBody bool,
+) (resp *http.Response, err error) {
+	AddToRequest(t, req)
+
+	resp, err = httpclient.DoRequest(client, req, dumpReqBody, dumpRespBody)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return
+	}
+
+	r, ok := t.(Refresher)
+	if !ok || req.Body != nil && req.GetBody == nil {
+		return
+	}
+
+	if tk, ok := r.(*token); ok && tk.authenticator == nil {
+		return
+	}
+
+	log.Info().Msg("Token rejected by the registry, re-authenticating.")
+
+	if err = utils.CheckedClose(resp.Body, r.Refresh(req.Context())); err != nil {
+		return nil, err
+	}
+
+	retry := req.WithContext(req.Context())
+	retry.Header = req.Header.Clone()
+	retry.Header.Del("Authorization")
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	AddToRequest(t, retry)
+
+	return httpclient.DoRequest(client, retry, dumpReqBody, dumpRespBody)
+}
@@ -15,13 +15,27 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/docker/distribution/registry/client/auth"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultExpiresIn is the lifetime of a token in seconds if the auth server does not
+	// specify one, as per the docker token specification
+	defaultExpiresIn = 60
+
+	// expiryMargin is how long before its expiry a token is considered stale, so that it
+	// does not expire in flight
+	expiryMargin = 10 * time.Second
 )
 
 // Token is the Bearer token to be used with API calls
@@ -30,34 +44,124 @@ type Token interface {
 	Fresh() bool
 }
 
+// Refresher is a Token that may be renewed from the auth server that issued it
+type Refresher interface {
+	Token
+	Refresh(ctx context.Context) error
+}
+
 type token struct {
-	Token string `json:"token"`
-	fresh bool
+	Token        string `json:"token"`
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+
+	expiry time.Time
+
+	// set if the token was obtained by an authenticator, so that it may be refreshed
+	authenticator *authenticator
+	challenge     *Challenge
+
+	mu sync.RWMutex
 }
 
 func (t *token) String() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	return t.Token
 }
 
+// Fresh reports whether the token is not about to expire
 func (t *token) Fresh() bool {
-	return t.fresh
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return time.Now().Add(expiryMargin).Before(t.expiry)
+}
+
+// Refresh obtains a new token for the same scope from the auth server
+func (t *token) Refresh(ctx context.Context) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.authenticator == nil {
+		return errors.New("token cannot be refreshed")
+	}
+
+	nt, err := t.authenticator.fetch(ctx, t.challenge, t.RefreshToken)
+	if err != nil {
+		return
+	}
+
+	t.Token, t.expiry = nt.Token, nt.expiry
+	if nt.RefreshToken != "" {
+		t.RefreshToken = nt.RefreshToken
+	}
+
+	log.Debug().Msgf("Token refreshed, expires at %s.", t.expiry)
+
+	return
+}
+
+// NewTokenFromResp creates a token from the body of a response from an auth server.
+// Both the docker token response and the OAuth2 access token response are accepted.
+func NewTokenFromResp(respBody io.Reader) (Token, error) {
+	return newTokenFromResp(respBody)
 }
 
-// NewTokenFromResp creates a new token from a http response
-func NewTokenFromResp(respBody io.Reader) (t Token, err error) {
+func newTokenFromResp(respBody io.Reader) (t *token, err error) {
 	t = &token{}
-	if err = json.NewDecoder(respBody).Decode(&t); err != nil {
+	if err = json.NewDecoder(respBody).Decode(t); err != nil {
 		err = errors.WithStack(err)
 		return
 	}
-	if t.String() == "" {
+
+	if t.Token == "" {
+		t.Token = t.AccessToken
+	}
+	if t.Token == "" {
 		err = errors.New("malformed response from auth server")
+		return
+	}
+
+	if t.ExpiresIn <= 0 {
+		t.ExpiresIn = defaultExpiresIn
 	}
+
+	// the expiry is measured from the local time the token was received, rather than
+	// issued_at, so that it does not depend on the clocks being in sync
+	t.expiry = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+
 	return
 }
 
-// AddToRequest adds a token as a Bearer Authorization of a request
+// basicToken authenticates each request with a username and password
+type basicToken struct {
+	credentials Credentials
+}
+
+func (t *basicToken) String() string {
+	return ""
+}
+
+func (t *basicToken) Fresh() bool {
+	return true
+}
+
+// AddToRequest adds a token as the Authorization of a request, Basic or Bearer as appropriate.
+// A Bearer token that is about to expire is refreshed first.
 func AddToRequest(t auth.Scope, req *http.Request) {
+	switch tk := t.(type) {
+	case *basicToken:
+		tk.credentials.SetAuth(req)
+		return
+	case *token:
+		if tk.authenticator != nil && !tk.Fresh() {
+			if err := tk.Refresh(req.Context()); err != nil {
+				log.Warn().Err(err).Msg("Could not refresh expired token.")
+			}
+		}
+	}
+
 	if t != nil && t.String() != "" {
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t))
 	}
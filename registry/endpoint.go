@@ -1,21 +1,47 @@
 package registry
 
 import (
+	"context"
+	"net/http"
+
 	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
 	"github.com/docker/docker/registry"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
 )
 
 // GetEndpoint returns the endpoint associated with the reference
 func GetEndpoint(
+	ctx context.Context,
 	ref reference.Named,
 	repoInfo registry.RepositoryInfo,
 ) (
 	_ *registry.APIEndpoint,
 	err error,
 ) {
-	options := registry.ServiceOptions{}
-	options.InsecureRegistries = append(options.InsecureRegistries, "0.0.0.0/0")
+	return LookupEndpoint(ctx, repoInfo.Index.Name)
+}
+
+// insecureRegistries may be accessed over plain HTTP or without verifying their certificates
+var insecureRegistries []string
+
+// SetInsecureRegistries sets the registries (host[:port] or CIDR) that may be accessed over
+// plain HTTP or without verifying their certificates. As for docker, registries on localhost
+// are always insecure.
+func SetInsecureRegistries(registries []string) {
+	insecureRegistries = registries
+}
+
+// LookupEndpoint returns the endpoint of the registry with the given index name (i.e. host).
+// The endpoint uses HTTPS, with the CA and client certificates in the docker certs.d
+// directory for the registry, which are also used by httpclient.DefaultClient. Only an
+// insecure registry that does not accept HTTPS connections is accessed over plain HTTP.
+func LookupEndpoint(ctx context.Context, indexName string) (_ *registry.APIEndpoint, err error) {
+	options := registry.ServiceOptions{InsecureRegistries: insecureRegistries}
 
 	var registryService *registry.DefaultService
 	registryService, err = registry.NewService(options)
@@ -25,11 +51,60 @@ func GetEndpoint(
 	}
 
 	var endpoints []registry.APIEndpoint
-	endpoints, err = registryService.LookupPushEndpoints(repoInfo.Index.Name)
+	endpoints, err = registryService.LookupPushEndpoints(indexName)
+	if err != nil {
+		err = errors.Wrapf(err, "index name = %#v", indexName)
+		return
+	}
+
+	if len(endpoints) == 0 {
+		err = errors.Errorf("no endpoints found for %s", indexName)
+		return
+	}
+
+	// the HTTPS endpoint comes first, followed by the HTTP endpoint if the registry is insecure
+	for i := range endpoints {
+		endpoint := endpoints[i]
+
+		// copy the url, as the default endpoint url is shared
+		u := *endpoint.URL
+		endpoint.URL = &u
+
+		if u.Scheme == "https" {
+			httpclient.SetTLSConfig(u.Host, endpoint.TLSConfig)
+		}
+
+		if i == len(endpoints)-1 {
+			return &endpoint, nil
+		}
+
+		if err = ping(ctx, &endpoint); err == nil {
+			return &endpoint, nil
+		} else if ctx.Err() != nil {
+			return nil, errors.WithStack(ctx.Err())
+		}
+		log.Debug().Err(err).Msgf("Could not reach %s, trying the next endpoint.", &u)
+	}
+
+	return
+}
+
+// ping checks that the registry is reachable at the endpoint. Any response will do.
+func ping(ctx context.Context, endpoint *registry.APIEndpoint) (err error) {
+	urlStr, err := v2.NewURLBuilder(endpoint.URL, false).BuildBaseURL()
+	if err != nil {
+		return errors.Wrapf(err, "base = %s", endpoint.URL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	if err != nil {
+		return errors.Wrapf(err, "url = %s", urlStr)
+	}
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, httpclient.WithoutRetries(req), true, true)
 	if err != nil {
-		err = errors.Wrapf(err, "index name = %#v", repoInfo.Index.Name)
 		return
 	}
 
-	return &endpoints[0], nil
+	return utils.CheckedClose(resp.Body, nil)
 }
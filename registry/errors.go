@@ -0,0 +1,182 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// ErrorCode identifies the cause of an error reported by a registry
+type ErrorCode string
+
+// The error codes of the registry API
+const (
+	ErrorCodeBlobUnknown         ErrorCode = "BLOB_UNKNOWN"
+	ErrorCodeBlobUploadInvalid   ErrorCode = "BLOB_UPLOAD_INVALID"
+	ErrorCodeBlobUploadUnknown   ErrorCode = "BLOB_UPLOAD_UNKNOWN"
+	ErrorCodeDigestInvalid       ErrorCode = "DIGEST_INVALID"
+	ErrorCodeManifestBlobUnknown ErrorCode = "MANIFEST_BLOB_UNKNOWN"
+	ErrorCodeManifestInvalid     ErrorCode = "MANIFEST_INVALID"
+	ErrorCodeManifestUnknown     ErrorCode = "MANIFEST_UNKNOWN"
+	ErrorCodeManifestUnverified  ErrorCode = "MANIFEST_UNVERIFIED"
+	ErrorCodeNameInvalid         ErrorCode = "NAME_INVALID"
+	ErrorCodeNameUnknown         ErrorCode = "NAME_UNKNOWN"
+	ErrorCodeSizeInvalid         ErrorCode = "SIZE_INVALID"
+	ErrorCodeTagInvalid          ErrorCode = "TAG_INVALID"
+	ErrorCodeUnauthorized        ErrorCode = "UNAUTHORIZED"
+	ErrorCodeDenied              ErrorCode = "DENIED"
+	ErrorCodeUnsupported         ErrorCode = "UNSUPPORTED"
+	ErrorCodeTooManyRequests     ErrorCode = "TOOMANYREQUESTS"
+	ErrorCodeUnknown             ErrorCode = "UNKNOWN"
+)
+
+// maxErrorBody is the most of an error response that is read
+const maxErrorBody = 64 * 1024
+
+// Error is a single error in the body of an error response from a registry
+type Error struct {
+	Code    ErrorCode       `json:"code"`
+	Message string          `json:"message"`
+	Detail  json.RawMessage `json:"detail,omitempty"`
+}
+
+func (e Error) Error() string {
+	msg := string(e.Code)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if len(e.Detail) > 0 && !bytes.Equal(e.Detail, []byte("null")) {
+		msg += " (" + string(e.Detail) + ")"
+	}
+	return msg
+}
+
+// APIError is an unsuccessful response to a request to the registry API
+type APIError struct {
+	// Op describes the request that failed, e.g. "manifest upload"
+	Op         string
+	StatusCode int
+	Status     string
+	// Errors are decoded from the body of the response, if it had one
+	Errors []Error
+}
+
+func (e *APIError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("%s failed with status: %s", e.Op, e.Status)
+	}
+
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%s failed: %s", e.Op, strings.Join(msgs, "; "))
+}
+
+// Code is the code of the first error in the response. If the response had none, it is
+// inferred from the status.
+func (e *APIError) Code() ErrorCode {
+	if len(e.Errors) > 0 {
+		return e.Errors[0].Code
+	}
+
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		return ErrorCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrorCodeDenied
+	case http.StatusNotFound:
+		return ErrorCodeNameUnknown
+	case http.StatusTooManyRequests:
+		return ErrorCodeTooManyRequests
+	case http.StatusMethodNotAllowed:
+		return ErrorCodeUnsupported
+	}
+
+	return ErrorCodeUnknown
+}
+
+// Has reports whether the response contained an error with the given code
+func (e *APIError) Has(code ErrorCode) bool {
+	for _, err := range e.Errors {
+		if err.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Kind classifies the error by its code. Server errors are KindNetwork.
+func (e *APIError) Kind() utils.Kind {
+	switch e.Code() {
+	case ErrorCodeUnauthorized, ErrorCodeDenied:
+		return utils.KindAuth
+	case ErrorCodeNameUnknown,
+		ErrorCodeManifestUnknown,
+		ErrorCodeBlobUnknown,
+		ErrorCodeManifestBlobUnknown,
+		ErrorCodeBlobUploadUnknown:
+		return utils.KindNotFound
+	}
+
+	if e.StatusCode >= http.StatusInternalServerError {
+		return utils.KindNetwork
+	}
+
+	return utils.KindUnknown
+}
+
+// AsAPIError finds the APIError in the chain of err, if there is one
+func AsAPIError(err error) (*APIError, bool) {
+	var apiErr *APIError
+	if stderrors.As(errors.Cause(err), &apiErr) {
+		return apiErr, true
+	}
+	return nil, false
+}
+
+// newAPIError creates the error for an unexpected response to op. The errors array in the
+// body of the response is decoded if it has one; the body is not closed.
+func newAPIError(op string, resp *http.Response) error {
+	apiErr := &APIError{
+		Op:         op,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+	}
+
+	body := &struct {
+		Errors []Error `json:"errors"`
+	}{}
+
+	// the body is informational only, so a malformed one is ignored
+	if data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody)); err == nil {
+		if json.Unmarshal(data, body) == nil {
+			apiErr.Errors = body.Errors
+		}
+	}
+
+	return errors.WithStack(apiErr)
+}
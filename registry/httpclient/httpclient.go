@@ -15,47 +15,66 @@
 package httpclient
 
 import (
-	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// DefaultTimeout is the timeout of requests made with DefaultClient, unless another
+	// is set with SetTimeout
+	DefaultTimeout = 100 * time.Second
+)
+
 var (
 	// DefaultClient is a http client with timeouts set
 	DefaultClient = &http.Client{
-		Timeout:   100 * time.Second,
-		Transport: defaultTransport,
+		Timeout:   DefaultTimeout,
+		Transport: clientTransport,
 	}
-	defaultTransport = &http.Transport{
-		Dial: (&net.Dialer{
-			Timeout: 20 * time.Second,
-		}).Dial,
-		TLSHandshakeTimeout: 20 * time.Second,
+
+	// TransferClient is a http client without an overall timeout, for uploading and
+	// downloading blobs whose transfers are timed out by their progress instead
+	TransferClient = &http.Client{
+		Transport: clientTransport,
 	}
+
+	// each attempt of a retried request is traced
+	clientTransport = &retryingTransport{next: &tracingTransport{next: sharedTransport}}
 )
 
-// DoRequest wraps http.Client.Do but dumps the request and response with optional bodies
+// SetTimeout sets the timeout of requests made with DefaultClient. A timeout of 0
+// disables it.
+func SetTimeout(d time.Duration) {
+	DefaultClient.Timeout = d
+}
+
+// DoRequest wraps http.Client.Do but dumps the request and response with optional bodies.
+// Credentials and tokens are redacted from the dumps.
 func DoRequest(client *http.Client, req *http.Request, dumpReqBody, dumpRespBody bool) (*http.Response, error) {
 	dump, err := httputil.DumpRequestOut(req, dumpReqBody)
 	if err != nil {
-		return nil, errors.Wrapf(err, "%#v", req)
+		return nil, errors.Wrapf(err, "%s %s", req.Method, redactURL(req.URL))
 	}
-	log.Debug().Msg(req.URL.String())
-	log.Debug().Msgf("%s", dump)
+	log.Debug().Msg(redactURL(req.URL))
+	log.Debug().Msgf("%s", Redact(dump))
 
 	resp, err := client.Do(req)
 	if err != nil {
+		if uerr, ok := err.(*url.Error); ok {
+			uerr.URL = redactURL(req.URL)
+		}
 		return nil, errors.WithStack(err)
 	}
 
 	if dump, err = httputil.DumpResponse(resp, dumpRespBody); err != nil {
-		return nil, errors.Wrapf(err, "%#v", resp)
+		return nil, errors.Wrapf(err, "%s %s", req.Method, redactURL(req.URL))
 	}
-	log.Debug().Msgf("%s", dump)
+	log.Debug().Msgf("%s", Redact(dump))
 
 	return resp, err
 }
@@ -16,14 +16,27 @@ package httpclient_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
 )
 
 func TestHTTPClient(t *testing.T) {
@@ -49,3 +62,401 @@ func TestHTTPClient(t *testing.T) {
 
 	assert.Equal(body.String(), "OK")
 }
+
+func TestSetTLSConfig(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(`OK`))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+
+	get := func() error {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		require.NoError(err)
+
+		resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	// the certificate of the server is not trusted by default
+	assert.Error(get())
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	httpclient.SetTLSConfig(u.Host, &tls.Config{RootCAs: pool})
+	assert.NoError(get())
+
+	// the configuration is per host
+	httpclient.SetTLSConfig(u.Host, nil)
+	assert.Error(get())
+}
+
+func TestHTTP2(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(`OK`))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	httpclient.SetTLSConfig(u.Host, &tls.Config{RootCAs: pool})
+	defer httpclient.SetTLSConfig(u.Host, nil)
+	defer httpclient.SetTransportConfig(httpclient.DefaultTransportConfig)
+
+	for _, disable := range []bool{false, true} {
+		config := httpclient.DefaultTransportConfig
+		config.DisableHTTP2 = disable
+		httpclient.SetTransportConfig(config)
+
+		req, err := http.NewRequest("GET", server.URL, nil)
+		require.NoError(err)
+
+		resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+		if !assert.NoError(err) {
+			continue
+		}
+		assert.NoError(resp.Body.Close())
+
+		if disable {
+			assert.Equal(1, resp.ProtoMajor)
+		} else {
+			assert.Equal(2, resp.ProtoMajor)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// requests through a proxy have an absolute URL
+		if req.URL.IsAbs() {
+			proxied = append(proxied, req.URL.String())
+		}
+		_, _ = rw.Write([]byte(`OK`))
+	}))
+	defer proxy.Close()
+
+	u, err := url.Parse(proxy.URL)
+	require.NoError(err)
+
+	config := httpclient.DefaultTransportConfig
+	config.Proxy = u
+	httpclient.SetTransportConfig(config)
+	defer httpclient.SetTransportConfig(httpclient.DefaultTransportConfig)
+	defer httpclient.SetRetryPolicy(httpclient.DefaultRetryPolicy)
+	httpclient.SetRetryPolicy(httpclient.RetryPolicy{})
+
+	get := func(rawurl string) error {
+		// requests that bypass the proxy may never connect
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, "GET", rawurl, nil)
+		require.NoError(err)
+
+		resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	tests := []struct {
+		url     string
+		noProxy string
+		proxied bool
+	}{
+		{"http://registry.example.com/v2/", "", true},
+		{"http://registry.example.com/v2/", "other.example.com", true},
+		{"http://registry.example.com/v2/", ".example.com", false},
+		{"http://registry.example.com/v2/", "registry.example.com:443", false},
+		{"http://10.1.2.3/v2/", "10.0.0.0/8", false},
+		{"http://10.1.2.3/v2/", "*", false},
+		{proxy.URL + "/v2/", "", false},
+	}
+
+	for _, test := range tests {
+		proxied = nil
+		t.Setenv("NO_PROXY", test.noProxy)
+
+		err := get(test.url)
+		if test.proxied {
+			assert.NoError(err)
+			assert.Equal([]string{test.url}, proxied, test.url)
+		} else {
+			assert.Empty(proxied, test.url)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		dump     string
+		redacted string
+	}{
+		{
+			"GET /token?account=ahab&scope=repository%3Aa%2Fb%3Apull HTTP/1.1\r\nAuthorization: Basic YWhhYjpodW50ZXIy\r\n\r\n",
+			"GET /token?account=REDACTED&scope=repository%3Aa%2Fb%3Apull HTTP/1.1\r\nAuthorization: Basic REDACTED\r\n\r\n",
+		},
+		{
+			"HEAD /v2/ HTTP/1.1\r\nauthorization: Bearer abc.def.ghi\r\nCookie: a=b\r\n\r\n",
+			"HEAD /v2/ HTTP/1.1\r\nauthorization: Bearer REDACTED\r\nCookie: REDACTED\r\n\r\n",
+		},
+		{
+			"\r\n\r\nclient_id=crypto-cli&grant_type=refresh_token&refresh_token=secret&service=r",
+			"\r\n\r\nclient_id=crypto-cli&grant_type=refresh_token&refresh_token=REDACTED&service=r",
+		},
+		{
+			`{"token":"abc","access_token": "def","expires_in":60,"refresh_token":"ghi"}`,
+			`{"token":"REDACTED","access_token": "REDACTED","expires_in":60,"refresh_token":"REDACTED"}`,
+		},
+		{
+			"POST /v1/transit/decrypt/k HTTP/1.1\r\nX-Vault-Token: s.abc\r\n\r\n" + `{"data":{"plaintext":"a2V5"}}`,
+			"POST /v1/transit/decrypt/k HTTP/1.1\r\nX-Vault-Token: REDACTED\r\n\r\n" + `{"data":{"plaintext":"REDACTED"}}`,
+		},
+		{
+			"HTTP/1.1 307 Temporary Redirect\r\nLocation: https://s3.example.com/b?X-Amz-Credential=AKIA%2F&x-amz-signature=abc&X-Amz-Expires=1200\r\n\r\n",
+			"HTTP/1.1 307 Temporary Redirect\r\nLocation: https://s3.example.com/b?X-Amz-Credential=REDACTED&x-amz-signature=REDACTED&X-Amz-Expires=1200\r\n\r\n",
+		},
+		{
+			"GET /blobs/b?sv=2018-03-28&sig=abc%3D&se=2018 HTTP/1.1\r\n\r\n",
+			"GET /blobs/b?sv=2018-03-28&sig=REDACTED&se=2018 HTTP/1.1\r\n\r\n",
+		},
+		{"GET /v2/a/b/manifests/latest HTTP/1.1\r\n\r\n", "GET /v2/a/b/manifests/latest HTTP/1.1\r\n\r\n"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.redacted, string(httpclient.Redact([]byte(test.dump))))
+	}
+}
+
+func TestTrace(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		_, _ = rw.Write([]byte(`OK`))
+	}))
+	defer server.Close()
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	require.NoError(os.MkdirAll(dir, 0700))
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	filename := filepath.Join(dir, "trace.har")
+	trace, err := httpclient.StartTrace(filename)
+	require.NoError(err)
+
+	req, err := http.NewRequest("GET", server.URL+"/token?account=ahab&service=registry", nil)
+	require.NoError(err)
+	req.SetBasicAuth("ahab", "hunter2")
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	require.NoError(err)
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	require.NoError(err)
+	require.NoError(resp.Body.Close())
+
+	require.NoError(trace.Close())
+
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(err)
+	assert.NotContains(string(data), "ahab")
+	assert.NotContains(string(data), "YWhhYjpodW50ZXIy")
+
+	har := &struct {
+		Log struct {
+			Entries []struct {
+				Request struct {
+					Method  string
+					URL     string
+					Headers []struct{ Name, Value string }
+				}
+				Response struct {
+					Status  int
+					Content struct{ Size int64 }
+				}
+			}
+		}
+	}{}
+	require.NoError(json.Unmarshal(data, har))
+	require.Len(har.Log.Entries, 1)
+
+	e := har.Log.Entries[0]
+	assert.Equal("GET", e.Request.Method)
+	assert.Equal(server.URL+"/token?account=REDACTED&service=registry", e.Request.URL)
+	assert.Contains(e.Request.Headers, struct{ Name, Value string }{"Authorization", "Basic REDACTED"})
+	assert.Equal(http.StatusOK, e.Response.Status)
+	assert.Equal(int64(2), e.Response.Content.Size)
+}
+
+func TestTraceRedirect(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const presigned = "/storage/blob?X-Amz-Algorithm=AWS4-HMAC-SHA256" +
+		"&X-Amz-Credential=AKIAEXAMPLE%2F20180101%2Fus-east-1%2Fs3%2Faws4_request" +
+		"&X-Amz-Security-Token=FQoDYXdz&X-Amz-Signature=0123456789abcdef"
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v2/a/b/blobs/sha256:abc" {
+			http.Redirect(rw, req, presigned, http.StatusTemporaryRedirect)
+			return
+		}
+		_, _ = rw.Write([]byte(`blob`))
+	}))
+	defer server.Close()
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	require.NoError(os.MkdirAll(dir, 0700))
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	filename := filepath.Join(dir, "trace.har")
+	trace, err := httpclient.StartTrace(filename)
+	require.NoError(err)
+
+	req, err := http.NewRequest("GET", server.URL+"/v2/a/b/blobs/sha256:abc", nil)
+	require.NoError(err)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	require.NoError(err)
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	require.NoError(err)
+	require.NoError(resp.Body.Close())
+
+	require.NoError(trace.Close())
+
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(err)
+	for _, secret := range []string{"AKIAEXAMPLE", "FQoDYXdz", "0123456789abcdef"} {
+		assert.NotContains(string(data), secret)
+	}
+
+	har := &struct {
+		Log struct {
+			Entries []struct {
+				Request struct {
+					URL string
+				}
+				Response struct {
+					Status      int
+					RedirectURL string
+					Headers     []struct{ Name, Value string }
+				}
+			}
+		}
+	}{}
+	require.NoError(json.Unmarshal(data, har))
+	require.Len(har.Log.Entries, 2)
+
+	const want = "/storage/blob?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=REDACTED" +
+		"&X-Amz-Security-Token=REDACTED&X-Amz-Signature=REDACTED"
+
+	redirect := har.Log.Entries[0].Response
+	assert.Equal(http.StatusTemporaryRedirect, redirect.Status)
+	assert.Equal(want, redirect.RedirectURL)
+	assert.Contains(redirect.Headers, struct{ Name, Value string }{"Location", want})
+	assert.Equal(server.URL+want, har.Log.Entries[1].Request.URL)
+}
+
+func TestRetry(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	httpclient.SetRetryPolicy(httpclient.RetryPolicy{
+		MaxRetries: 3,
+		BaseDelay:  time.Millisecond,
+		MaxDelay:   10 * time.Millisecond,
+	})
+	defer httpclient.SetRetryPolicy(httpclient.DefaultRetryPolicy)
+
+	tests := []struct {
+		method   string
+		body     io.Reader
+		statuses []int
+		status   int
+		attempts int
+	}{
+		{"GET", nil, []int{http.StatusServiceUnavailable, http.StatusOK}, http.StatusOK, 2},
+		{"PUT", strings.NewReader("body"), []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusCreated}, http.StatusCreated, 3},
+		{"HEAD", nil, []int{http.StatusNotFound}, http.StatusNotFound, 1},
+		{"GET", nil, []int{500, 500, 500, 500, 500}, http.StatusInternalServerError, 4},
+		// not idempotent
+		{"POST", nil, []int{http.StatusServiceUnavailable, http.StatusAccepted}, http.StatusServiceUnavailable, 1},
+		// the body cannot be sent again
+		{"PUT", ioutil.NopCloser(strings.NewReader("body")), []int{http.StatusServiceUnavailable, http.StatusCreated}, http.StatusServiceUnavailable, 1},
+	}
+
+	for _, test := range tests {
+		attempts := 0
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if test.body != nil {
+				body, err := ioutil.ReadAll(req.Body)
+				assert.NoError(err)
+				assert.Equal("body", string(body))
+			}
+			rw.Header().Set("Retry-After", "0")
+			rw.WriteHeader(test.statuses[attempts])
+			attempts++
+		}))
+
+		req, err := http.NewRequest(test.method, server.URL, test.body)
+		require.NoError(err)
+
+		resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, false, true)
+		if assert.NoError(err) {
+			assert.Equal(test.status, resp.StatusCode, "%s %v", test.method, test.statuses)
+			assert.NoError(resp.Body.Close())
+		}
+		assert.Equal(test.attempts, attempts, "%s %v", test.method, test.statuses)
+
+		server.Close()
+	}
+}
+
+func TestRetryCancel(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	httpclient.SetRetryPolicy(httpclient.RetryPolicy{MaxRetries: 5, BaseDelay: time.Second, MaxDelay: time.Minute})
+	defer httpclient.SetRetryPolicy(httpclient.DefaultRetryPolicy)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Retry-After", "30")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	require.NoError(err)
+
+	start := time.Now()
+	_, err = httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	assert.Error(err)
+	assert.True(time.Since(start) < 5*time.Second)
+}
@@ -0,0 +1,123 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpclient
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces secrets in logs and traces
+const redacted = "REDACTED"
+
+// sensitiveParams are the query and form parameters that identify the user or hold secrets,
+// including the signatures and credentials of the presigned URLs of blob storage that
+// registries redirect to. They are matched case-insensitively.
+var sensitiveParams = []string{
+	"account", "password", "refresh_token", "access_token", "token",
+	"X-Amz-Signature", "X-Amz-Credential", "X-Amz-Security-Token",
+	"X-Goog-Signature", "X-Goog-Credential", "Signature", "sig",
+}
+
+// sensitiveHeaders are the headers that hold credentials or tokens
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Vault-Token"}
+
+// redactions match the secrets in a dump of a request or response. The first group of
+// each is kept and the rest of the match is replaced.
+var redactions = []*regexp.Regexp{
+	// the credentials of Authorization headers, keeping the scheme
+	regexp.MustCompile(`(?im)^((?:Proxy-)?Authorization:[ \t]*(?:\w+ )?)[^\r\n]*`),
+	regexp.MustCompile(`(?im)^((?:Set-)?Cookie:[ \t]*)[^\r\n]*`),
+	regexp.MustCompile(`(?im)^(X-Vault-Token:[ \t]*)[^\r\n]*`),
+	// query and form parameters
+	regexp.MustCompile(`(?i)([?&\s](?:` + strings.Join(sensitiveParams, "|") + `)=)[^&\s]*`),
+	// tokens in the JSON responses of auth servers, and data keys sent to and from a KMS
+	regexp.MustCompile(`("(?:token|access_token|refresh_token|identitytoken|plaintext)"\s*:\s*")[^"]*`),
+}
+
+// Redact removes credentials, tokens and account names from a dump of a request or response
+func Redact(dump []byte) []byte {
+	for _, re := range redactions {
+		dump = re.ReplaceAll(dump, []byte("${1}"+redacted))
+	}
+	return dump
+}
+
+// redactURL returns the url with the values of sensitive query parameters removed
+func redactURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+
+	v := *u
+	v.RawQuery = redactQuery(u).Encode()
+	return v.String()
+}
+
+// redactLocation returns the url of a Location header with the values of sensitive query
+// parameters removed
+func redactLocation(loc string) string {
+	if loc == "" {
+		return ""
+	}
+
+	u, err := url.Parse(loc)
+	if err != nil {
+		return redacted
+	}
+	return redactURL(u)
+}
+
+// redactQuery returns the query parameters of the url with the sensitive values removed
+func redactQuery(u *url.URL) url.Values {
+	q := u.Query()
+	for k := range q {
+		if isSensitiveParam(k) {
+			q.Set(k, redacted)
+		}
+	}
+	return q
+}
+
+func isSensitiveParam(k string) bool {
+	for _, p := range sensitiveParams {
+		if strings.EqualFold(k, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHeader returns a copy of h with the values of sensitive headers removed,
+// keeping the scheme of Authorization headers and all but the sensitive query parameters
+// of Location headers
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for i, v := range h["Location"] {
+		h["Location"][i] = redactLocation(v)
+	}
+	for _, k := range sensitiveHeaders {
+		for i, v := range h[k] {
+			if scheme := strings.Fields(v); strings.HasSuffix(k, "Authorization") && len(scheme) > 1 {
+				h[k][i] = scheme[0] + " " + redacted
+			} else {
+				h[k][i] = redacted
+			}
+		}
+	}
+	return h
+}
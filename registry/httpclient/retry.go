@@ -0,0 +1,239 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	stderrors "errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// RetryPolicy determines how requests that fail transiently are retried
+type RetryPolicy struct {
+	// MaxRetries is the number of times a request is retried, 0 disables retries
+	MaxRetries int
+	// BaseDelay is the delay before the first retry, which doubles with each retry
+	BaseDelay time.Duration
+	// MaxDelay bounds the delay before each retry, including delays requested by the
+	// registry with Retry-After
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used unless another is set with SetRetryPolicy
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 5,
+	BaseDelay:  500 * time.Millisecond,
+	MaxDelay:   30 * time.Second,
+}
+
+var (
+	retryPolicy   = DefaultRetryPolicy
+	retryPolicyMu sync.RWMutex
+)
+
+// SetRetryPolicy sets the retry policy of the clients in this package
+func SetRetryPolicy(p RetryPolicy) {
+	retryPolicyMu.Lock()
+	defer retryPolicyMu.Unlock()
+	retryPolicy = p
+}
+
+func currentRetryPolicy() RetryPolicy {
+	retryPolicyMu.RLock()
+	defer retryPolicyMu.RUnlock()
+	return retryPolicy
+}
+
+// retryingTransport retries requests that fail with a connection error or a transient
+// status, provided that they are idempotent and their body may be sent again. Blob chunk
+// uploads (PATCH) are also retried, as the registry rejects a chunk at the wrong offset.
+type retryingTransport struct {
+	next http.RoundTripper
+}
+
+func (rt *retryingTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	p := currentRetryPolicy()
+	if !retryable(req) {
+		p.MaxRetries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 {
+			if r, err = rewind(req); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err = rt.next.RoundTrip(r)
+		if attempt >= p.MaxRetries || !transient(req, resp, err) {
+			return resp, err
+		}
+
+		delay := p.delay(attempt, resp)
+		if err != nil {
+			log.Warn().Err(err).Msgf("%s %s failed, retrying in %s.", req.Method, redactURL(req.URL), delay)
+		} else {
+			log.Warn().Msgf("%s %s failed with status %s, retrying in %s.", req.Method, redactURL(req.URL), resp.Status, delay)
+			// drain the body so that the connection may be reused
+			_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+			_ = resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, errors.WithStack(req.Context().Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// noRetryKey marks the context of a request that should not be retried
+type noRetryKey struct{}
+
+// WithoutRetries returns a copy of the request that is not retried, e.g. to probe
+// whether a registry is reachable
+func WithoutRetries(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), noRetryKey{}, true))
+}
+
+// retryable reports whether the request may be sent more than once
+func retryable(req *http.Request) bool {
+	if req.Context().Value(noRetryKey{}) != nil {
+		return false
+	}
+
+	switch req.Method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS", "PATCH":
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// rewind copies the request with a fresh body
+func rewind(req *http.Request) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		r.Body = body
+	}
+	return r, nil
+}
+
+// transient reports whether the request failed in a way that may succeed if it is retried
+func transient(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// the request was cancelled or timed out by the caller, or it failed in a
+		// way that will not change
+		return req.Context().Err() == nil && !permanent(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// permanent reports whether the error is a failure to resolve the host of the registry
+// or to establish a trusted TLS connection to it
+func permanent(err error) bool {
+	err = errors.Cause(err)
+
+	var dnsErr *net.DNSError
+	if stderrors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return true
+	}
+
+	var (
+		verificationErr *tls.CertificateVerificationError
+		recordErr       tls.RecordHeaderError
+		alertErr        tls.AlertError
+		authorityErr    x509.UnknownAuthorityError
+		hostnameErr     x509.HostnameError
+		invalidErr      x509.CertificateInvalidError
+	)
+
+	return stderrors.As(err, &verificationErr) ||
+		stderrors.As(err, &recordErr) ||
+		stderrors.As(err, &alertErr) ||
+		stderrors.As(err, &authorityErr) ||
+		stderrors.As(err, &hostnameErr) ||
+		stderrors.As(err, &invalidErr)
+}
+
+// delay returns the time to wait before the retry following the given attempt: the delay
+// requested by the registry with Retry-After if any, otherwise exponential backoff with
+// full jitter
+func (p RetryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if d, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			if d > p.MaxDelay {
+				d = p.MaxDelay
+			}
+			return d
+		}
+	}
+
+	backoff := p.MaxDelay
+	if attempt < 32 && p.BaseDelay<<uint(attempt) < p.MaxDelay {
+		backoff = p.BaseDelay << uint(attempt)
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	// #nosec the jitter does not need to be cryptographically random
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// retryAfter parses the value of a Retry-After header, which is either a number of
+// seconds or a date
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,55 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpclient
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+)
+
+var (
+	// tlsConfigs holds the TLS configuration of connections to each host, keyed by host:port
+	tlsConfigs   = make(map[string]*tls.Config)
+	tlsConfigsMu sync.RWMutex
+)
+
+// SetTLSConfig sets the TLS configuration of connections to host (host[:port], the port
+// defaults to 443) made by the clients in this package, e.g. to trust a custom CA or to
+// present a client certificate. Connections to other hosts use the system defaults.
+// Idle connections are closed so that the configuration applies to every later request.
+func SetTLSConfig(host string, config *tls.Config) {
+	tlsConfigsMu.Lock()
+	tlsConfigs[withPort(host)] = config
+	tlsConfigsMu.Unlock()
+
+	sharedTransport.forget(withPort(host))
+}
+
+// withPort appends the default https port to host if it does not have a port
+func withPort(host string) string {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return net.JoinHostPort(host, "443")
+	}
+	return host
+}
+
+// tlsConfig returns the TLS configuration of connections to addr, or nil if it has none
+func tlsConfig(addr string) *tls.Config {
+	tlsConfigsMu.RLock()
+	defer tlsConfigsMu.RUnlock()
+
+	return tlsConfigs[addr]
+}
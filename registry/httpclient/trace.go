@@ -0,0 +1,272 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpclient
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// Trace records every request made by the clients in this package and writes them to a
+// file in the HTTP Archive (HAR) format when it is closed. Credentials, tokens, account
+// names and the signatures of presigned URLs are redacted, and bodies are not recorded.
+type Trace struct {
+	filename string
+	mu       sync.Mutex
+	entries  []*harEntry
+}
+
+var (
+	trace   *Trace
+	traceMu sync.RWMutex
+)
+
+// StartTrace starts recording requests to the file filename, which is written when the
+// returned Trace is closed
+func StartTrace(filename string) (t *Trace, err error) {
+	// check that the file may be written before any requests are made
+	fh, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create trace file: %s", filename)
+	}
+	if err = fh.Close(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	t = &Trace{filename: filename, entries: []*harEntry{}}
+
+	traceMu.Lock()
+	trace = t
+	traceMu.Unlock()
+
+	return t, nil
+}
+
+// Close stops recording requests and writes the trace file
+func (t *Trace) Close() (err error) {
+	traceMu.Lock()
+	if trace == t {
+		trace = nil
+	}
+	traceMu.Unlock()
+
+	fh, err := os.OpenFile(t.filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "could not write trace file: %s", t.filename)
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	har := &harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "crypto-cli", Version: "1.0"},
+		Entries: t.entries,
+	}}
+
+	enc := json.NewEncoder(fh)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(har); err != nil {
+		return errors.Wrapf(err, "could not write trace file: %s", t.filename)
+	}
+
+	return
+}
+
+func (t *Trace) add(e *harEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = append(t.entries, e)
+}
+
+func currentTrace() *Trace {
+	traceMu.RLock()
+	defer traceMu.RUnlock()
+	return trace
+}
+
+// tracingTransport records the requests it makes in the current trace, if any
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (tt *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t := currentTrace()
+	if t == nil {
+		return tt.next.RoundTrip(req)
+	}
+
+	e := &harEntry{
+		StartedDateTime: time.Now(),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         redactURL(req.URL),
+			HTTPVersion: req.Proto,
+			Headers:     harHeaders(redactHeader(req.Header)),
+			QueryString: []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    req.ContentLength,
+		},
+		Response: harResponse{
+			Headers:     []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+	}
+
+	for k, vs := range redactQuery(req.URL) {
+		for _, v := range vs {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{Name: k, Value: v})
+		}
+	}
+
+	resp, err := tt.next.RoundTrip(req)
+	e.Timings.Wait = milliseconds(time.Since(e.StartedDateTime))
+	if err != nil {
+		e.Comment = err.Error()
+		e.Time = e.Timings.Wait
+		t.add(e)
+		return resp, err
+	}
+
+	e.Response.Status = resp.StatusCode
+	e.Response.StatusText = http.StatusText(resp.StatusCode)
+	e.Response.HTTPVersion = resp.Proto
+	e.Response.Headers = harHeaders(redactHeader(resp.Header))
+	e.Response.RedirectURL = redactLocation(resp.Header.Get("Location"))
+	e.Response.Content.MimeType = resp.Header.Get("Content-Type")
+
+	// the entry is complete once the body has been read
+	resp.Body = &tracedBody{ReadCloser: resp.Body, trace: t, entry: e, received: time.Now()}
+
+	return resp, nil
+}
+
+// tracedBody counts the bytes read from a response body and adds its entry to the trace when closed
+type tracedBody struct {
+	io.ReadCloser
+	trace    *Trace
+	entry    *harEntry
+	received time.Time
+	size     int64
+	once     sync.Once
+}
+
+func (b *tracedBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.size += int64(n)
+	return
+}
+
+func (b *tracedBody) Close() error {
+	b.once.Do(func() {
+		b.entry.Timings.Receive = milliseconds(time.Since(b.received))
+		b.entry.Time = b.entry.Timings.Wait + b.entry.Timings.Receive
+		b.entry.Response.BodySize = b.size
+		b.entry.Response.Content.Size = b.size
+		b.trace.add(b.entry)
+	})
+	return b.ReadCloser.Close()
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	nvs := []harNameValue{}
+	for k, vs := range h {
+		for _, v := range vs {
+			nvs = append(nvs, harNameValue{Name: k, Value: v})
+		}
+	}
+	return nvs
+}
+
+// the subset of the HAR 1.2 format that is recorded
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string      `json:"version"`
+	Creator harCreator  `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
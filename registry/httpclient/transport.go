@@ -0,0 +1,243 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpclient
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout         = 20 * time.Second
+	tlsHandshakeTimeout = 20 * time.Second
+)
+
+// TransportConfig configures the transport shared by every client in this package
+type TransportConfig struct {
+	// Proxy is the proxy through which every request is made, except those to the hosts
+	// listed in NO_PROXY. If nil, the proxy is taken from HTTPS_PROXY and HTTP_PROXY.
+	Proxy *url.URL
+
+	// KeepAlive is the interval between TCP keep-alive probes of open connections
+	KeepAlive time.Duration
+
+	// MaxIdleConnsPerHost is the number of idle connections kept open to each host
+	MaxIdleConnsPerHost int
+
+	// IdleConnTimeout is how long an idle connection is kept open
+	IdleConnTimeout time.Duration
+
+	// DisableHTTP2 restricts connections to HTTP/1.1
+	DisableHTTP2 bool
+}
+
+// DefaultTransportConfig is the configuration of the transport unless another is set
+// with SetTransportConfig
+var DefaultTransportConfig = TransportConfig{
+	KeepAlive:           30 * time.Second,
+	MaxIdleConnsPerHost: 8,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// SetTransportConfig replaces the configuration of the transport shared by every client
+// in this package. Idle connections made under the previous configuration are closed.
+func SetTransportConfig(config TransportConfig) {
+	sharedTransport.reset(newTransport(config))
+}
+
+// newTransport creates the base transport for config. Connections to hosts with their own
+// TLS configuration are made by clones of it.
+func newTransport(config TransportConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: config.KeepAlive,
+	}
+
+	t := &http.Transport{
+		Proxy:                 proxyFunc(config.Proxy),
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     !config.DisableHTTP2,
+	}
+
+	if config.DisableHTTP2 {
+		// a non-nil, empty map prevents the upgrade to HTTP/2
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return t
+}
+
+// proxyFunc returns the function that selects the proxy of each request
+func proxyFunc(proxy *url.URL) func(*http.Request) (*url.URL, error) {
+	if proxy == nil {
+		return http.ProxyFromEnvironment
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if noProxy(req.URL.Hostname()) {
+			return nil, nil
+		}
+		return proxy, nil
+	}
+}
+
+// noProxy reports whether requests to host bypass the proxy, because it is a loopback
+// address or it matches an entry of NO_PROXY
+func noProxy(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return true
+	}
+
+	list := os.Getenv("NO_PROXY")
+	if list == "" {
+		list = os.Getenv("no_proxy")
+	}
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+
+		switch {
+		case entry == "":
+		case entry == "*":
+			return true
+		case ip != nil:
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && cidr.Contains(ip) {
+				return true
+			}
+			if ip.Equal(net.ParseIP(entry)) {
+				return true
+			}
+		default:
+			entry = strings.TrimPrefix(entry, ".")
+			host = strings.ToLower(host)
+			if host == entry || strings.HasSuffix(host, "."+entry) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// hostTransport sends requests with the base transport, except requests to hosts with
+// their own TLS configuration, which are sent with a clone of it
+type hostTransport struct {
+	mu    sync.RWMutex
+	base  *http.Transport
+	hosts map[string]*http.Transport
+}
+
+// sharedTransport is the transport shared by every client in this package
+var sharedTransport = &hostTransport{
+	base:  newTransport(DefaultTransportConfig),
+	hosts: make(map[string]*http.Transport),
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transportFor(req.URL).RoundTrip(req)
+}
+
+// transportFor selects the transport of requests to u
+func (t *hostTransport) transportFor(u *url.URL) *http.Transport {
+	t.mu.RLock()
+	base := t.base
+	t.mu.RUnlock()
+
+	if u.Scheme != "https" {
+		return base
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	config := tlsConfig(addr)
+	if config == nil {
+		return base
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ht, ok := t.hosts[addr]
+	if !ok {
+		ht = t.base.Clone()
+		ht.TLSClientConfig = config.Clone()
+		t.hosts[addr] = ht
+	}
+
+	return ht
+}
+
+// forget discards the transport of addr so that it is recreated with the current
+// TLS configuration
+func (t *hostTransport) forget(addr string) {
+	t.mu.Lock()
+	ht, ok := t.hosts[addr]
+	delete(t.hosts, addr)
+	base := t.base
+	t.mu.Unlock()
+
+	if ok {
+		ht.CloseIdleConnections()
+	}
+	base.CloseIdleConnections()
+}
+
+// reset replaces the base transport and discards the transports of every host
+func (t *hostTransport) reset(base *http.Transport) {
+	t.mu.Lock()
+	old, hosts := t.base, t.hosts
+	t.base, t.hosts = base, make(map[string]*http.Transport)
+	t.mu.Unlock()
+
+	old.CloseIdleConnections()
+	for _, ht := range hosts {
+		ht.CloseIdleConnections()
+	}
+}
+
+// CloseIdleConnections closes the idle connections of every transport
+func (t *hostTransport) CloseIdleConnections() {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	t.base.CloseIdleConnections()
+	for _, ht := range t.hosts {
+		ht.CloseIdleConnections()
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/docker/distribution/reference"
@@ -43,6 +42,7 @@ import (
 
 // PullImage pulls an image from a remote repository
 func PullImage(
+	ctx context.Context,
 	token dauth.Scope,
 	ref names.NamedTaggedRepository,
 	endpoint *registry.APIEndpoint,
@@ -51,7 +51,7 @@ func PullImage(
 ) (manifest *distribution.ImageManifest, err error) {
 	bldr := v2.NewURLBuilder(endpoint.URL, false)
 
-	manifest, err = PullManifest(token, ref, bldr, downloadDir)
+	manifest, err = PullManifest(ctx, token, ref, bldr, downloadDir)
 	if err != nil {
 		return nil, err
 	}
@@ -68,6 +68,7 @@ func PullImage(
 
 	log.Info().Msgf("Downloading config: %s.", manifest.Config.GetDigest())
 	filename, err := PullFromDigest(
+		ctx,
 		token,
 		ref,
 		manifest.Config.GetDigest(),
@@ -88,6 +89,7 @@ func PullImage(
 
 		log.Info().Msgf("Downloading: %s.", l.GetDigest())
 		filename, err = PullFromDigest(
+			ctx,
 			token,
 			ref,
 			l.GetDigest(),
@@ -105,6 +107,7 @@ func PullImage(
 
 // PullManifest pulls a manifest from the registry and parses it
 func PullManifest(
+	ctx context.Context,
 	token dauth.Scope,
 	ref reference.Named,
 	bldr *v2.URLBuilder,
@@ -115,7 +118,7 @@ func PullManifest(
 		return nil, errors.Wrapf(err, "ref = %v", ref)
 	}
 
-	req, err := http.NewRequest("GET", urlStr, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
 	if err != nil {
 		return nil, errors.Wrapf(err, "GET %s", urlStr)
 	}
@@ -123,9 +126,7 @@ func PullManifest(
 	// TODO: Handle list manifests
 	req.Header.Set("Accept", distribution.MediaTypeManifest)
 	req.Header.Set("Accept-Encoding", "gzip, deflate")
-	auth.AddToRequest(token, req)
-
-	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	resp, err := auth.DoRequest(httpclient.DefaultClient, token, req, true, true)
 	if resp != nil {
 		defer func() { err = utils.CheckedClose(resp.Body, err) }()
 	}
@@ -134,7 +135,7 @@ func PullManifest(
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("manifest download failed with status: " + resp.Status)
+		return nil, newAPIError("manifest download", resp)
 	}
 
 	manifest := &distribution.ImageManifest{DirName: dir}
@@ -152,6 +153,7 @@ func PullManifest(
 // digest is used to name the file, it is first verified to be a valid digest, so this cannot lead
 // to a file inclusion vulrenability.
 func PullFromDigest(
+	ctx context.Context,
 	token dauth.Scope,
 	ref reference.Named,
 	d digest.Digest,
@@ -167,50 +169,34 @@ func PullFromDigest(
 		return "", errors.Wrapf(err, "%#v", ref)
 	}
 
-	req, err := http.NewRequest("GET", urlStr, nil)
+	// abandon the download if it stalls
+	ctx, reset, stop := withIdleTimeout(ctx)
+	defer stop()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
 	if err != nil {
 		return "", errors.Wrapf(err, "GET %s", urlStr)
 	}
 
 	req.Header.Set("Accept", distribution.MediaTypeLayer)
 	req.Header.Set("Accept-Encoding", "gzip, deflate")
-	auth.AddToRequest(token, req)
-
-	ctx, cancel := context.WithCancel(context.Background())
-	req = req.WithContext(ctx)
-
-	errCh := make(chan error)
-	defer close(errCh)
-
-	// timeout
-	timer := time.AfterFunc(100*time.Second, cancel)
-
-	go download(ctx, req, timer, dir, fn, d, errCh)
 
-	select {
-	case <-ctx.Done():
-		err = errors.New("request timed out")
-		return
-	default:
+	if err = download(token, req, reset, fn, d); err != nil {
+		return "", errors.Wrapf(transferErr(ctx, err), "download of %s failed", d)
 	}
 
-	err = <-errCh
 	return
 }
 
 // download handles the downloading of the blob file in PullFromDigest
 func download(
-	ctx context.Context,
+	token dauth.Scope,
 	req *http.Request,
-	timer *time.Timer,
-	dir, fn string,
+	reset func(),
+	fn string,
 	d digest.Digest,
-	errCh chan<- error,
-) {
-	var err error
-	defer func() { errCh <- err }()
-
-	resp, err := httpclient.DoRequest(&http.Client{}, req, true, false)
+) (err error) {
+	resp, err := auth.DoRequest(httpclient.TransferClient, token, req, true, false)
 	if resp != nil {
 		defer func() { err = utils.CheckedClose(resp.Body, err) }()
 	}
@@ -219,18 +205,16 @@ func download(
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		err = errors.Errorf("Failed to download blob %s", fn)
-		return
+		return newAPIError("blob download", resp)
 	}
 
 	fh, err := os.Create(fn)
 	if err != nil {
-		err = errors.Wrapf(err, "filename = %s", fn)
-		return
+		return errors.Wrapf(err, "filename = %s", fn)
 	}
 	defer func() { err = utils.CheckedClose(fh, err) }()
 
-	err = processResp(resp, d, fn, fh, timer)
+	return processResp(resp, d, fn, fh, reset)
 }
 
 // processResp handles the response to the request to download a blob
@@ -241,7 +225,7 @@ func processResp(
 	d digest.Digest,
 	fn string,
 	fh io.WriteCloser,
-	timer *time.Timer,
+	reset func(),
 ) (err error) {
 	bar := pb.New(int(resp.ContentLength)).SetUnits(pb.U_BYTES)
 	vw := d.Verifier()
@@ -251,7 +235,7 @@ func processResp(
 
 	// reset timeout everytime 1 KiB is downloaded
 	for {
-		timer.Reset(100 * time.Second)
+		reset()
 		_, err = io.CopyN(mw, resp.Body, 1024)
 		if err == io.EOF {
 			break
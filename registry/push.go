@@ -15,13 +15,15 @@
 package registry
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
-	"time"
 
 	"github.com/docker/distribution/reference"
 	"github.com/docker/distribution/registry/api/v2"
@@ -40,6 +42,7 @@ import (
 
 // PushImage pushes the config, layers and mainifest to the nominated registry, in that order
 func PushImage(
+	ctx context.Context,
 	token dauth.Scope,
 	ref reference.Named,
 	manifest *distribution.ImageManifest,
@@ -47,17 +50,17 @@ func PushImage(
 ) error {
 	trimed := names.TrimNamed(ref)
 
-	if err := PushLayer(token, trimed, manifest.Config, endpoint); err != nil {
+	if err := PushLayer(ctx, token, trimed, manifest.Config, endpoint); err != nil {
 		return err
 	}
 	for _, l := range manifest.Layers {
-		if err := PushLayer(token, trimed, l, endpoint); err != nil {
+		if err := PushLayer(ctx, token, trimed, l, endpoint); err != nil {
 			return err
 		}
 	}
 	log.Info().Msg("Layers and config uploaded successfully.")
 
-	mdigest, err := PushManifest(token, ref, manifest, endpoint)
+	mdigest, err := PushManifest(ctx, token, ref, manifest, endpoint)
 	if err != nil {
 		return err
 	}
@@ -68,6 +71,7 @@ func PushImage(
 
 // PushManifest puts a manifest on the registry
 func PushManifest(
+	ctx context.Context,
 	token dauth.Scope,
 	ref reference.Named,
 	manifest *distribution.ImageManifest,
@@ -80,20 +84,14 @@ func PushManifest(
 		return
 	}
 
-	// a pipe allows using the struct directly as the http body
-	// w/o copying to a buffer
-	pr, pw := io.Pipe()
-	errChan := make(chan error, 1)
-	defer close(errChan)
-
-	go func() {
-		defer func() { errChan <- pw.Close() }()
-		enc := json.NewEncoder(pw)
-		enc.SetIndent("", "\t")
-		errChan <- enc.Encode(manifest)
-	}()
+	// the manifest is buffered so that the request may be retried if the token is rejected
+	body, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
 
-	req, err := http.NewRequest("PUT", urlStr, pr)
+	req, err := http.NewRequestWithContext(ctx, "PUT", urlStr, bytes.NewReader(body))
 	if err != nil {
 		err = errors.Wrapf(err, "url = %v", urlStr)
 		return
@@ -102,9 +100,8 @@ func PushManifest(
 	req.Header.Set("Accept", "application/json, */*")
 	req.Header.Set("Accept-Encoding", "gzip, deflate")
 	req.Header.Set("Content-Type", distribution.MediaTypeManifest)
-	auth.AddToRequest(token, req)
 
-	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	resp, err := auth.DoRequest(httpclient.DefaultClient, token, req, true, true)
 	if resp != nil {
 		defer func() { err = utils.CheckedClose(resp.Body, err) }()
 	}
@@ -112,14 +109,8 @@ func PushManifest(
 		return
 	}
 
-	// close the channel after request is done
-	if err = utils.ConcatErrChan(errChan, 2); err != nil {
-		err = errors.WithStack(err)
-		return
-	}
-
 	if resp.StatusCode != http.StatusCreated {
-		err = errors.New("manifest upload failed with status: " + resp.Status)
+		err = newAPIError("manifest upload", resp)
 		return
 	}
 
@@ -128,6 +119,7 @@ func PushManifest(
 
 // PushLayer pushes a layer to the registry, checking if it exists
 func PushLayer(
+	ctx context.Context,
 	token dauth.Scope,
 	ref reference.Named,
 	layer distribution.Blob,
@@ -137,7 +129,7 @@ func PushLayer(
 	dig := names.AppendDigest(sep, layer.GetDigest())
 	bldr := v2.NewURLBuilder(endpoint.URL, false)
 
-	exists, err := layerExists(token, dig, bldr)
+	exists, err := layerExists(ctx, token, dig, bldr)
 	if err != nil {
 		return
 	} else if exists {
@@ -148,37 +140,40 @@ func PushLayer(
 	log.Info().Msgf("Blob %s is new, proceed to upload.", layer.GetDigest())
 
 	// query the server for which location to upload to
-	loc, err := getUploadLoc(token, dig, bldr, layer)
+	loc, err := getUploadLoc(ctx, token, dig, bldr, layer)
 	if err != nil {
 		return
 	}
 
 	// now actually upload the blob
-	return uploadBlob(loc, token, dig, bldr, layer)
+	return uploadBlob(ctx, loc, token, dig, bldr, layer)
 }
 
 // layerExists checks if the layer already exists on the repository
-func layerExists(token dauth.Scope, ref reference.Canonical, bldr *v2.URLBuilder) (b bool, err error) {
+func layerExists(
+	ctx context.Context,
+	token dauth.Scope,
+	ref reference.Canonical,
+	bldr *v2.URLBuilder,
+) (b bool, err error) {
 	layerURLStr, err := bldr.BuildBlobURL(ref)
 	if err != nil {
 		err = errors.Wrapf(err, "%#v", ref)
 		return
 	}
 
-	req, err := http.NewRequest("HEAD", layerURLStr, nil)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", layerURLStr, nil)
 	if err != nil {
 		err = errors.Wrapf(err, "%v", layerURLStr)
 		return
 	}
 
-	auth.AddToRequest(token, req)
-
-	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	resp, err := auth.DoRequest(httpclient.DefaultClient, token, req, true, true)
 	if resp != nil {
 		defer func() { err = utils.CheckedClose(resp.Body, err) }()
 	}
 	if err != nil {
-		err = errors.Wrapf(err, "%v", req)
+		err = errors.Wrapf(err, "HEAD %s", layerURLStr)
 		return
 	}
 
@@ -189,10 +184,9 @@ func layerExists(token dauth.Scope, ref reference.Canonical, bldr *v2.URLBuilder
 		b = true
 	case http.StatusNotFound:
 		b = false
-	case http.StatusUnauthorized:
-		err = errors.Errorf("this account is not authorised to access the repository: %s", ref.Name())
 	default:
-		err = errors.New("error testing exsistence of layer")
+		// the response to HEAD has no body, so the error is inferred from the status
+		err = newAPIError(fmt.Sprintf("check for blob %s", ref.Digest()), resp)
 	}
 
 	return
@@ -200,6 +194,7 @@ func layerExists(token dauth.Scope, ref reference.Canonical, bldr *v2.URLBuilder
 
 // getUploadLoc optains the urlString to upload the blob to by querying the API
 func getUploadLoc(
+	ctx context.Context,
 	token dauth.Scope,
 	dig reference.Named,
 	bldr *v2.URLBuilder,
@@ -212,15 +207,13 @@ func getUploadLoc(
 		return
 	}
 
-	req, err := http.NewRequest("POST", uploadURLStr, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", uploadURLStr, nil)
 	if err != nil {
 		err = errors.Wrapf(err, "could not make req = %v", req)
 		return
 	}
 
-	auth.AddToRequest(token, req)
-
-	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	resp, err := auth.DoRequest(httpclient.DefaultClient, token, req, true, true)
 	if resp != nil {
 		defer func() { err = utils.CheckedClose(resp.Body, err) }()
 	}
@@ -234,10 +227,8 @@ func getUploadLoc(
 		if loc == "" {
 			err = errors.New("server did not return location to upload to")
 		}
-	case http.StatusUnauthorized:
-		err = errors.Errorf("this account is not authorised to access the repository: %s", dig.Name())
 	default:
-		err = errors.Errorf("upload of layer %v was not accepted", layerData.GetDigest())
+		err = newAPIError(fmt.Sprintf("upload of blob %s", layerData.GetDigest()), resp)
 	}
 
 	return
@@ -245,12 +236,13 @@ func getUploadLoc(
 
 // uploadBlob uploads the blob to the given urlString
 func uploadBlob(
+	ctx context.Context,
 	loc string,
 	token dauth.Scope,
 	dig reference.Canonical,
 	bldr *v2.URLBuilder,
 	blob distribution.Blob,
-) error {
+) (err error) {
 	u, err := url.Parse(loc)
 	if err != nil {
 		return errors.Wrapf(err, "loc = %v", loc)
@@ -274,50 +266,47 @@ func uploadBlob(
 	}
 	defer func() { err = utils.CheckedClose(blobFH, err) }()
 
-	// timeout
-	ctx, cancel := context.WithCancel(context.Background())
-	timer := time.AfterFunc(10*time.Second, cancel)
+	// abandon the upload if it stalls
+	ctx, reset, stop := withIdleTimeout(ctx)
+	defer stop()
+
 	bar := pb.New64(blob.GetSize()).SetUnits(pb.U_BYTES)
 	pr := bar.NewProxyReader(blobFH)
-	trr := utils.NewResetReader(pr, func() { timer.Reset(20 * time.Second) })
+	trr := utils.NewResetReader(pr, reset)
 
-	errCh := make(chan error)
-	defer close(errCh)
-
-	req, err := http.NewRequest("PUT", u.String(), trr)
+	req, err := http.NewRequestWithContext(ctx, "PUT", u.String(), trr)
 	if err != nil {
 		return errors.Wrapf(err, "could not make req = %v", req)
 	}
 
-	req = req.WithContext(ctx)
 	req.ContentLength = blob.GetSize()
 	req.Header.Set("Content-Type", "application/octect-stream")
-	auth.AddToRequest(token, req)
 
-	go upload(req, bar, blob, errCh)
+	// the blob is read again from the start if the upload is retried
+	req.GetBody = func() (io.ReadCloser, error) {
+		if _, err := blobFH.Seek(0, io.SeekStart); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		bar.Set(0)
+		return ioutil.NopCloser(trr), nil
+	}
 
-	select {
-	case <-ctx.Done():
-		return errors.New("request timed out")
-	default:
+	if err = upload(token, req, bar); err != nil {
+		return errors.Wrapf(transferErr(ctx, err), "upload of %s failed", blob.GetDigest())
 	}
 
-	return <-errCh
+	return nil
 }
 
 // upload executes the upload request in uploadBlob
 func upload(
+	token dauth.Scope,
 	req *http.Request,
 	bar *pb.ProgressBar,
-	blob distribution.Blob,
-	errCh chan<- error,
-) {
-	var err error
-	defer func() { errCh <- err }()
-
+) (err error) {
 	bar.Start()
 
-	resp, err := httpclient.DoRequest(http.DefaultClient, req, false, true)
+	resp, err := auth.DoRequest(httpclient.TransferClient, token, req, false, true)
 	if resp != nil {
 		defer func() { err = utils.CheckedClose(resp.Body, err) }()
 	}
@@ -329,6 +318,8 @@ func upload(
 	}
 
 	if resp.StatusCode != http.StatusCreated {
-		err = errors.Errorf("upload of blob %s failed with status %s", blob.GetFilename(), resp.Status)
+		err = newAPIError("blob upload", resp)
 	}
+
+	return
 }
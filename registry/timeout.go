@@ -0,0 +1,63 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// DefaultIdleTimeout is how long a blob upload or download may make no progress before it
+// is abandoned, unless another timeout is set with SetIdleTimeout
+const DefaultIdleTimeout = 60 * time.Second
+
+// idleTimeout is how long a blob transfer may make no progress before it is abandoned
+var idleTimeout = DefaultIdleTimeout
+
+// SetIdleTimeout sets how long a blob upload or download may make no progress before it is
+// abandoned. A timeout of 0 disables it.
+func SetIdleTimeout(d time.Duration) {
+	idleTimeout = d
+}
+
+// withIdleTimeout returns a context that is cancelled when ctx is, or if reset is not
+// called for the idle timeout. The cause of the cancellation is available from
+// context.Cause. stop releases the resources of the context.
+func withIdleTimeout(ctx context.Context) (_ context.Context, reset func(), stop func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	d := idleTimeout
+	if d <= 0 {
+		return ctx, func() {}, func() { cancel(nil) }
+	}
+
+	timer := time.AfterFunc(d, func() {
+		cancel(utils.WithKind(utils.KindNetwork, errors.Errorf("no progress for %s", d)))
+	})
+
+	return ctx, func() { timer.Reset(d) }, func() { timer.Stop(); cancel(nil) }
+}
+
+// transferErr explains why a transfer that was performed under ctx failed with err
+func transferErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return errors.WithStack(context.Cause(ctx))
+	}
+	return err
+}
@@ -30,7 +30,7 @@ func CleanUp(dir string, err error) error {
 	}
 	if err2 := RemoveFunc(dir); err2 != nil {
 		if err != nil {
-			err2 = errors.Wrapf(err, err2.Error())
+			err2 = errors.Wrap(err, err2.Error())
 		}
 		err = errors.Wrapf(err2, "could not clean up temp files in: %s", dir)
 	}
@@ -16,12 +16,62 @@ package utils
 
 import (
 	"bytes"
+	"fmt"
+	"io"
+	"net"
 )
 
-// Error is an error type that may be used to turn off the stack trace
+// Kind classifies an error, e.g. so that each kind of failure has its own exit status
+type Kind int
+
+const (
+	// KindUnknown is an error that has not been classified
+	KindUnknown Kind = iota
+	// KindUsage is an invalid command line or option
+	KindUsage
+	// KindAuth is a rejection of the credentials or access by a registry
+	KindAuth
+	// KindCrypto is a failure to decrypt or authenticate data, e.g. because the passphrase
+	// is wrong or the image was tampered with
+	KindCrypto
+	// KindNotFound is a missing image, repository or blob
+	KindNotFound
+	// KindNetwork is a failure to connect or talk to a registry
+	KindNetwork
+	// KindDaemon is a failure of the local docker daemon
+	KindDaemon
+	// KindPolicy is a refusal to decrypt an image that is outside the decryption policy,
+	// e.g. because it is in a legacy format or its keys are too costly to derive
+	KindPolicy
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindUsage:
+		return "usage"
+	case KindAuth:
+		return "auth"
+	case KindCrypto:
+		return "crypto"
+	case KindNotFound:
+		return "not found"
+	case KindNetwork:
+		return "network"
+	case KindDaemon:
+		return "daemon"
+	case KindPolicy:
+		return "policy"
+	}
+	return "unknown"
+}
+
+// Error is an error type that may be used to turn off the stack trace and to classify
+// an error
 type Error struct {
 	errtext  string
 	HasStack bool
+	kind     Kind
+	cause    error
 }
 
 // StripTrace cause the stack trace to not print on the error
@@ -32,18 +82,86 @@ func StripTrace(e error) error {
 
 // NewError creates a new Error
 func NewError(errtext string, hasStack bool) Error {
-	return Error{errtext, hasStack}
+	return Error{errtext: errtext, HasStack: hasStack}
 }
 
 // WrapError creates a new Error
 func WrapError(err error, hasStack bool) Error {
-	return Error{err.Error(), hasStack}
+	return Error{errtext: err.Error(), HasStack: hasStack}
+}
+
+// NewKindError creates a new Error of the given kind without a stack trace
+func NewKindError(kind Kind, errtext string) Error {
+	return Error{errtext: errtext, kind: kind}
+}
+
+// WithKind classifies err, keeping its message and stack trace. It returns nil if err is nil.
+func WithKind(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return Error{errtext: err.Error(), HasStack: true, kind: kind, cause: err}
 }
 
 func (e Error) Error() string {
 	return e.errtext
 }
 
+// Kind is the kind of the error
+func (e Error) Kind() Kind {
+	return e.kind
+}
+
+// Unwrap returns the error classified by WithKind, if any
+func (e Error) Unwrap() error {
+	return e.cause
+}
+
+// Format prints the stack trace of the classified error with %+v
+func (e Error) Format(s fmt.State, verb rune) {
+	switch {
+	case verb == 'v' && s.Flag('+') && e.cause != nil:
+		fmt.Fprintf(s, "%+v", e.cause)
+	case verb == 'q':
+		fmt.Fprintf(s, "%q", e.errtext)
+	default:
+		_, _ = io.WriteString(s, e.errtext)
+	}
+}
+
+// KindOf returns the kind of err: that of the first error in its chain with a Kind method
+// that returns a known kind. Otherwise network errors are KindNetwork and others are
+// KindUnknown.
+func KindOf(err error) Kind {
+	for err != nil {
+		if k, ok := err.(interface{ Kind() Kind }); ok && k.Kind() != KindUnknown {
+			return k.Kind()
+		}
+
+		if _, ok := err.(net.Error); ok {
+			return KindNetwork
+		}
+
+		switch e := err.(type) {
+		case Errors:
+			for _, err := range e {
+				if k := KindOf(err); k != KindUnknown {
+					return k
+				}
+			}
+			return KindUnknown
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return KindUnknown
+		}
+	}
+
+	return KindUnknown
+}
+
 // Errors holds mutiple errors
 type Errors []error
 
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -209,6 +210,38 @@ func TestError(t *testing.T) {
 	}
 }
 
+func TestKindOf(t *testing.T) {
+	assert := assert.New(t)
+
+	crypto := utils.WithKind(utils.KindCrypto, errors.New("authentication failed"))
+
+	tests := []struct {
+		err  error
+		kind utils.Kind
+	}{
+		{nil, utils.KindUnknown},
+		{errors.New("an error"), utils.KindUnknown},
+		{utils.NewError("an error", false), utils.KindUnknown},
+		{utils.NewKindError(utils.KindUsage, "bad flag"), utils.KindUsage},
+		{crypto, utils.KindCrypto},
+		{errors.Wrap(crypto, "decrypting layer"), utils.KindCrypto},
+		{fmt.Errorf("decrypting layer: %w", crypto), utils.KindCrypto},
+		{utils.Errors{errors.New("an error"), crypto}, utils.KindCrypto},
+		{errors.WithStack(&net.OpError{Op: "dial", Err: errors.New("connection refused")}), utils.KindNetwork},
+		{utils.WithKind(utils.KindDaemon, &net.OpError{Op: "dial", Err: errors.New("refused")}), utils.KindDaemon},
+		{errors.Wrap(utils.NewKindError(utils.KindPolicy, "legacy format"), "decrypting layer"), utils.KindPolicy},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.kind, utils.KindOf(test.err), "%v", test.err)
+	}
+
+	// the classified error keeps its message and stack trace
+	assert.Nil(utils.WithKind(utils.KindAuth, nil))
+	assert.EqualError(crypto, "authentication failed")
+	assert.Contains(fmt.Sprintf("%+v", crypto), "TestKindOf")
+}
+
 func TestErrors(t *testing.T) {
 	assert := assert.New(t)
 